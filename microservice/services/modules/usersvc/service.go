@@ -2,6 +2,7 @@ package usersvc
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"encoding/json"
@@ -15,6 +16,7 @@ import (
 
 	"go/microservice/services/config"
 	"go/microservice/services/models"
+	"go/redisclient"
 )
 
 // Service describes a service that adds things together.
@@ -38,52 +40,29 @@ type redisCmd struct {
 
 type basicService struct {
 	cfg      *config.Config
-	pool     *redis.Pool
-	syncPool *redis.Pool
+	pool     *redisclient.Client
+	syncPool *redisclient.Client
 	node     string
 }
 
 func NewBasicService(cfg *config.Config, node string) Service {
-	pool := &redis.Pool{
-		MaxIdle:     5,
-		IdleTimeout: 300 * time.Second,
-		// Other pool configuration not shown in this example.
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", cfg.REDIS_HOST_app)
-			if err != nil {
-				return nil, err
-			}
-			if _, err := c.Do("AUTH", cfg.REDIS_PWD_app); err != nil {
-				c.Close()
-				return nil, err
-			}
-			if _, err := c.Do("SELECT", cfg.REDIS_DB_app); err != nil {
-				c.Close()
-				return nil, err
-			}
-			return c, nil
-		},
+	pool, err := redisclient.New(redisclient.NewConfig(cfg.REDIS_HOST_app, cfg.REDIS_PWD_app, cfg.REDIS_DB_app))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	syncPool := &redis.Pool{
-		MaxIdle:     5,
-		IdleTimeout: 300 * time.Second,
-		// Other pool configuration not shown in this example.
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", cfg.REDIS_HOST_pubsub)
-			if err != nil {
-				return nil, err
-			}
-			if _, err := c.Do("AUTH", cfg.REDIS_PWD_pubsub); err != nil {
-				c.Close()
-				return nil, err
-			}
-			if _, err := c.Do("SELECT", cfg.REDIS_DB_pubsub); err != nil {
-				c.Close()
-				return nil, err
-			}
-			return c, nil
-		},
+	//没有单独配置同步用的redis时使用业务redis
+	syncCfg := redisclient.NewConfig(cfg.REDIS_HOST_app, cfg.REDIS_PWD_app, cfg.REDIS_DB_app)
+	if cfg.REDIS_HOST_pubsub != "" {
+		syncCfg = redisclient.NewConfig(cfg.REDIS_HOST_pubsub, cfg.REDIS_PWD_pubsub, cfg.REDIS_DB_pubsub)
+	}
+	//订阅连接长时间没有消息，不能设置读超时
+	syncCfg.ReadTimeout = 0
+	syncPool, err := redisclient.New(syncCfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	bs := basicService{
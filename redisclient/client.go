@@ -0,0 +1,177 @@
+package redisclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	MODE_STANDALONE = "standalone" //单机
+	MODE_SENTINEL   = "sentinel"   //哨兵，自动切换到新的master
+	MODE_CLUSTER    = "cluster"    //集群，按key的slot路由
+)
+
+type Config struct {
+	Mode       string `yaml:"mode"`        //standalone, sentinel, cluster
+	Host       string `yaml:"host"`        //单机为 host:port，哨兵和集群为逗号分隔的多个地址
+	MasterName string `yaml:"master_name"` //哨兵模式的master名称
+	Pwd        string `yaml:"pwd" secret:"true"`
+	Db         int    `yaml:"db"` //集群模式只能为0
+
+	MaxIdle             int           `yaml:"max_idle"`              //最大空闲连接数
+	MaxActive           int           `yaml:"max_active"`            //最大连接数，达到上限时等待
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`          //空闲连接超时关闭
+	ConnectTimeout      time.Duration `yaml:"connect_timeout"`       //建立连接超时
+	ReadTimeout         time.Duration `yaml:"read_timeout"`          //读超时
+	WriteTimeout        time.Duration `yaml:"write_timeout"`         //写超时
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"` //连接空闲超过该时间，取出时先检查连接可用
+}
+
+func NewConfig(host string, pwd string, db int) *Config {
+	return &Config{
+		Mode:                MODE_STANDALONE,
+		Host:                host,
+		Pwd:                 pwd,
+		Db:                  db,
+		MaxIdle:             16,
+		MaxActive:           128,
+		IdleTimeout:         300 * time.Second,
+		ConnectTimeout:      3 * time.Second,
+		ReadTimeout:         3 * time.Second,
+		WriteTimeout:        3 * time.Second,
+		HealthCheckInterval: 30 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	switch c.Mode {
+	case "", MODE_STANDALONE:
+		if c.Host == "" {
+			return errors.New("redis host is required")
+		}
+	case MODE_SENTINEL:
+		if c.Host == "" || c.MasterName == "" {
+			return errors.New("redis host (sentinel addresses) and master_name are required in sentinel mode")
+		}
+	case MODE_CLUSTER:
+		if c.Host == "" {
+			return errors.New("redis host (cluster seed addresses) is required in cluster mode")
+		}
+		if c.Db != 0 {
+			return fmt.Errorf("redis db must be 0 in cluster mode, got %d", c.Db)
+		}
+	default:
+		return fmt.Errorf("unknown redis mode: %s", c.Mode)
+	}
+
+	if c.Db < 0 {
+		return fmt.Errorf("redis db must not be negative, got %d", c.Db)
+	}
+	if c.MaxActive < 0 || c.MaxIdle < 0 {
+		return errors.New("redis max_idle and max_active must not be negative")
+	}
+	if c.MaxActive > 0 && c.MaxIdle > c.MaxActive {
+		return fmt.Errorf("redis max_idle %d must not exceed max_active %d", c.MaxIdle, c.MaxActive)
+	}
+	return nil
+}
+
+func (c *Config) hosts() []string {
+	hosts := []string{}
+	for _, host := range strings.Split(c.Host, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func (c *Config) dialOptions() []redis.DialOption {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(c.ConnectTimeout),
+		redis.DialReadTimeout(c.ReadTimeout),
+		redis.DialWriteTimeout(c.WriteTimeout),
+	}
+	if c.Pwd != "" {
+		options = append(options, redis.DialPassword(c.Pwd))
+	}
+	if c.Db != 0 {
+		options = append(options, redis.DialDatabase(c.Db))
+	}
+	return options
+}
+
+//redis客户端，Get返回的连接用法和redis.Pool一样，用完需要Close
+type Client struct {
+	pool    *redis.Pool
+	cluster *cluster
+}
+
+func New(config *Config) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.Mode {
+	case MODE_SENTINEL:
+		s := newSentinel(config)
+		return &Client{pool: newPool(config, s.dial, s.testOnBorrow)}, nil
+	case MODE_CLUSTER:
+		c, err := newCluster(config)
+		if err != nil {
+			return nil, err
+		}
+		return &Client{cluster: c}, nil
+	default:
+		addr := config.hosts()[0]
+		dial := func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, config.dialOptions()...)
+		}
+		return &Client{pool: newPool(config, dial, ping)}, nil
+	}
+}
+
+//单机模式使用自定义的方式建立连接，例如经过代理或者在测试中使用假的连接
+func NewWithDial(config *Config, dial func() (redis.Conn, error)) *Client {
+	return &Client{pool: newPool(config, dial, ping)}
+}
+
+func (c *Client) Get() redis.Conn {
+	if c.cluster != nil {
+		return c.cluster.get()
+	}
+	return c.pool.Get()
+}
+
+func (c *Client) Close() error {
+	if c.cluster != nil {
+		return c.cluster.close()
+	}
+	return c.pool.Close()
+}
+
+func newPool(config *Config, dial func() (redis.Conn, error), test func(c redis.Conn) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		Wait:        config.MaxActive > 0,
+		Dial:        dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			//最近用过的连接不检查，减少一次往返
+			if time.Since(t) < config.HealthCheckInterval {
+				return nil
+			}
+			return test(c)
+		},
+	}
+}
+
+func ping(c redis.Conn) error {
+	_, err := c.Do("PING")
+	return err
+}
@@ -0,0 +1,328 @@
+package redisclient
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	CLUSTER_SLOTS    = 16384
+	CLUSTER_REDIRECT = 5 //MOVED/ASK最多重定向次数
+
+	ErrClusterPipeline = errors.New("redis cluster connection already bound to another node")
+)
+
+//集群模式，按key的slot把命令路由到对应节点，处理MOVED和ASK重定向
+type cluster struct {
+	config *Config
+	mutex  sync.RWMutex
+	slots  []string //slot对应的master地址
+	pools  map[string]*redis.Pool
+	seeds  []string
+
+	refreshing int32 //正在后台刷新路由表
+}
+
+func newCluster(config *Config) (*cluster, error) {
+	c := &cluster{
+		config: config,
+		slots:  make([]string, CLUSTER_SLOTS),
+		pools:  make(map[string]*redis.Pool),
+		seeds:  config.hosts(),
+	}
+
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *cluster) pool(addr string) *redis.Pool {
+	c.mutex.RLock()
+	p, ok := c.pools[addr]
+	c.mutex.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if p, ok := c.pools[addr]; ok {
+		return p
+	}
+
+	p = newPool(c.config, func() (redis.Conn, error) {
+		return redis.Dial("tcp", addr, c.config.dialOptions()...)
+	}, ping)
+	c.pools[addr] = p
+	return p
+}
+
+//通过CLUSTER SLOTS刷新slot路由表
+func (c *cluster) refresh() error {
+	c.mutex.RLock()
+	addrs := append([]string{}, c.seeds...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mutex.RUnlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn := c.pool(addr).Get()
+		reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		slots := make([]string, CLUSTER_SLOTS)
+		for _, r := range reply {
+			item, err := redis.Values(r, nil)
+			if err != nil || len(item) < 3 {
+				continue
+			}
+			start, _ := redis.Int(item[0], nil)
+			end, _ := redis.Int(item[1], nil)
+			node, err := redis.Values(item[2], nil)
+			if err != nil || len(node) < 2 {
+				continue
+			}
+			host, _ := redis.String(node[0], nil)
+			port, _ := redis.Int(node[1], nil)
+			if host == "" {
+				//节点没有配置ip时使用连接的地址
+				host, _, _ = net.SplitHostPort(addr)
+			}
+			master := net.JoinHostPort(host, strconv.Itoa(port))
+			for slot := start; slot <= end && slot < CLUSTER_SLOTS; slot++ {
+				slots[slot] = master
+			}
+		}
+
+		c.mutex.Lock()
+		c.slots = slots
+		c.mutex.Unlock()
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no redis cluster node available")
+	}
+	return fmt.Errorf("redis cluster refresh slots error: %s", lastErr.Error())
+}
+
+//收到MOVED后在后台刷新路由表，同一时间只刷新一次
+func (c *cluster) refreshAsync() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		if err := c.refresh(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+func (c *cluster) addr(slot int) string {
+	c.mutex.RLock()
+	addr := c.slots[slot]
+	c.mutex.RUnlock()
+	if addr != "" {
+		return addr
+	}
+
+	//路由表不完整时随机选一个节点，依靠MOVED重定向
+	return c.seeds[rand.Intn(len(c.seeds))]
+}
+
+func (c *cluster) setSlot(slot int, addr string) {
+	c.mutex.Lock()
+	c.slots[slot] = addr
+	c.mutex.Unlock()
+}
+
+func (c *cluster) get() redis.Conn {
+	return &clusterConn{cluster: c}
+}
+
+func (c *cluster) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, p := range c.pools {
+		p.Close()
+	}
+	return nil
+}
+
+//集群连接，Do按key路由；Send/Flush/Receive会绑定到第一个命令所在的节点，用于pipeline和订阅
+type clusterConn struct {
+	cluster *cluster
+	bound   redis.Conn
+	err     error
+}
+
+func (cc *clusterConn) Close() error {
+	if cc.bound != nil {
+		err := cc.bound.Close()
+		cc.bound = nil
+		return err
+	}
+	return nil
+}
+
+func (cc *clusterConn) Err() error {
+	if cc.bound != nil {
+		return cc.bound.Err()
+	}
+	return cc.err
+}
+
+func (cc *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cc.bound != nil {
+		return cc.bound.Do(cmd, args...)
+	}
+	if cmd == "" {
+		return nil, nil
+	}
+
+	slot := -1
+	if key, ok := commandKey(cmd, args); ok {
+		slot = Slot(key)
+	}
+
+	addr := ""
+	if slot >= 0 {
+		addr = cc.cluster.addr(slot)
+	} else {
+		addr = cc.cluster.seeds[rand.Intn(len(cc.cluster.seeds))]
+	}
+
+	asking := false
+	for i := 0; i < CLUSTER_REDIRECT; i++ {
+		conn := cc.cluster.pool(addr).Get()
+		if asking {
+			conn.Send("ASKING")
+		}
+		reply, err := conn.Do(cmd, args...)
+		conn.Close()
+
+		rerr, ok := err.(redis.Error)
+		if !ok {
+			return reply, err
+		}
+
+		//MOVED 3999 127.0.0.1:6381 / ASK 3999 127.0.0.1:6381
+		fields := strings.Fields(string(rerr))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+
+		addr = fields[2]
+		asking = fields[0] == "ASK"
+		if !asking {
+			if s, err := strconv.Atoi(fields[1]); err == nil {
+				cc.cluster.setSlot(s, addr)
+			}
+			cc.cluster.refreshAsync()
+		}
+	}
+
+	return nil, fmt.Errorf("redis cluster too many redirections for %s", cmd)
+}
+
+func (cc *clusterConn) Send(cmd string, args ...interface{}) error {
+	if cc.bound == nil {
+		addr := cc.cluster.seeds[rand.Intn(len(cc.cluster.seeds))]
+		if key, ok := commandKey(cmd, args); ok {
+			addr = cc.cluster.addr(Slot(key))
+		}
+		cc.bound = cc.cluster.pool(addr).Get()
+	}
+	return cc.bound.Send(cmd, args...)
+}
+
+func (cc *clusterConn) Flush() error {
+	if cc.bound == nil {
+		return nil
+	}
+	return cc.bound.Flush()
+}
+
+func (cc *clusterConn) Receive() (interface{}, error) {
+	if cc.bound == nil {
+		return nil, ErrClusterPipeline
+	}
+	return cc.bound.Receive()
+}
+
+//取出命令的key，用于计算slot
+//EVAL/EVALSHA的key在numkeys之后，其他命令取第一个参数
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "PING", "INFO", "CLUSTER", "SCRIPT", "AUTH", "SELECT", "ASKING":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, ok := argString(args[1]); !ok || n == "0" {
+			return "", false
+		}
+		return argString(args[2])
+	}
+
+	if len(args) == 0 {
+		return "", false
+	}
+	return argString(args[0])
+}
+
+func argString(arg interface{}) (string, bool) {
+	switch v := arg.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case int, int32, int64:
+		return fmt.Sprintf("%d", v), true
+	}
+	return "", false
+}
+
+//key对应的slot，支持{hash tag}
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % CLUSTER_SLOTS
+}
+
+//CRC16 XMODEM，和redis集群使用的算法一致
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,77 @@
+package redisclient
+
+import "testing"
+
+//结果和 CLUSTER KEYSLOT 一致
+func TestSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739},
+		{"somekey", 11058},
+		{"foo", 12182},
+		{"foo{hash_tag}", 2515},
+		{"bar{hash_tag}", 2515},
+		{"{hash_tag}", 2515},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := Slot(tt.key); got != tt.slot {
+			t.Errorf("Slot(%q) = %d, want %d", tt.key, got, tt.slot)
+		}
+	}
+
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("crc16 = %#x, want 0x31c3", got)
+	}
+}
+
+//只有第一个{和之后第一个}之间不为空时才使用hash tag
+func TestSlotHashTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		same string
+	}{
+		{"user#{1000}#following", "1000"},
+		{"{1000}", "1000"},
+		{"foo{bar}{zap}", "bar"},
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{}{bar}", "foo{}{bar}"}, //空的tag，整个key计算
+		{"foo{bar", "foo{bar"},
+		{"foo}bar{", "foo}bar{"},
+	}
+	for _, tt := range tests {
+		if got, want := Slot(tt.key), int(crc16(tt.same))%CLUSTER_SLOTS; got != want {
+			t.Errorf("Slot(%q) = %d, want slot of %q (%d)", tt.key, got, tt.same, want)
+		}
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		key  string
+		ok   bool
+	}{
+		{"GET", []interface{}{"k"}, "k", true},
+		{"hset", []interface{}{[]byte("h"), "f", 1}, "h", true},
+		{"INCRBY", []interface{}{int64(42), 1}, "42", true},
+		{"EVAL", []interface{}{"return 1", 2, "k1", "k2", "arg"}, "k1", true},
+		{"evalsha", []interface{}{"sha", "1", []byte("k1")}, "k1", true},
+		{"EVAL", []interface{}{"return 1", 0, "arg"}, "", false},
+		{"EVAL", []interface{}{"return 1", "0"}, "", false},
+		{"EVALSHA", []interface{}{"sha", 1}, "", false},
+		{"PING", nil, "", false},
+		{"cluster", []interface{}{"slots"}, "", false},
+		{"GET", nil, "", false},
+		{"GET", []interface{}{3.5}, "", false},
+	}
+	for _, tt := range tests {
+		key, ok := commandKey(tt.cmd, tt.args)
+		if key != tt.key || ok != tt.ok {
+			t.Errorf("commandKey(%s, %v) = %q, %v, want %q, %v", tt.cmd, tt.args, key, ok, tt.key, tt.ok)
+		}
+	}
+}
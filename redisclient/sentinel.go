@@ -0,0 +1,117 @@
+package redisclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//哨兵模式，每次建立连接时向哨兵查询当前master地址
+type sentinel struct {
+	config *Config
+
+	mutex sync.Mutex //连接池并发Dial时保护addrs
+	addrs []string
+}
+
+func newSentinel(config *Config) *sentinel {
+	return &sentinel{
+		config: config,
+		addrs:  config.hosts(),
+	}
+}
+
+//依次询问哨兵，返回第一个拿到的master地址
+func (s *sentinel) masterAddr() (string, error) {
+	s.mutex.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mutex.Unlock()
+
+	var lastErr error
+	for i, addr := range addrs {
+		conn, err := redis.Dial("tcp", addr,
+			redis.DialConnectTimeout(s.config.ConnectTimeout),
+			redis.DialReadTimeout(s.config.ReadTimeout),
+			redis.DialWriteTimeout(s.config.WriteTimeout))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.config.MasterName))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = fmt.Errorf("sentinel %s has no master named %s", addr, s.config.MasterName)
+			continue
+		}
+
+		//可用的哨兵放到最前面，下次优先询问
+		if i > 0 {
+			s.prefer(addr)
+		}
+		return net.JoinHostPort(reply[0], reply[1]), nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no sentinel available")
+	}
+	return "", lastErr
+}
+
+//把addr换到最前面，按地址查找，其他Dial可能已经调整过顺序
+func (s *sentinel) prefer(addr string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := range s.addrs {
+		if s.addrs[i] == addr {
+			s.addrs[0], s.addrs[i] = s.addrs[i], s.addrs[0]
+			return
+		}
+	}
+}
+
+func (s *sentinel) dial() (redis.Conn, error) {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := redis.Dial("tcp", addr, s.config.dialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMaster(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//故障切换后老master变成slave，借出前检查角色，丢弃指向老master的连接
+func (s *sentinel) testOnBorrow(conn redis.Conn) error {
+	return checkMaster(conn)
+}
+
+func checkMaster(conn redis.Conn) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("redis role is %s, not master", role)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package tcpserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//http接口，后端服务发送系统消息和机器人消息
+//调用方通过 Authorization: Bearer <api key> 鉴权，消息发布到MESSAGE_TOPIC_LOGIC，和客户端发送的消息一样由dispatch处理
+//同一个进程可以开启webhook投递，发给机器人uid的消息POST到配置的url
+var (
+	API_PATH_MESSAGES   = "/v1/messages"
+	API_PATH_BROADCASTS = "/v1/broadcasts"
+	API_READ_TIMEOUT    = 10 * time.Second
+	API_WRITE_TIMEOUT   = 10 * time.Second
+)
+
+//发送消息请求，POST /v1/messages 的body
+type ApiMessage struct {
+	Mt          int32  `json:"mt"`           //MESSAGE_TYPE_P2P、MESSAGE_TYPE_GROUP或者MESSAGE_TYPE_ROOM
+	Sid         int64  `json:"sid"`          //发送者uid，系统账号或者机器人
+	Rid         int64  `json:"rid"`          //接收者uid、群id或者聊天室id
+	ClientMid   int64  `json:"client_mid"`   //调用方的消息序号，拒绝通知按这个序号关联，为0时服务端生成
+	ContentType string `json:"content_type"` //内容类型，为空时按文本处理
+	Ext         []byte `json:"ext"`          //Ext原始内容，base64，没有时为空
+	Pl          []byte `json:"pl"`           //消息内容，base64
+}
+
+//发送广播请求，POST /v1/broadcasts 的body
+type ApiBroadcast struct {
+	Sid         int64              `json:"sid"`          //发送者，系统账号
+	Segment     []SegmentPredicate `json:"segment"`      //分群条件，为空时发给所有在线用户
+	Offline     bool               `json:"offline"`      //是否保存给离线用户，上线时下发
+	Ttl         int64              `json:"ttl"`          //有效期，秒，为0时使用BROADCAST_DEFAULT_TTL
+	ContentType string             `json:"content_type"` //内容类型，为空时按文本处理
+	Ext         []byte             `json:"ext"`          //Ext原始内容，base64
+	Pl          []byte             `json:"pl"`           //消息内容，base64
+}
+
+//http接口的响应，和ResponseInfo相同，成功时带上消息序号或者广播id
+type ApiResponse struct {
+	Status    int64
+	Msg       string
+	ClientMid int64 `json:",omitempty"`
+	Id        int64 `json:",omitempty"`
+}
+
+type ApiSrv struct {
+	server      *http.Server
+	sub         *Subscribe //只发布消息，不订阅
+	webhook     *Webhook   //没有开启时为nil
+	maxBodySize int64
+	seq         int64 //调用方没有指定ClientMid时使用
+
+	mutex sync.RWMutex
+	keys  map[string]string //api key -> 名称
+}
+
+func NewApiSrv(config *ApiConfig) *ApiSrv {
+	s := &ApiSrv{
+		maxBodySize: config.MaxBodySize,
+		seq:         time.Now().UnixNano() / 1000000,
+	}
+	s.reloadKeys(config.ApiKeys)
+
+	s.sub = NewPublisher(&CustomProto{}, config.NsqdHost)
+	if config.Webhook.Enable {
+		s.webhook = NewWebhook(config.NsqdHost, &config.Webhook)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(API_PATH_MESSAGES, s.handleMessages)
+	mux.HandleFunc(API_PATH_BROADCASTS, s.handleBroadcasts)
+	s.server = &http.Server{
+		Addr:         config.HttpHost,
+		Handler:      mux,
+		ReadTimeout:  API_READ_TIMEOUT,
+		WriteTimeout: API_WRITE_TIMEOUT,
+	}
+	return s
+}
+
+//名称:key，逗号分隔
+func parseApiKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		i := strings.Index(f, ":")
+		if i <= 0 || i == len(f)-1 {
+			return nil, errors.New("api_keys must be name:key, comma separated")
+		}
+		keys[f[i+1:]] = f[:i]
+	}
+	return keys, nil
+}
+
+func (s *ApiSrv) reloadKeys(apiKeys string) {
+	keys, _ := parseApiKeys(apiKeys)
+	s.mutex.Lock()
+	s.keys = keys
+	s.mutex.Unlock()
+}
+
+func (s *ApiSrv) Serve() error {
+	return s.server.ListenAndServe()
+}
+
+//SIGHUP重新加载api key和webhook配置
+func (s *ApiSrv) Reload(config *ApiConfig) {
+	s.reloadKeys(config.ApiKeys)
+	if s.webhook != nil {
+		s.webhook.Reload(&config.Webhook)
+	}
+}
+
+//返回调用方名称，key无效时返回空
+func (s *ApiSrv) auth(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	key := []byte(strings.TrimPrefix(header, "Bearer "))
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	//逐个比较，避免通过响应时间猜测key
+	name := ""
+	for k, n := range s.keys {
+		if subtle.ConstantTimeCompare(key, []byte(k)) == 1 {
+			name = n
+		}
+	}
+	return name
+}
+
+//校验方法和api key后解析json body，失败时已经写入响应，返回调用方名称
+func (s *ApiSrv) readRequest(w http.ResponseWriter, r *http.Request, v interface{}) (string, bool) {
+	if r.Method != "POST" {
+		writeApiResponse(w, http.StatusMethodNotAllowed, &ApiResponse{Status: -1, Msg: "method not allowed"})
+		return "", false
+	}
+	name := s.auth(r)
+	if name == "" {
+		writeApiResponse(w, http.StatusUnauthorized, &ApiResponse{Status: -2, Msg: "auth failed"})
+		return "", false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBodySize))
+	if err != nil {
+		writeApiResponse(w, http.StatusRequestEntityTooLarge, &ApiResponse{Status: -1, Msg: "body too large"})
+		return "", false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeApiResponse(w, http.StatusBadRequest, &ApiResponse{Status: -1, Msg: "params decode err"})
+		return "", false
+	}
+	return name, true
+}
+
+func (s *ApiSrv) handleMessages(w http.ResponseWriter, r *http.Request) {
+	msg := &ApiMessage{}
+	name, ok := s.readRequest(w, r, msg)
+	if !ok {
+		return
+	}
+	p, err := s.buildPacket(msg)
+	if err != nil {
+		writeApiResponse(w, http.StatusBadRequest, &ApiResponse{Status: -1, Msg: err.Error()})
+		return
+	}
+
+	if err := s.sub.Publish(MESSAGE_TOPIC_LOGIC, p); err != nil {
+		fmt.Printf("api publish error: %s, caller=%s, sid=%d\n", err.Error(), name, p.Sid)
+		writeApiResponse(w, http.StatusServiceUnavailable, &ApiResponse{Status: -3, Msg: "publish failed"})
+		return
+	}
+	writeApiResponse(w, http.StatusOK, &ApiResponse{Status: 0, Msg: "ok", ClientMid: p.ClientMid()})
+}
+
+func (s *ApiSrv) buildPacket(msg *ApiMessage) (*Packet, error) {
+	if !isChatPacket(&Packet{Mt: msg.Mt}) {
+		return nil, fmt.Errorf("unsupported message type: %d", msg.Mt)
+	}
+	if msg.Sid <= 0 || msg.Rid <= 0 {
+		return nil, errors.New("sid and rid are required")
+	}
+	if len(msg.Pl) == 0 {
+		return nil, errors.New("pl is required")
+	}
+
+	clientMid := msg.ClientMid
+	if clientMid == 0 {
+		clientMid = atomic.AddInt64(&s.seq, 1)
+	}
+	p := &Packet{
+		Ver: PROTO_VERSION,
+		Mt:  msg.Mt,
+		Mid: clientMid,
+		Ct:  time.Now().UnixNano() / 1000000,
+		Sid: msg.Sid,
+		Rid: msg.Rid,
+		Ext: msg.Ext,
+		Pl:  msg.Pl,
+	}
+	//dispatch会把Mid替换为服务端消息id，客户端序号保存在Ext
+	p.SetClientMid(clientMid)
+	if err := p.SetContentType(msg.ContentType); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//广播只发布一次，每个comet按分群条件下发给本节点的在线用户
+func (s *ApiSrv) handleBroadcasts(w http.ResponseWriter, r *http.Request) {
+	req := &ApiBroadcast{}
+	name, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+	if len(req.Pl) == 0 {
+		writeApiResponse(w, http.StatusBadRequest, &ApiResponse{Status: -1, Msg: "pl is required"})
+		return
+	}
+	if err := ValidateSegment(req.Segment); err != nil {
+		writeApiResponse(w, http.StatusBadRequest, &ApiResponse{Status: -1, Msg: err.Error()})
+		return
+	}
+
+	ttl := time.Duration(req.Ttl) * time.Second
+	if ttl <= 0 {
+		ttl = BROADCAST_DEFAULT_TTL
+	}
+	b := &Broadcast{
+		Id:      atomic.AddInt64(&s.seq, 1),
+		Sid:     req.Sid,
+		Segment: req.Segment,
+		Offline: req.Offline,
+		Ct:      time.Now().UnixNano() / 1000000,
+		Ext:     req.Ext,
+		Pl:      req.Pl,
+	}
+	b.Expire = b.Ct + int64(ttl/time.Millisecond)
+	if req.ContentType != "" {
+		//内容类型和普通消息一样放在Ext中
+		p := &Packet{Ext: b.Ext}
+		if err := p.SetContentType(req.ContentType); err != nil {
+			writeApiResponse(w, http.StatusBadRequest, &ApiResponse{Status: -1, Msg: err.Error()})
+			return
+		}
+		b.Ext = p.Ext
+		b.ContentType = req.ContentType
+	}
+
+	data, _ := json.Marshal(b)
+	if err := s.sub.PublishBody(MESSAGE_TOPIC_BROADCAST, data); err != nil {
+		fmt.Printf("api publish broadcast error: %s, caller=%s\n", err.Error(), name)
+		writeApiResponse(w, http.StatusServiceUnavailable, &ApiResponse{Status: -3, Msg: "publish failed"})
+		return
+	}
+	fmt.Printf("broadcast %d published by %s, segment=%d predicates, offline=%v\n", b.Id, name, len(b.Segment), b.Offline)
+	writeApiResponse(w, http.StatusOK, &ApiResponse{Status: 0, Msg: "ok", Id: b.Id})
+}
+
+func writeApiResponse(w http.ResponseWriter, code int, resp *ApiResponse) {
+	data, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func (s *ApiSrv) Close() {
+	s.server.Close()
+	if s.webhook != nil {
+		s.webhook.Close()
+	}
+	s.sub.Close()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"go/tcpserver"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	config, loader, err := tcpserver.LoadApiConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("config: %s\n", tcpserver.ConfigString(config))
+
+	server := tcpserver.NewApiSrv(config)
+	defer func() {
+		server.Close()
+	}()
+	errc := make(chan error)
+	go func() {
+		errc <- fmt.Errorf("%s", server.Serve())
+	}()
+	// Reload handler.
+	go tcpserver.HandleReload(loader, config, func(c interface{}) {
+		server.Reload(c.(*tcpserver.ApiConfig))
+	})
+	// Interrupt handler.
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errc <- fmt.Errorf("%s", <-c)
+	}()
+
+	fmt.Printf("exit: %v", <-errc)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/tcpserver"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//连接反复建立、注册、鉴权、断开，多个连接使用相同的uid和设备token制造重新登录
+//配合 go run -race 检查客户端映射表的并发安全
+type Stat struct {
+	N     int    //每个worker的循环次数
+	C     int    //并发worker数量
+	Users int    //用户数量，小于C时会产生大量重新登录
+	addr  string //comet地址
+
+	rounds int64
+	errors int64
+}
+
+func (stat *Stat) round(uid int64) error {
+	conn, err := net.DialTimeout("tcp", stat.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	proto := &tcpserver.CustomProto{}
+	bs, _ := json.Marshal(tcpserver.DeviceInfo{Token: fmt.Sprintf("device-%d", uid)})
+	if err := proto.WritePacket(conn, &tcpserver.Packet{Ver: 1, Mt: tcpserver.MESSAGE_TYPE_REGISTER, Pl: bs}); err != nil {
+		return err
+	}
+
+	bs, _ = json.Marshal(tcpserver.AuthInfo{Uid: uid, Token: "123"})
+	if err := proto.WritePacket(conn, &tcpserver.Packet{Ver: 1, Mt: tcpserver.MESSAGE_TYPE_AUTH, Pl: bs}); err != nil {
+		return err
+	}
+
+	for {
+		p, err := proto.ReadPacket(conn)
+		if err != nil {
+			//被同一用户的新连接挤下线
+			return nil
+		}
+		if p.Mt == tcpserver.MESSAGE_TYPE_AUTH_STATUS {
+			break
+		}
+	}
+
+	//随机保持一段时间，让断开和重新登录交错
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	return nil
+}
+
+func (stat *Stat) runWorker() {
+	for i := 0; i < stat.N; i++ {
+		uid := int64(rand.Intn(stat.Users) + 1)
+		if err := stat.round(uid); err != nil {
+			atomic.AddInt64(&stat.errors, 1)
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		atomic.AddInt64(&stat.rounds, 1)
+	}
+}
+
+func main() {
+	var (
+		n     = flag.Int("n", 200, "rounds per worker")
+		c     = flag.Int("c", 50, "concurrency, number of workers")
+		users = flag.Int("users", 10, "number of distinct uids")
+		addr  = flag.String("addr", "127.0.0.1:12300", "tcp listen address")
+		loop  = flag.Bool("eventloop", false, "use event loop connection mode")
+	)
+	flag.Parse()
+
+	config := tcpserver.NewCometConfig()
+	config.TcpHost = *addr
+	config.NsqdHost = ""
+	config.EventLoop = *loop
+
+	//服务端每个连接都会打印日志，压测时丢弃，结果输出到stderr
+	os.Stdout, _ = os.Open(os.DevNull)
+
+	server := tcpserver.NewTCPServer(config)
+	go server.Serve()
+	time.Sleep(100 * time.Millisecond)
+
+	stat := &Stat{
+		N:     *n,
+		C:     *c,
+		Users: *users,
+		addr:  *addr,
+	}
+
+	//并发查找，和注册注销交错
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.GetClientByUid(int64(rand.Intn(stat.Users) + 1))
+				server.GetClientByDt(fmt.Sprintf("device-%d", rand.Intn(stat.Users)+1))
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(stat.C)
+	for i := 0; i < stat.C; i++ {
+		go func() {
+			stat.runWorker()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	close(done)
+	spend := time.Now().Sub(start)
+
+	//等待服务端处理完所有断开
+	for i := 0; i < 100 && server.ConnCount() > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	fmt.Fprintf(os.Stderr, "rounds: %d, errors: %d, spend: %v\n", stat.rounds, stat.errors, spend)
+	fmt.Fprintf(os.Stderr, "conns left: %d, online left: %d\n", server.ConnCount(), server.OnlineCount())
+	if server.ConnCount() != 0 || server.OnlineCount() != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"go/tcpserver"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+//每个本地ip最多建立的连接数，避免耗尽临时端口
+var connsPerIp = 20000
+
+//提升进程可以打开的文件数
+func raiseFdLimit(n uint64) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return
+	}
+	if rlimit.Cur < n {
+		rlimit.Cur = n
+		if rlimit.Max < n {
+			rlimit.Max = n
+		}
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+			fmt.Fprintf(os.Stderr, "setrlimit error: %v\n", err)
+		}
+	}
+}
+
+//子进程：建立n个空闲连接，建立完成后输出ready，直到父进程退出
+func runDialer(addr string, n int) {
+	raiseFdLimit(uint64(n) + 1024)
+
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		local := &net.TCPAddr{IP: net.IPv4(127, 0, byte(i/connsPerIp/256), byte(1+i/connsPerIp%255))}
+		dialer := net.Dialer{LocalAddr: local, Timeout: 5 * time.Second}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dial error: %v\n", err)
+			os.Exit(1)
+		}
+		conns = append(conns, conn)
+	}
+
+	fmt.Println("ready")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+func memUsed() (uint64, int) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse + stats.StackInuse, runtime.NumGoroutine()
+}
+
+func main() {
+	var (
+		mode = flag.String("mode", "goroutine", "comet connection mode: goroutine or eventloop")
+		n    = flag.Int("n", 100000, "number of idle connections")
+		addr = flag.String("addr", "127.0.0.1:12100", "tcp listen address")
+		dial = flag.Bool("dial", false, "run as dialer process")
+	)
+	flag.Parse()
+
+	if *dial {
+		runDialer(*addr, *n)
+		return
+	}
+
+	raiseFdLimit(uint64(*n) + 1024)
+
+	config := tcpserver.NewCometConfig()
+	config.TcpHost = *addr
+	config.NsqdHost = ""
+	config.EventLoop = *mode == "eventloop"
+
+	//服务端每个连接都会打印日志，压测时丢弃
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	server := tcpserver.NewTCPServer(config)
+	go server.Serve()
+	time.Sleep(100 * time.Millisecond)
+
+	baseMem, baseGoroutines := memUsed()
+
+	cmd := exec.Command(os.Args[0], "-dial", "-addr", *addr, "-n", fmt.Sprintf("%d", *n))
+	cmd.Stderr = os.Stderr
+	stdin, _ := cmd.StdinPipe()
+	out, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "start dialer error: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+
+	start := time.Now()
+	if line, err := bufio.NewReader(out).ReadString('\n'); err != nil || line != "ready\n" {
+		fmt.Fprintf(os.Stderr, "dialer failed: %v\n", err)
+		os.Exit(1)
+	}
+	for server.ConnCount() < int64(*n) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spend := time.Now().Sub(start)
+
+	time.Sleep(time.Second)
+	mem, goroutines := memUsed()
+
+	fmt.Fprintf(os.Stderr, "mode: %s, conns: %d, connect: %v\n", *mode, *n, spend)
+	fmt.Fprintf(os.Stderr, "memory: %.2f MB total, %d bytes/conn, %.2f MB per 100k conns\n",
+		float64(mem-baseMem)/1024/1024,
+		(mem-baseMem)/uint64(*n),
+		float64(mem-baseMem)/float64(*n)*100000/1024/1024)
+	fmt.Fprintf(os.Stderr, "goroutines: %d\n", goroutines-baseGoroutines)
+}
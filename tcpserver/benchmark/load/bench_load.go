@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/tcpserver"
+	"go/tcpserver/client"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//压测场景，可以通过json文件配置
+type Scenario struct {
+	Addr        string  //comet地址
+	Conns       int     //并发连接数
+	UidStart    int64   //起始用户id，连接使用 UidStart ~ UidStart+Conns-1
+	Token       string  //鉴权token
+	Ramp        string  //建立全部连接的时间
+	Duration    string  //发送消息持续时间
+	Drain       string  //停止发送后等待消息到达的时间
+	P2pRate     float64 //每个连接每秒发送单聊消息数
+	GroupRate   float64 //每个连接每秒发送群消息数
+	Groups      []int64 //群消息随机发送到这些群
+	PayloadSize int     //payload大小，最小为时间戳占用的字节数
+}
+
+func defaultScenario() *Scenario {
+	return &Scenario{
+		Addr:        "127.0.0.1:12000",
+		Conns:       1000,
+		UidStart:    1000000,
+		Token:       "123",
+		Ramp:        "10s",
+		Duration:    "60s",
+		Drain:       "5s",
+		P2pRate:     0.1,
+		GroupRate:   0,
+		PayloadSize: 64,
+	}
+}
+
+func (s *Scenario) Validate() error {
+	if s.Conns <= 0 {
+		return fmt.Errorf("conns must be positive, got %d", s.Conns)
+	}
+	if s.P2pRate < 0 || s.GroupRate < 0 {
+		return fmt.Errorf("p2p.rate and group.rate must not be negative, got %v, %v", s.P2pRate, s.GroupRate)
+	}
+	if s.GroupRate > 0 && len(s.Groups) == 0 {
+		return errors.New("group.rate needs groups")
+	}
+	return nil
+}
+
+//payload里带上发送时间，计算端到端延迟
+type loadPayload struct {
+	Ts  int64  //发送时间 us
+	Pad string //填充到指定大小
+}
+
+//延迟样本，超过上限后使用水塘抽样
+type Samples struct {
+	mutex  sync.Mutex
+	values []int64
+	count  int64
+	max    int
+}
+
+func NewSamples(max int) *Samples {
+	return &Samples{max: max}
+}
+
+func (s *Samples) Add(v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.count++
+	if len(s.values) < s.max {
+		s.values = append(s.values, v)
+		return
+	}
+	if i := rand.Int63n(s.count); i < int64(s.max) {
+		s.values[i] = v
+	}
+}
+
+func (s *Samples) Report(name string, unit time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.values) == 0 {
+		fmt.Printf("%-22s no samples\n", name)
+		return
+	}
+
+	sort.Slice(s.values, func(i, j int) bool { return s.values[i] < s.values[j] })
+	p := func(q float64) time.Duration {
+		i := int(q * float64(len(s.values)-1))
+		return time.Duration(s.values[i]) * unit
+	}
+	fmt.Printf("%-22s n=%d p50=%v p90=%v p99=%v p999=%v max=%v\n",
+		name, s.count, p(0.5), p(0.9), p(0.99), p(0.999), time.Duration(s.values[len(s.values)-1])*unit)
+}
+
+type Stat struct {
+	connOk       int64
+	connFail     int64
+	disconnects  int64
+	sent         int64
+	sendErrors   int64
+	acked        int64
+	ackTimeouts  int64
+	ackErrors    int64
+	received     int64
+	payloadError int64
+
+	ackLatency     *Samples //发送到收到ack
+	e2eLatency     *Samples //发送到接收方收到，使用payload里的发送时间
+	deliverLatency *Samples //服务端分发到接收方收到，使用packet的Ct
+}
+
+type Loader struct {
+	scenario *Scenario
+	stat     *Stat
+	clients  []*client.Client
+	payload  string
+	mutex    sync.Mutex
+	closing  int32          //压测结束主动断开的连接不计入断线
+	acks     sync.WaitGroup //等待ack的goroutine，输出结果前等待全部结束
+}
+
+func (l *Loader) onMessage(p *tcpserver.Packet) {
+	now := time.Now()
+	atomic.AddInt64(&l.stat.received, 1)
+	if p.Ct > 0 {
+		l.stat.deliverLatency.Add(now.UnixNano()/1000000 - p.Ct)
+	}
+
+	payload := loadPayload{}
+	if err := json.Unmarshal(p.Pl, &payload); err != nil || payload.Ts == 0 {
+		atomic.AddInt64(&l.stat.payloadError, 1)
+		return
+	}
+	l.stat.e2eLatency.Add(now.UnixNano()/1000 - payload.Ts)
+}
+
+//建立单个连接，等待注册鉴权完成
+func (l *Loader) connect(uid int64, timeout time.Duration) *client.Client {
+	config := client.NewConfig(l.scenario.Addr, uid, l.scenario.Token, fmt.Sprintf("load-%d", uid))
+	config.ReconnectMin = time.Second
+
+	connected := make(chan struct{}, 1)
+	var once int32
+	c := client.NewClient(config, client.Callbacks{
+		OnConnect: func() {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+		OnDisconnect: func(err error) {
+			if atomic.LoadInt32(&once) == 1 && atomic.LoadInt32(&l.closing) == 0 {
+				atomic.AddInt64(&l.stat.disconnects, 1)
+			}
+		},
+		OnP2p:   l.onMessage,
+		OnGroup: l.onMessage,
+	})
+	c.Start()
+
+	select {
+	case <-connected:
+		atomic.StoreInt32(&once, 1)
+		atomic.AddInt64(&l.stat.connOk, 1)
+		return c
+	case <-time.After(timeout):
+		atomic.AddInt64(&l.stat.connFail, 1)
+		c.Close()
+		return nil
+	}
+}
+
+func (l *Loader) send(c *client.Client, mt int32, rid int64) {
+	bs, _ := json.Marshal(loadPayload{Ts: time.Now().UnixNano() / 1000, Pad: l.payload})
+	start := time.Now()
+	future, err := c.Send(mt, rid, bs, nil)
+	atomic.AddInt64(&l.stat.sent, 1)
+	if err != nil {
+		atomic.AddInt64(&l.stat.sendErrors, 1)
+		return
+	}
+
+	l.acks.Add(1)
+	go func() {
+		defer l.acks.Done()
+		_, err := future.Wait()
+		if err == client.ErrAckTimeout {
+			atomic.AddInt64(&l.stat.ackTimeouts, 1)
+			return
+		}
+		if err != nil {
+			atomic.AddInt64(&l.stat.ackErrors, 1)
+			return
+		}
+		atomic.AddInt64(&l.stat.acked, 1)
+		l.stat.ackLatency.Add(int64(time.Now().Sub(start) / time.Microsecond))
+	}()
+}
+
+//按照场景配置的速率发送消息
+func (l *Loader) runSender(c *client.Client, stop chan struct{}) {
+	s := l.scenario
+	rate := s.P2pRate + s.GroupRate
+	if rate <= 0 {
+		<-stop
+		return
+	}
+
+	interval := time.Duration(float64(time.Second) / rate)
+	//随机错开第一次发送
+	select {
+	case <-stop:
+		return
+	case <-time.After(time.Duration(rand.Int63n(int64(interval) + 1))):
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if len(s.Groups) > 0 && rand.Float64()*rate < s.GroupRate {
+				l.send(c, tcpserver.MESSAGE_TYPE_GROUP, s.Groups[rand.Intn(len(s.Groups))])
+			} else {
+				l.send(c, tcpserver.MESSAGE_TYPE_P2P, s.UidStart+rand.Int63n(int64(s.Conns)))
+			}
+		}
+	}
+}
+
+//关闭连接后回调可能还在执行，计数器使用atomic读取
+func (l *Loader) report(spend time.Duration) {
+	st := l.stat
+	load := atomic.LoadInt64
+	sent, received := load(&st.sent), load(&st.received)
+	fmt.Printf("conns: ok=%d failed=%d disconnects=%d\n", load(&st.connOk), load(&st.connFail), load(&st.disconnects))
+	fmt.Printf("sent: %d (%.1f/s) send_errors=%d\n", sent, float64(sent)/spend.Seconds(), load(&st.sendErrors))
+	fmt.Printf("acked: %d ack_timeouts=%d ack_errors=%d\n", load(&st.acked), load(&st.ackTimeouts), load(&st.ackErrors))
+	fmt.Printf("received: %d (%.1f/s) payload_errors=%d\n", received, float64(received)/spend.Seconds(), load(&st.payloadError))
+	st.ackLatency.Report("ack latency", time.Microsecond)
+	st.e2eLatency.Report("send->deliver", time.Microsecond)
+	st.deliverLatency.Report("dispatch->deliver(Ct)", time.Millisecond)
+}
+
+func parseDuration(name string, s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid %s: %s\n", name, s)
+		os.Exit(1)
+	}
+	return d
+}
+
+func main() {
+	var (
+		scenarioFile = flag.String("scenario", "", "json scenario file, flags below override it")
+		addr         = flag.String("addr", "", "comet address")
+		conns        = flag.Int("conns", 0, "number of concurrent connections")
+		duration     = flag.String("duration", "", "send duration")
+		p2pRate      = flag.Float64("p2p.rate", -1, "p2p messages per second per connection")
+		groupRate    = flag.Float64("group.rate", -1, "group messages per second per connection")
+	)
+	flag.Parse()
+
+	s := defaultScenario()
+	if *scenarioFile != "" {
+		bs, err := ioutil.ReadFile(*scenarioFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read scenario error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := json.Unmarshal(bs, s); err != nil {
+			fmt.Fprintf(os.Stderr, "parse scenario error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *addr != "" {
+		s.Addr = *addr
+	}
+	if *conns > 0 {
+		s.Conns = *conns
+	}
+	if *duration != "" {
+		s.Duration = *duration
+	}
+	if *p2pRate >= 0 {
+		s.P2pRate = *p2pRate
+	}
+	if *groupRate >= 0 {
+		s.GroupRate = *groupRate
+	}
+
+	if err := s.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid scenario: %v\n", err)
+		os.Exit(1)
+	}
+
+	ramp := parseDuration("ramp", s.Ramp)
+	sendDuration := parseDuration("duration", s.Duration)
+	drain := parseDuration("drain", s.Drain)
+
+	l := &Loader{
+		scenario: s,
+		stat: &Stat{
+			ackLatency:     NewSamples(1000000),
+			e2eLatency:     NewSamples(1000000),
+			deliverLatency: NewSamples(1000000),
+		},
+	}
+	if s.PayloadSize > 32 {
+		l.payload = fmt.Sprintf("%0*d", s.PayloadSize-32, 0)
+	}
+
+	//在ramp时间内均匀建立连接
+	fmt.Printf("connecting %d clients to %s\n", s.Conns, s.Addr)
+	start := time.Now()
+	var wg sync.WaitGroup
+	step := ramp / time.Duration(s.Conns)
+	for i := 0; i < s.Conns; i++ {
+		wg.Add(1)
+		go func(uid int64) {
+			defer wg.Done()
+			if c := l.connect(uid, 30*time.Second); c != nil {
+				l.mutex.Lock()
+				l.clients = append(l.clients, c)
+				l.mutex.Unlock()
+			}
+		}(s.UidStart + int64(i))
+		time.Sleep(step)
+	}
+	wg.Wait()
+	fmt.Printf("connected %d/%d in %v\n", len(l.clients), s.Conns, time.Now().Sub(start))
+
+	stop := make(chan struct{})
+	start = time.Now()
+	for _, c := range l.clients {
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			l.runSender(c, stop)
+		}(c)
+	}
+	time.Sleep(sendDuration)
+	close(stop)
+	wg.Wait()
+	//ack等待有超时，不会一直阻塞
+	l.acks.Wait()
+	time.Sleep(drain)
+	spend := time.Now().Sub(start)
+
+	atomic.StoreInt32(&l.closing, 1)
+	for _, c := range l.clients {
+		c.Close()
+	}
+
+	l.report(spend)
+}
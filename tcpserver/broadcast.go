@@ -0,0 +1,263 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//全服广播和按用户分群的系统通知
+//广播只发布一次到MESSAGE_TOPIC_BROADCAST，每个comet使用自己的临时channel，都收到一份，按本地连接的客户端信息过滤后下发
+//需要离线保存的广播由store写入redis，用户上线时comet下发断线期间的广播，同样按分群条件过滤
+var (
+	MESSAGE_TOPIC_BROADCAST         = "message_topic_broadcast"         //广播，内容为Broadcast(json)
+	MESSAGE_CHANNEL_BROADCAST       = "message_channel_broadcast"       //comet的channel前缀，加上节点标识和#ephemeral
+	MESSAGE_CHANNEL_BROADCAST_STORE = "message_channel_broadcast_store" //保存离线广播
+
+	KEY_BROADCAST_OFFLINE     = "broadcast#offline" //sorted set，member为Broadcast(json)，score为发布时间(ms)
+	KEY_PREFIX_BROADCAST_SEEN = "broadcast#seen#"   //broadcast#seen#uid，用户断线的时间(ms)，上线时下发这之后的广播
+
+	BROADCAST_OFFLINE_MAX_COUNT = 100                 //最多保存的离线广播数量
+	BROADCAST_OFFLINE_MAX_AGE   = 30 * 24 * time.Hour //离线广播最长保存时间，也是断线时间的保存时间
+	BROADCAST_DEFAULT_TTL       = 7 * 24 * time.Hour  //广播没有指定有效期时使用
+
+	//分群条件的字段
+	SEGMENT_FIELD_UID         = "uid"
+	SEGMENT_FIELD_PLATFORM    = "platform"    //不区分大小写
+	SEGMENT_FIELD_APP_VERSION = "app_version" //按点分隔的数字比较，例如 2.10.0 > 2.9.1
+
+	//nsq channel名称只能包含 . a-z A-Z 0-9 _ -
+	broadcastChannelPattern = regexp.MustCompile(`[^.a-zA-Z0-9_-]`)
+)
+
+var (
+	ErrSegmentInvalid = errors.New("segment predicate invalid")
+)
+
+//分群条件，一条广播的所有条件都满足时下发
+type SegmentPredicate struct {
+	Field string `json:"field"` //uid、platform、app_version
+	Op    string `json:"op"`    //= != < <= > >= in，uid和platform只支持 = != in
+	Value string `json:"value"` //in为逗号分隔的多个值
+}
+
+//MESSAGE_TOPIC_BROADCAST的消息内容
+type Broadcast struct {
+	Id          int64              `json:"id"`      //广播id，下发时作为Mid
+	Sid         int64              `json:"sid"`     //发送者，系统账号
+	Segment     []SegmentPredicate `json:"segment"` //为空时下发给所有在线用户
+	Offline     bool               `json:"offline"` //是否保存给离线用户
+	Expire      int64              `json:"expire"`  //过期时间 ms，过期后不再下发给上线的用户
+	Ct          int64              `json:"ct"`
+	ContentType string             `json:"content_type"`
+	Ext         []byte             `json:"ext"`
+	Pl          []byte             `json:"pl"`
+}
+
+//分群使用的客户端信息，鉴权时由客户端上报
+type ClientMeta struct {
+	Uid        int64
+	Platform   string
+	AppVersion string
+}
+
+func ValidateSegment(segment []SegmentPredicate) error {
+	for _, pred := range segment {
+		switch pred.Field {
+		case SEGMENT_FIELD_UID, SEGMENT_FIELD_PLATFORM:
+			if pred.Op != "=" && pred.Op != "!=" && pred.Op != "in" {
+				return fmt.Errorf("%s: %s does not support %q", ErrSegmentInvalid.Error(), pred.Field, pred.Op)
+			}
+		case SEGMENT_FIELD_APP_VERSION:
+			switch pred.Op {
+			case "=", "!=", "<", "<=", ">", ">=", "in":
+			default:
+				return fmt.Errorf("%s: unknown op %q", ErrSegmentInvalid.Error(), pred.Op)
+			}
+		default:
+			return fmt.Errorf("%s: unknown field %q", ErrSegmentInvalid.Error(), pred.Field)
+		}
+		if pred.Field == SEGMENT_FIELD_UID {
+			for _, v := range strings.Split(pred.Value, ",") {
+				if _, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err != nil {
+					return fmt.Errorf("%s: invalid uid %q", ErrSegmentInvalid.Error(), v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broadcast) Match(meta *ClientMeta) bool {
+	for i := range b.Segment {
+		if !b.Segment[i].match(meta) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pred *SegmentPredicate) match(meta *ClientMeta) bool {
+	var value string
+	var compare func(a, b string) int
+	switch pred.Field {
+	case SEGMENT_FIELD_UID:
+		value = strconv.FormatInt(meta.Uid, 10)
+		compare = strings.Compare
+	case SEGMENT_FIELD_PLATFORM:
+		value = strings.ToLower(meta.Platform)
+		compare = func(a, b string) int { return strings.Compare(a, strings.ToLower(b)) }
+	case SEGMENT_FIELD_APP_VERSION:
+		//没有上报版本的客户端不满足任何版本条件
+		if meta.AppVersion == "" {
+			return false
+		}
+		value = meta.AppVersion
+		compare = compareVersion
+	default:
+		return false
+	}
+
+	if pred.Op == "in" {
+		for _, v := range strings.Split(pred.Value, ",") {
+			if compare(value, strings.TrimSpace(v)) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	n := compare(value, strings.TrimSpace(pred.Value))
+	switch pred.Op {
+	case "=":
+		return n == 0
+	case "!=":
+		return n != 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	}
+	return false
+}
+
+//按点分隔逐段比较，数字按数值比较，缺少的段为0，例如 2.10 > 2.9.1，1.0 = 1
+func compareVersion(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.ParseInt(x, 10, 64)
+		yn, yerr := strconv.ParseInt(y, 10, 64)
+		if xerr == nil && yerr == nil {
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if n := strings.Compare(x, y); n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+//下发给uid的packet，Mid为广播id
+func (b *Broadcast) Packet(uid int64) *Packet {
+	return &Packet{
+		Ver: PROTO_VERSION,
+		Mt:  MESSAGE_TYPE_BROADCAST,
+		Mid: b.Id,
+		Ct:  b.Ct,
+		Sid: b.Sid,
+		Rid: uid,
+		Ext: b.Ext,
+		Pl:  b.Pl,
+	}
+}
+
+//comet的临时channel，每个节点一个，节点退出后nsq自动删除
+func broadcastChannel() string {
+	hostname, _ := os.Hostname()
+	node := broadcastChannelPattern.ReplaceAllString(fmt.Sprintf("%s_%d", hostname, os.Getpid()), "_")
+	channel := MESSAGE_CHANNEL_BROADCAST + "_" + node
+	//channel名称最长64个字符，包括#ephemeral
+	if len(channel) > 54 {
+		channel = channel[len(channel)-54:]
+	}
+	return channel + "#ephemeral"
+}
+
+var (
+	//KEYS: offline
+	//ARGV: ct broadcast min_ct max_count
+	saveBroadcastScript = redis.NewScript(1, `
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -tonumber(ARGV[4]) - 1)
+return 1`)
+)
+
+//保存离线广播，删除超过保存时间和数量的广播
+func SaveOfflineBroadcast(conn redis.Conn, b *Broadcast) error {
+	data, _ := json.Marshal(b)
+	minCt := nowMillis() - int64(BROADCAST_OFFLINE_MAX_AGE/time.Millisecond)
+	_, err := saveBroadcastScript.Do(conn, KEY_BROADCAST_OFFLINE, b.Ct, data, minCt, BROADCAST_OFFLINE_MAX_COUNT)
+	return err
+}
+
+//用户断线期间的离线广播，没有断线记录时返回所有没有过期的广播
+func OfflineBroadcasts(conn redis.Conn, uid int64) ([]*Broadcast, error) {
+	min := "-inf"
+	if seen, err := redis.Int64(conn.Do("GET", broadcastSeenKey(uid))); err == nil {
+		min = "(" + strconv.FormatInt(seen, 10)
+	} else if err != redis.ErrNil {
+		return nil, err
+	}
+
+	values, err := redis.ByteSlices(conn.Do("ZRANGEBYSCORE", KEY_BROADCAST_OFFLINE, min, "+inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := nowMillis()
+	bs := []*Broadcast{}
+	for _, data := range values {
+		b := &Broadcast{}
+		if err := json.Unmarshal(data, b); err != nil || b.Expire < now {
+			continue
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+//记录断线时间，上线时只下发这之后的广播
+func SetBroadcastSeen(conn redis.Conn, uid int64) error {
+	_, err := conn.Do("SET", broadcastSeenKey(uid), nowMillis(), "EX", int64(BROADCAST_OFFLINE_MAX_AGE/time.Second))
+	return err
+}
+
+func broadcastSeenKey(uid int64) string {
+	return fmt.Sprintf("%s%d", KEY_PREFIX_BROADCAST_SEEN, uid)
+}
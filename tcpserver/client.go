@@ -2,8 +2,10 @@ package tcpserver
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,6 +21,11 @@ var (
 type ResponseInfo struct {
 	Status int64
 	Msg    string
+	Caps   uint32 `json:",omitempty"` //鉴权回执: 协商后的能力
+	Key    string `json:",omitempty"` //鉴权回执: comet的公钥，协商加密时返回
+	KeySig string `json:",omitempty"` //鉴权回执: comet配置了签名私钥时对双方公钥的签名
+	Resume string `json:",omitempty"` //鉴权回执: 断线重连时恢复会话的token，只能使用一次
+	AckMid int64  `json:",omitempty"` //鉴权回执: 恢复会话时服务端记录的最后回执的消息id
 }
 
 type DeviceInfo struct {
@@ -28,6 +35,13 @@ type DeviceInfo struct {
 type AuthInfo struct {
 	Uid   int64
 	Token string
+	Caps  uint32 `json:",omitempty"` //客户端支持的能力，协议版本不低于PROTO_VERSION_CAPS时有效
+	Key   string `json:",omitempty"` //客户端的公钥，请求加密时需要
+
+	Platform   string `json:",omitempty"` //客户端平台，例如 ios、android，用于广播分群
+	AppVersion string `json:",omitempty"` //客户端版本，用于广播分群
+
+	Resume string `json:",omitempty"` //上次鉴权回执中的恢复token，有效时不需要Token，也不需要注册设备
 }
 
 type ClientCallback interface {
@@ -43,24 +57,155 @@ type Client struct {
 	deviceToken string //用户设备token作为客户端唯一id
 	server      *TCPServer
 	conn        net.Conn
-	sendChan    chan *Packet //发送数据到客户端
+	sendQueue   *laneQueue   //发送数据到客户端，按优先级分为多个通道
 	receiveChan chan *Packet //从客户端接收数据
 	quit        chan bool
 	authFlag    int32
 	closeFlag   int32
-	closeOnce   sync.Once //保证调用一次close
+	closeOnce   sync.Once     //保证调用一次close
+	lc          *loopConn     //事件循环模式下的连接状态
+	looped      bool          //是否由事件循环处理读写，TLS连接不使用事件循环
+	certName    string        //TLS客户端证书的CN，没有证书时为空
+	mutex       sync.Mutex    //保护uid、deviceToken和codec，其他连接重新登录时会并发读取
+	codec       *PayloadCodec //鉴权时协商的payload编解码，没有协商时为nil
+	meta        ClientMeta    //鉴权时上报的客户端信息
+
+	traceAcks map[int64]traceAck //已经下发等待回执的追踪消息，按mid索引，使用mutex保护
+
+	resumeToken string    //本次鉴权下发的恢复token，使用mutex保护
+	ackMid      int64     //客户端最后回执的消息id
+	pending     []*Packet //已经下发还没有回执的消息，断线时写入会话状态
+}
+
+type traceAck struct {
+	traceId uint64
+	sent    time.Time
 }
 
 func NewClient(s *TCPServer, c net.Conn) *Client {
+	if s.loop != nil && !isTlsConn(c) {
+		//事件循环模式不需要读写channel
+		return &Client{
+			server: s,
+			conn:   c,
+			quit:   make(chan bool),
+			looped: true,
+		}
+	}
+
 	return &Client{
 		server:      s,
 		conn:        c,
-		sendChan:    make(chan *Packet, 1024),
+		sendQueue:   newLaneQueue(),
 		receiveChan: make(chan *Packet, 1024),
 		quit:        make(chan bool),
 	}
 }
 
+func (client *Client) Uid() int64 {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.uid
+}
+
+func (client *Client) DeviceToken() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.deviceToken
+}
+
+func (client *Client) setUid(uid int64) {
+	client.mutex.Lock()
+	client.uid = uid
+	client.mutex.Unlock()
+}
+
+func (client *Client) setDeviceToken(dt string) {
+	client.mutex.Lock()
+	client.deviceToken = dt
+	client.mutex.Unlock()
+}
+
+func (client *Client) payloadCodec() *PayloadCodec {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.codec
+}
+
+func (client *Client) Meta() ClientMeta {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.meta
+}
+
+func (client *Client) setMeta(meta ClientMeta) {
+	client.mutex.Lock()
+	client.meta = meta
+	client.mutex.Unlock()
+}
+
+func (client *Client) setPayloadCodec(codec *PayloadCodec) {
+	client.mutex.Lock()
+	client.codec = codec
+	client.mutex.Unlock()
+}
+
+//下发packet到客户端，按消息类型选择通道
+func (client *Client) Send(p *Packet) {
+	client.SendLane(p, packetLane(p))
+}
+
+//下发packet到指定优先级的通道，连接已经关闭时直接丢弃
+func (client *Client) SendLane(p *Packet, lane Lane) {
+	client.enqueue(p, lane, true)
+}
+
+//和SendLane相同，但是不等待，通道满时返回false，调用方决定丢弃还是关闭连接
+//在nsq handler中遍历所有连接时使用，一个慢连接不能阻塞其他连接
+func (client *Client) TrySendLane(p *Packet, lane Lane) bool {
+	return client.enqueue(p, lane, false)
+}
+
+func (client *Client) enqueue(p *Packet, lane Lane, block bool) bool {
+	if client.IsClose() {
+		return true
+	}
+	lane = validLane(lane)
+
+	if traceId := p.TraceId(); traceId != 0 {
+		//trace id只在服务端内部使用，下发前去掉，SetTraceId重新分配Ext，不修改共享的packet
+		cp := *p
+		cp.SetTraceId(0)
+		p = &cp
+		defer client.traceDownlink(traceId, p, time.Now())
+	}
+
+	if client.server.resumeTtl > 0 && isResumablePacket(p) {
+		client.trackPending(p)
+	}
+
+	//在入队时处理payload，保证协商之前入队的消息不会被加密
+	p = client.payloadCodec().Encode(p)
+
+	if client.lc != nil {
+		//事件循环模式写不出去时暂存，不会阻塞
+		if err := client.lc.send(p, lane); err != nil {
+			client.Close()
+		}
+		return true
+	}
+
+	if !block {
+		return client.sendQueue.tryPush(p, lane)
+	}
+	client.sendQueue.push(p, lane, client.quit)
+	return true
+}
+
 func (client *Client) OnConnect() bool {
 	fmt.Println("connect success")
 	return true
@@ -71,8 +216,8 @@ func (client *Client) OnRegister() bool {
 	defer conn.Close()
 
 	//写入设备在线
-	key := fmt.Sprintf("%s%s", KEY_PREFIX_DEVICE_ONLINE, client.deviceToken)
-	conn.Do("SET", key, client.deviceToken)
+	key := fmt.Sprintf("%s%s", KEY_PREFIX_DEVICE_ONLINE, client.DeviceToken())
+	conn.Do("SET", key, client.DeviceToken())
 	return true
 }
 
@@ -81,51 +226,70 @@ func (client *Client) OnAuth() bool {
 	defer conn.Close()
 
 	//写入用户在线
-	key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_ONLINE, client.uid)
-	conn.Do("SET", key, client.uid)
+	key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_ONLINE, client.Uid())
+	conn.Do("SET", key, client.Uid())
 
-	//下发离线消息
-	//下发p2p
+	//下发离线消息，每个会话先下发缺失通知(如果有)再按时间顺序下发消息
 	go func() {
 		conn := client.server.pool.Get()
 		defer conn.Close()
 
-		key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_OFFLINE_MSGS, client.uid)
-		for {
-			buf, err := redis.Bytes(conn.Do("LPOP", key))
-			if buf == nil || err != nil {
-				break
-			}
-
-			p, err := client.server.protocol.Unserialize(buf)
-			if err == nil {
-				client.sendChan <- p
-			}
-		}
+		uid := client.Uid()
+		proto := client.server.protocol
+		ps := popLegacyOffline(conn, proto, fmt.Sprintf("%s%d", KEY_PREFIX_USER_OFFLINE_MSGS, uid))
+		ps = append(ps, popLegacyOffline(conn, proto, fmt.Sprintf("%s%d", KEY_PREFIX_GROUP_OFFLINE_MSGS, uid))...)
+		client.deliverOffline(conn, ps)
 	}()
 
-	//下发群消息
+	return true
+}
+
+//恢复会话，先重新下发断线前没有回执的消息，再下发断线期间的离线消息
+func (client *Client) OnResume(s *ResumeSession) bool {
+	conn := client.server.pool.Get()
+	defer conn.Close()
+
+	//写入用户在线
+	key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_ONLINE, client.Uid())
+	conn.Do("SET", key, client.Uid())
+
 	go func() {
 		conn := client.server.pool.Get()
 		defer conn.Close()
 
-		key := fmt.Sprintf("%s%d", KEY_PREFIX_GROUP_OFFLINE_MSGS, client.uid)
-		for {
-			buf, err := redis.Bytes(conn.Do("LPOP", key))
-			if buf == nil || err != nil {
-				break
-			}
-
-			p, err := client.server.protocol.Unserialize(buf)
-			if err == nil {
-				client.sendChan <- p
-			}
-		}
+		client.deliverOffline(conn, s.packets(client.server.protocol))
 	}()
 
 	return true
 }
 
+//在ps之后下发离线消息和断线期间的广播
+func (client *Client) deliverOffline(conn redis.Conn, ps []*Packet) {
+	uid := client.Uid()
+	offline, err := PopOffline(conn, client.server.protocol, uid)
+	if err != nil {
+		fmt.Printf("pop offline messages error: %s, uid=%d\n", err.Error(), uid)
+	}
+	ps = append(ps, offline...)
+
+	//断线期间的广播，按当前连接的客户端信息过滤
+	broadcasts, err := OfflineBroadcasts(conn, uid)
+	if err != nil {
+		fmt.Printf("get offline broadcasts error: %s, uid=%d\n", err.Error(), uid)
+	}
+	meta := client.Meta()
+	for _, b := range broadcasts {
+		if b.Match(&meta) {
+			ps = append(ps, b.Packet(uid))
+		}
+	}
+
+	//离线同步量可能很大，使用批量通道，不影响控制消息和在线聊天消息
+	for _, p := range ps {
+		client.SendLane(p, LANE_BULK)
+	}
+}
+
 func buildResponseInfo(status int64, msg string) []byte {
 	resp := ResponseInfo{
 		Status: status,
@@ -138,6 +302,11 @@ func buildResponseInfo(status int64, msg string) []byte {
 
 //根据收到的消息类型，不同的处理逻辑
 func (client *Client) OnMessage(p *Packet) bool {
+	if err := client.payloadCodec().Decode(p); err != nil {
+		fmt.Printf("decode payload error: %s, uid=%d, mt=%d\n", err.Error(), client.Uid(), p.Mt)
+		return true
+	}
+
 	switch p.Mt {
 	case MESSAGE_TYPE_HEARTBEAT:
 		//心跳
@@ -160,6 +329,18 @@ func (client *Client) OnMessage(p *Packet) bool {
 	case MESSAGE_TYPE_ROOM:
 		//聊天室消息
 		client.handleRoom(p)
+	case MESSAGE_TYPE_ACK:
+		//收到下发消息的回执
+		client.handleAck(p)
+	case MESSAGE_TYPE_CONV_SYNC:
+		//同步会话列表
+		client.handleConvSync(p)
+	case MESSAGE_TYPE_CONV_READ:
+		//会话已读
+		client.handleConvRead(p)
+	case MESSAGE_TYPE_BURN_READ:
+		//阅后即焚消息已读
+		client.handleBurnRead(p)
 	default:
 		fmt.Printf("unknown message type: %d\n", p.Mt)
 	}
@@ -180,7 +361,7 @@ func (client *Client) handlePing(p *Packet) {
 		Rid: 0,
 	}
 
-	client.sendChan <- packet
+	client.Send(packet)
 }
 
 func (client *Client) handleRegister(p *Packet) {
@@ -197,34 +378,12 @@ func (client *Client) handleRegister(p *Packet) {
 			Rid: 0,
 			Pl:  buildResponseInfo(-1, "params decode err"),
 		}
-		client.sendChan <- packet
+		client.Send(packet)
 		return
 	}
 
 	fmt.Println(deviceInfo.Token)
-	c := client.server.GetClientByDt(deviceInfo.Token)
-	if c == nil {
-		//注册新的客户端
-		client.server.RegisterClientByDt(client, deviceInfo.Token)
-	} else {
-		//有老的客户端
-		if client == c {
-			//同一个客户端 do nothing
-		} else {
-			//不是同一个客户端，注销之前的客户端
-			c.Close()
-			client.server.UnRegisterClient(c.uid, deviceInfo.Token)
-			//注册新的客户端
-			client.server.RegisterClientByDt(client, deviceInfo.Token)
-		}
-	}
-
-	if client.IsAuth() {
-		client.server.RegisterClientByUid(client, client.uid)
-	}
-
-	client.deviceToken = deviceInfo.Token
-	client.OnRegister()
+	client.registerDevice(deviceInfo.Token)
 
 	//返回成功回执
 	packet := &Packet{
@@ -235,14 +394,37 @@ func (client *Client) handleRegister(p *Packet) {
 		Rid: 0,
 		Pl:  buildResponseInfo(0, ""),
 	}
-	client.sendChan <- packet
+	client.Send(packet)
+}
+
+//同一台设备只保留一个连接，原子替换后关闭老的客户端
+func (client *Client) registerDevice(token string) {
+	if dt := client.DeviceToken(); dt != "" && dt != token {
+		client.server.clients.RemoveDt(dt, client)
+	}
+	client.setDeviceToken(token)
+	if c := client.server.ReplaceClientByDt(client, token); c != nil && c != client {
+		c.Close()
+	}
+	if client.IsClose() {
+		client.server.UnRegisterClient(client)
+		return
+	}
+
+	if client.IsAuth() {
+		client.server.RegisterClientByUid(client, client.Uid())
+	}
+
+	client.OnRegister()
 }
 
 func (client *Client) handleAuth(p *Packet) {
 	//获取鉴权信息
 	authInfo := AuthInfo{}
 	err := json.Unmarshal(p.Pl, &authInfo)
-	if err != nil || authInfo.Uid == 0 || authInfo.Token == "" {
+	//TLS客户端证书的CN和uid一致时信任该连接，不需要token，用于服务端机器人
+	trusted := err == nil && client.certName != "" && client.certName == strconv.FormatInt(authInfo.Uid, 10)
+	if err != nil || authInfo.Uid == 0 || (authInfo.Token == "" && authInfo.Resume == "" && !trusted) {
 		//输出鉴权失败信息
 		packet := &Packet{
 			Ver: p.Ver,
@@ -253,13 +435,35 @@ func (client *Client) handleAuth(p *Packet) {
 			Rid: 0,
 			Pl:  buildResponseInfo(-1, "params decode err"),
 		}
-		client.sendChan <- packet
+		client.Send(packet)
+		return
+	}
+
+	//带有恢复token时恢复断线前的会话，不需要鉴权
+	var session *ResumeSession
+	if authInfo.Resume != "" && client.server.resumeTtl > 0 {
+		session, err = client.server.takeResumeSession(authInfo.Uid, authInfo.Resume)
+		if err != nil {
+			fmt.Printf("take resume session error: %s, uid=%d\n", err.Error(), authInfo.Uid)
+		}
+	}
+	if authInfo.Resume != "" && session == nil {
+		packet := &Packet{
+			Ver: p.Ver,
+			Mt:  MESSAGE_TYPE_AUTH_STATUS,
+			Mid: 0,
+			Ct:  time.Now().UnixNano() / 1000000,
+			Sid: 0,
+			Rid: 0,
+			Pl:  buildResponseInfo(AUTH_STATUS_RESUME_FAILED, "resume failed"),
+		}
+		client.Send(packet)
 		return
 	}
 
 	//获取鉴权信息
 	//判断鉴权通过
-	if authInfo.Token != "123" {
+	if session == nil && !trusted && authInfo.Token != "123" {
 		packet := &Packet{
 			Ver: p.Ver,
 			Mt:  MESSAGE_TYPE_AUTH_STATUS,
@@ -269,34 +473,51 @@ func (client *Client) handleAuth(p *Packet) {
 			Rid: 0,
 			Pl:  buildResponseInfo(-2, "auth failed"),
 		}
-		client.sendChan <- packet
+		client.Send(packet)
+		return
 	}
 
 	//通过
-	c := client.server.GetClientByUid(authInfo.Uid)
-	if c == nil {
-		//注册新的客户端
-		client.server.RegisterClientByUid(client, authInfo.Uid)
-	} else {
-		//有老的客户端
-		if client == c {
-			//同一个客户端 do nothing
-		} else {
-			//不是同一个客户端，注销之前的客户端
-			c.Close()
-			client.server.UnRegisterClient(authInfo.Uid, c.deviceToken)
-			//注册新的客户端
-			client.server.RegisterClientByDt(client, client.deviceToken)
-			client.server.RegisterClientByUid(client, authInfo.Uid)
-		}
+	//同一个用户只保留一个连接，原子替换后关闭老的客户端
+	if uid := client.Uid(); uid != 0 && uid != authInfo.Uid {
+		client.server.clients.RemoveUid(uid, client)
+	}
+	client.setUid(authInfo.Uid)
+	meta := ClientMeta{Uid: authInfo.Uid, Platform: authInfo.Platform, AppVersion: authInfo.AppVersion}
+	if session != nil && meta.Platform == "" && meta.AppVersion == "" {
+		meta.Platform, meta.AppVersion = session.Platform, session.AppVersion
+	}
+	client.setMeta(meta)
+	if c := client.server.ReplaceClientByUid(client, authInfo.Uid); c != nil && c != client {
+		c.Close()
+	}
+	//鉴权期间连接可能已经关闭(心跳超时、写失败)，关闭时的注销可能早于上面的注册，这里再注销一次
+	if client.IsClose() {
+		client.server.UnRegisterClient(client)
+		return
 	}
 
 	atomic.StoreInt32(&client.authFlag, 1)
 
-	client.uid = authInfo.Uid
-	client.OnAuth()
+	resp := ResponseInfo{}
+	if session != nil {
+		//恢复设备注册，之后收到的回执从断线前的位置继续
+		if session.DeviceToken != "" {
+			client.registerDevice(session.DeviceToken)
+		}
+		client.mutex.Lock()
+		client.ackMid = session.AckMid
+		client.mutex.Unlock()
+		resp.AckMid = session.AckMid
+	}
+	if client.server.resumeTtl > 0 {
+		resp.Resume = newResumeToken()
+		client.setResumeToken(resp.Resume)
+	}
+	codec := client.negotiate(p, &authInfo, &resp)
 
-	//成功回执
+	//成功回执，回执本身不加密，之后下发的消息按协商结果处理
+	data, _ := json.Marshal(resp)
 	packet := &Packet{
 		Ver: p.Ver,
 		Mt:  MESSAGE_TYPE_AUTH_STATUS,
@@ -304,9 +525,50 @@ func (client *Client) handleAuth(p *Packet) {
 		Ct:  time.Now().UnixNano() / 1000000,
 		Sid: 0,
 		Rid: 0,
-		Pl:  buildResponseInfo(0, ""),
+		Pl:  data,
+	}
+	client.Send(packet)
+	client.setPayloadCodec(codec)
+
+	if session != nil {
+		client.OnResume(session)
+		return
 	}
-	client.sendChan <- packet
+	client.OnAuth()
+}
+
+//协商压缩和加密，结果写入resp，老版本客户端不协商
+func (client *Client) negotiate(p *Packet, authInfo *AuthInfo, resp *ResponseInfo) *PayloadCodec {
+	if p.Ver < PROTO_VERSION_CAPS {
+		return nil
+	}
+
+	caps := authInfo.Caps & client.server.caps
+	var key []byte
+	if caps&CAP_AES_GCM != 0 {
+		kx, err := NewKeyExchange()
+		if err == nil {
+			key, err = kx.SessionKey(authInfo.Key)
+		}
+		if err != nil {
+			//公钥无效时不加密，客户端根据回执中的Caps决定是否继续
+			fmt.Printf("key exchange error: %s, uid=%d\n", err.Error(), authInfo.Uid)
+			caps &^= CAP_AES_GCM
+		} else {
+			resp.Key = kx.PublicKey()
+			if client.server.signKey != nil {
+				resp.KeySig = SignKeyExchange(client.server.signKey, resp.Key, authInfo.Key)
+			}
+		}
+	}
+
+	codec, err := NewPayloadCodec(caps, client.server.compressThreshold, key)
+	if err != nil {
+		fmt.Printf("payload codec error: %s, uid=%d\n", err.Error(), authInfo.Uid)
+		return nil
+	}
+	resp.Caps = codec.Caps()
+	return codec
 }
 
 func (client *Client) handleP2p(p *Packet) {
@@ -315,7 +577,7 @@ func (client *Client) handleP2p(p *Packet) {
 		return
 	}
 
-	client.server.inChan <- p
+	client.ingress(p)
 
 	//成功回执
 	packet := &Packet{
@@ -327,7 +589,7 @@ func (client *Client) handleP2p(p *Packet) {
 		Rid: p.Rid,
 	}
 
-	client.sendChan <- packet
+	client.Send(packet)
 }
 
 func (client *Client) handleGroup(p *Packet) {
@@ -336,7 +598,7 @@ func (client *Client) handleGroup(p *Packet) {
 		return
 	}
 
-	client.server.inChan <- p
+	client.ingress(p)
 
 	//成功回执
 	packet := &Packet{
@@ -348,7 +610,7 @@ func (client *Client) handleGroup(p *Packet) {
 		Rid: p.Rid,
 	}
 
-	client.sendChan <- packet
+	client.Send(packet)
 }
 
 func (client *Client) handleRoom(p *Packet) {
@@ -357,7 +619,7 @@ func (client *Client) handleRoom(p *Packet) {
 		return
 	}
 
-	client.server.inChan <- p
+	client.ingress(p)
 
 	//成功回执
 	packet := &Packet{
@@ -369,7 +631,136 @@ func (client *Client) handleRoom(p *Packet) {
 		Rid: p.Rid,
 	}
 
-	client.sendChan <- packet
+	client.Send(packet)
+}
+
+//分配trace id后交给nsq分发
+func (client *Client) ingress(p *Packet) {
+	//发送者以鉴权的uid为准，拉黑、好友和陌生人限制都按Sid检查，不能信任客户端填写的值
+	p.Sid = client.Uid()
+	//trace id只由comet分配，客户端带上的不能用来强制追踪或者伪造span
+	p.SetTraceId(0)
+
+	start := time.Now()
+	traceId := client.server.tracer.Start(p)
+	client.server.inChan <- p
+	client.server.tracer.Record(traceId, SPAN_COMET_INGRESS, p, start, nil)
+}
+
+//记录下发span，等待接收者回执
+func (client *Client) traceDownlink(traceId uint64, p *Packet, start time.Time) {
+	client.server.tracer.Record(traceId, SPAN_DOWNLINK_WRITE, p, start, nil, "uid", strconv.FormatInt(client.Uid(), 10))
+	if p.Mid == 0 {
+		return
+	}
+
+	client.mutex.Lock()
+	if client.traceAcks == nil {
+		client.traceAcks = make(map[int64]traceAck)
+	}
+	//客户端一直不回执时不再记录，避免占用内存
+	if len(client.traceAcks) < TRACE_PENDING_ACKS {
+		client.traceAcks[p.Mid] = traceAck{traceId: traceId, sent: start}
+	}
+	client.mutex.Unlock()
+}
+
+func (client *Client) handleAck(p *Packet) {
+	client.mutex.Lock()
+	ack, ok := client.traceAcks[p.Mid]
+	delete(client.traceAcks, p.Mid)
+	client.mutex.Unlock()
+
+	if client.server.resumeTtl > 0 {
+		client.ackPending(p.Mid)
+	}
+
+	//span的耗时为下发到收到回执的时间
+	if ok {
+		client.server.tracer.Record(ack.traceId, SPAN_CLIENT_ACK, p, ack.sent, nil, "uid", strconv.FormatInt(client.Uid(), 10))
+	}
+}
+
+func (client *Client) handleConvSync(p *Packet) {
+	if !client.IsAuth() {
+		//没有通过鉴权
+		return
+	}
+
+	//payload为空时返回最新的会话
+	s := &ConvSync{}
+	if len(p.Pl) > 0 {
+		if err := json.Unmarshal(p.Pl, s); err != nil {
+			fmt.Printf("conv sync decode error: %s, uid=%d\n", err.Error(), client.Uid())
+			return
+		}
+	}
+
+	conn := client.server.pool.Get()
+	defer conn.Close()
+
+	list, err := ListConversations(conn, client.Uid(), s)
+	if err != nil {
+		fmt.Printf("list conversations error: %s, uid=%d\n", err.Error(), client.Uid())
+		return
+	}
+	client.sendConvList(p, list)
+}
+
+func (client *Client) handleConvRead(p *Packet) {
+	if !client.IsAuth() {
+		//没有通过鉴权
+		return
+	}
+
+	r := &ConvRead{}
+	if err := json.Unmarshal(p.Pl, r); err != nil {
+		fmt.Printf("conv read decode error: %s, uid=%d\n", err.Error(), client.Uid())
+		return
+	}
+
+	conn := client.server.pool.Get()
+	defer conn.Close()
+
+	unread, err := ReadConversation(conn, client.Uid(), r)
+	if err != nil {
+		fmt.Printf("read conversation error: %s, uid=%d\n", err.Error(), client.Uid())
+		return
+	}
+	client.sendConvList(p, &ConvList{Convs: []*Conversation{}, Unread: unread})
+}
+
+//交给store从所有存储删除，store校验消息属于这个用户并且是阅后即焚消息
+func (client *Client) handleBurnRead(p *Packet) {
+	if !client.IsAuth() || client.server.sub == nil {
+		return
+	}
+
+	r := &ConvRead{}
+	if err := json.Unmarshal(p.Pl, r); err != nil {
+		fmt.Printf("burn read decode error: %s, uid=%d\n", err.Error(), client.Uid())
+		return
+	}
+
+	data, _ := json.Marshal(&BurnEvent{Uid: client.Uid(), Mt: r.Mt, Cid: r.Cid, Mid: r.Mid})
+	if err := client.server.sub.PublishBody(MESSAGE_TOPIC_BURN, data); err != nil {
+		fmt.Printf("publish burn read error: %s, uid=%d, mid=%d\n", err.Error(), client.Uid(), r.Mid)
+	}
+}
+
+//回复会话请求，Mid为请求的Mid
+func (client *Client) sendConvList(p *Packet, list *ConvList) {
+	data, _ := json.Marshal(list)
+	packet := &Packet{
+		Ver: p.Ver,
+		Mt:  MESSAGE_TYPE_CONV_LIST,
+		Mid: p.Mid,
+		Ct:  time.Now().UnixNano() / 1000000,
+		Sid: 0,
+		Rid: client.Uid(),
+		Pl:  data,
+	}
+	client.Send(packet)
 }
 
 func (client *Client) OnClose() bool {
@@ -378,27 +769,49 @@ func (client *Client) OnClose() bool {
 	conn := client.server.pool.Get()
 	defer conn.Close()
 
-	//删除用户在线
-	key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_ONLINE, client.uid)
-	conn.Do("DEL", key)
+	//删除用户在线并记录断线时间，用户已经在新连接上重新登录时保留
+	if c := client.server.GetClientByUid(client.Uid()); c == nil || c == client {
+		key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_ONLINE, client.Uid())
+		conn.Do("DEL", key)
+		if client.Uid() != 0 {
+			SetBroadcastSeen(conn, client.Uid())
+		}
+		//保存会话状态，客户端在resume_ttl内重连时恢复
+		if token, s := client.resumeSession(); s != nil {
+			if err := SaveResumeSession(conn, token, s, client.server.resumeTtl); err != nil {
+				fmt.Printf("save resume session error: %s, uid=%d\n", err.Error(), s.Uid)
+			}
+		}
+	}
 
 	//删除设备在线
-	key = fmt.Sprintf("%s%s", KEY_PREFIX_DEVICE_ONLINE, client.deviceToken)
-	conn.Do("DEL", key)
+	if c := client.server.GetClientByDt(client.DeviceToken()); c == nil || c == client {
+		key := fmt.Sprintf("%s%s", KEY_PREFIX_DEVICE_ONLINE, client.DeviceToken())
+		conn.Do("DEL", key)
+	}
 
 	return true
 }
 
 func (client *Client) Close() {
 	client.closeOnce.Do(func() {
-		client.server.UnRegisterClient(client.uid, client.deviceToken)
+		//先标记关闭再注销，并发注册的一方在注册后检查到关闭时自己注销
 		atomic.StoreInt32(&client.closeFlag, 1) //标记关闭
-		atomic.StoreInt32(&client.authFlag, 0)  //标记关闭
-		client.quit <- true
-		close(client.quit)
-		close(client.sendChan)
-		close(client.receiveChan)
+		client.server.UnRegisterClient(client)
+		atomic.StoreInt32(&client.authFlag, 0) //标记关闭
+		if client.looped {
+			//事件循环模式没有读写goroutine在等待quit
+			if client.lc != nil {
+				client.lc.close()
+			}
+			close(client.quit)
+		} else {
+			//close会唤醒所有等待quit的goroutine，不需要再发送
+			//sendQueue和receiveChan不关闭，避免和并发写入竞争，读写goroutine通过quit退出
+			close(client.quit)
+		}
 		client.conn.Close()
+		client.server.connDone()
 		client.OnClose()
 	})
 }
@@ -413,6 +826,17 @@ func (client *Client) IsAuth() bool {
 
 func (client *Client) Do() {
 	if !client.OnConnect() {
+		client.conn.Close()
+		client.server.connDone()
+		return
+	}
+
+	if client.looped {
+		//事件循环模式，读写由poller统一处理
+		if err := client.server.loop.Add(client); err != nil {
+			fmt.Printf("event loop add error: %s\n", err.Error())
+			client.Close()
+		}
 		return
 	}
 
@@ -437,41 +861,134 @@ func (client *Client) readLoop() {
 		default:
 		}
 
-		//读取数据
+		//读取数据，超过idleTimeout没有数据时读取失败，关闭连接
+		if client.server.idleTimeout > 0 {
+			client.conn.SetReadDeadline(time.Now().Add(client.server.idleTimeout))
+		}
 		p, err := client.server.protocol.ReadPacket(client.conn)
 		if err != nil {
 			fmt.Printf("read packet error: %s\n", err.Error())
 			return
 		}
 
-		client.receiveChan <- p
+		select {
+		case client.receiveChan <- p:
+		case <-client.quit:
+			return
+		}
+	}
+}
+
+//控制类消息需要立即下发，不参与合并等待
+func isControlPacket(p *Packet) bool {
+	switch p.Mt {
+	case MESSAGE_TYPE_PONG, MESSAGE_TYPE_REGISTER_STATUS, MESSAGE_TYPE_AUTH_STATUS, MESSAGE_TYPE_ACK:
+		return true
 	}
+	return false
 }
 
 //写入数据到客户端
+//按优先级从sendQueue取出已经排队的packet合并到一个缓冲区，一次系统调用写出
+//缓冲区达到writeFlushSize，或者等待超过writeFlushLatency，或者遇到控制类消息时立即flush
 func (client *Client) writeLoop() {
 	defer func() {
 		recover()
 		client.Close()
 	}()
 
+	flushSize := int(atomic.LoadInt64(&client.server.writeFlushSize))
+	if flushSize <= 0 {
+		flushSize = 16 * 1024
+	}
+	latency := time.Duration(atomic.LoadInt64(&client.server.writeFlushLatency))
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	queue := client.sendQueue
+	var buf []byte
 	for {
 		select {
 		case <-client.server.quit:
 			return
 		case <-client.quit:
 			return
-		case p := <-client.sendChan:
-			if client.IsClose() {
-				return
+		case <-queue.signal:
+		}
+
+		p := queue.pop()
+		if p == nil {
+			continue
+		}
+		if client.IsClose() {
+			return
+		}
+
+		buf = appendPacket(client.server.protocol, buf[:0], p)
+		flush := isControlPacket(p)
+		waiting := false
+		for !flush && len(buf) < flushSize {
+			if p := queue.pop(); p != nil {
+				buf = appendPacket(client.server.protocol, buf, p)
+				flush = isControlPacket(p)
+				continue
+			}
+
+			//队列已经取空，在延迟预算内等待后续消息
+			if latency <= 0 {
+				break
+			}
+			if !waiting {
+				timer.Reset(latency)
+				waiting = true
 			}
 
-			err := client.server.protocol.WritePacket(client.conn, p)
-			if err != nil {
+			select {
+			case <-client.server.quit:
+				return
+			case <-client.quit:
 				return
+			case <-queue.signal:
+			case <-timer.C:
+				waiting = false
+				flush = true
 			}
 		}
+		if waiting && !timer.Stop() {
+			<-timer.C
+		}
+
+		if err := client.flush(buf); err != nil {
+			return
+		}
+
+		//缓冲区满或者遇到控制消息时队列里可能还有消息，通知已经被取走，重新通知
+		if queue.pending() {
+			queue.notify()
+		}
+
+		//突发流量产生的大缓冲区不长期保留
+		if cap(buf) > 4*flushSize {
+			buf = nil
+		}
+	}
+}
+
+//一次写出合并后的数据
+func (client *Client) flush(buf []byte) error {
+	n, err := client.conn.Write(buf)
+	if err != nil {
+		fmt.Printf("socket write error: %s\n", err.Error())
+		return err
+	}
+
+	if n != len(buf) {
+		fmt.Printf("socket write less: %d, %d\n", n, len(buf))
+		return errors.New("socket write less")
 	}
+
+	return nil
 }
 
 func (client *Client) handleLoop() {
@@ -1,131 +1,748 @@
-package main
+package client
 
 import (
+	"crypto/tls"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"go/tcpserver"
+	"math/rand"
 	"net"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func main() {
-	var (
-		listenAddr = flag.String("listen.addr", ":12000", "tcp listen address")
-		uid        = flag.Int64("sid", 1, "user id")
-		rid        = flag.Int64("rid", 2, "user id")
-	)
-	flag.Parse()
+var (
+	ErrClosed       = errors.New("client closed")
+	ErrNotConnected = errors.New("client not connected")
+	ErrAckTimeout   = errors.New("wait ack timeout")
+	ErrDisconnected = errors.New("connection lost before ack")
+)
+
+type Config struct {
+	Addr        string //comet地址
+	Ver         int32  //协议版本号
+	Uid         int64  //用户id
+	Token       string //鉴权token
+	DeviceToken string //设备token
+
+	DialTimeout       time.Duration //建立连接超时
+	LoginTimeout      time.Duration //注册和鉴权回执超时
+	HeartbeatInterval time.Duration //心跳间隔，超过3个间隔没有收到数据认为连接断开
+	AckTimeout        time.Duration //发送消息等待ack超时
+	ReconnectMin      time.Duration //重连最小等待时间
+	ReconnectMax      time.Duration //重连最大等待时间
+	DedupSize         int           //收到消息去重保留的mid数量
+	AutoAck           bool          //收到单聊和群消息后自动回执，服务端开启追踪时用于统计到达耗时
+	CompressThreshold int           //payload超过这个字节数时压缩，0表示不协商压缩
+	Encrypt           bool          //是否协商payload加密，需要Ver不低于PROTO_VERSION_CAPS
+	ServerKey         string        //comet签名公钥(base64)，设置后要求加密并校验密钥交换的签名，防止中间人替换公钥
+	Platform          string        //客户端平台，例如 ios、android，服务端按平台和版本筛选广播
+	AppVersion        string        //客户端版本，例如 2.10.0
+
+	Protocol tcpserver.Protocol //消息协议，默认CustomProto
+	Tls      *tls.Config        //不为nil时使用TLS连接，机器人可以配置客户端证书，证书CN为uid时不需要token
+}
+
+func NewConfig(addr string, uid int64, token string, deviceToken string) *Config {
+	return &Config{
+		Addr:              addr,
+		Ver:               tcpserver.PROTO_VERSION_CAPS,
+		Uid:               uid,
+		Token:             token,
+		DeviceToken:       deviceToken,
+		DialTimeout:       5 * time.Second,
+		LoginTimeout:      5 * time.Second,
+		HeartbeatInterval: 30 * time.Second,
+		AckTimeout:        10 * time.Second,
+		ReconnectMin:      500 * time.Millisecond,
+		ReconnectMax:      30 * time.Second,
+		DedupSize:         1024,
+		AutoAck:           true,
+		CompressThreshold: 1024,
+		Encrypt:           true,
+	}
+}
+
+//收到消息的回调，回调在读取goroutine里执行，不要长时间阻塞
+type Callbacks struct {
+	OnConnect    func()                    //注册鉴权成功
+	OnDisconnect func(err error)           //连接断开，之后会自动重连
+	OnP2p        func(p *tcpserver.Packet) //单聊消息
+	OnGroup      func(p *tcpserver.Packet) //群消息
+	OnRoom       func(p *tcpserver.Packet) //聊天室消息
+	OnPacket     func(p *tcpserver.Packet) //其他类型的消息
+	OnBroadcast  func(p *tcpserver.Packet) //系统广播，Mid为广播id，和消息id不是同一个序列
+
+	//离线消息超出服务端保留策略被丢弃，需要从消息存储补齐该会话的历史消息
+	OnOfflineGap func(gap *tcpserver.OfflineGap)
+
+	//已经发送成功的消息被服务端拒绝(例如内容过滤、被拉黑)，mid为Send时的客户端消息序号
+	//resp.Status为拒绝原因，见tcpserver.REJECT_STATUS_*
+	OnReject func(mid int64, resp *tcpserver.ResponseInfo)
+}
+
+//等待服务端ack的发送结果
+type AckFuture struct {
+	done chan struct{}
+	ack  *tcpserver.Packet
+	err  error
+	once sync.Once
+}
+
+func newAckFuture() *AckFuture {
+	return &AckFuture{done: make(chan struct{})}
+}
+
+func (f *AckFuture) complete(ack *tcpserver.Packet, err error) {
+	f.once.Do(func() {
+		f.ack = ack
+		f.err = err
+		close(f.done)
+	})
+}
+
+//等待ack，返回服务端的ack packet
+func (f *AckFuture) Wait() (*tcpserver.Packet, error) {
+	<-f.done
+	return f.ack, f.err
+}
+
+//ack完成时关闭的channel，方便和select一起使用
+func (f *AckFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+//im客户端，连接断开后自动重连并重新注册鉴权
+type Client struct {
+	config    *Config
+	callbacks Callbacks
+	proto     tcpserver.Protocol
+
+	mutex    sync.Mutex
+	conn     net.Conn
+	codec    *tcpserver.PayloadCodec //当前连接协商的payload编解码
+	pending  map[int64]*AckFuture    //等待ack的消息，key为客户端生成的mid
+	seq      int64                   //客户端消息序号
+	lastMid  int64                   //收到的最大消息id
+	recent   map[int64]bool          //最近收到的消息id，重连后服务端重复下发时去重
+	recentQ  []int64
+	resume   string     //上次鉴权回执中的恢复token，重连时先尝试恢复会话
+	writeMux sync.Mutex //保证packet完整写入
+
+	online int32
+	quit   chan struct{}
+	closed int32
+	wg     sync.WaitGroup
+}
+
+func NewClient(config *Config, callbacks Callbacks) *Client {
+	proto := config.Protocol
+	if proto == nil {
+		proto = &tcpserver.CustomProto{}
+	}
+
+	return &Client{
+		config:    config,
+		callbacks: callbacks,
+		proto:     proto,
+		pending:   make(map[int64]*AckFuture),
+		seq:       time.Now().UnixNano() / 1000000,
+		recent:    make(map[int64]bool),
+		quit:      make(chan struct{}),
+	}
+}
+
+//启动客户端，后台维持连接
+func (c *Client) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+func (c *Client) Close() {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+
+	close(c.quit)
+	c.mutex.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mutex.Unlock()
+	c.wg.Wait()
+}
+
+func (c *Client) IsOnline() bool {
+	return atomic.LoadInt32(&c.online) == 1
+}
+
+//收到的最大消息id
+func (c *Client) LastMid() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lastMid
+}
+
+func (c *Client) SendP2p(rid int64, pl []byte, ext []byte) (*AckFuture, error) {
+	return c.Send(tcpserver.MESSAGE_TYPE_P2P, rid, pl, ext)
+}
+
+func (c *Client) SendGroup(gid int64, pl []byte, ext []byte) (*AckFuture, error) {
+	return c.Send(tcpserver.MESSAGE_TYPE_GROUP, gid, pl, ext)
+}
+
+//发送@消息，uids为被@的群成员，包含tcpserver.MENTION_ALL时@所有人，不在群里的uid由服务端去掉
+//被@的接收者收到的消息IsMentioned()为true
+func (c *Client) SendGroupMentions(gid int64, pl []byte, ext []byte, uids []int64) (*AckFuture, error) {
+	p := &tcpserver.Packet{Ext: ext}
+	if err := p.SetMentions(uids); err != nil {
+		return nil, err
+	}
+	return c.Send(tcpserver.MESSAGE_TYPE_GROUP, gid, pl, p.Ext)
+}
+
+func (c *Client) SendRoom(roomId int64, pl []byte, ext []byte) (*AckFuture, error) {
+	return c.Send(tcpserver.MESSAGE_TYPE_ROOM, roomId, pl, ext)
+}
+
+//发送消息，返回等待ack的future，超过AckTimeout没有收到ack时返回ErrAckTimeout
+func (c *Client) Send(mt int32, rid int64, pl []byte, ext []byte) (*AckFuture, error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil, ErrClosed
+	}
+
+	c.mutex.Lock()
+	conn := c.conn
+	codec := c.codec
+	if conn == nil || !c.IsOnline() {
+		c.mutex.Unlock()
+		return nil, ErrNotConnected
+	}
+	c.seq++
+	mid := c.seq
+	future := newAckFuture()
+	c.pending[mid] = future
+	c.mutex.Unlock()
+
+	p := &tcpserver.Packet{
+		Ver: c.config.Ver,
+		Mt:  mt,
+		Mid: mid,
+		Ct:  time.Now().UnixNano() / 1000000,
+		Sid: c.config.Uid,
+		Rid: rid,
+		Ext: ext,
+		Pl:  pl,
+	}
+
+	if err := c.write(conn, codec.Encode(p)); err != nil {
+		c.removePending(mid)
+		return nil, err
+	}
+
+	if c.config.AckTimeout > 0 {
+		time.AfterFunc(c.config.AckTimeout, func() {
+			if c.removePending(mid) {
+				future.complete(nil, ErrAckTimeout)
+			}
+		})
+	}
+
+	return future, nil
+}
+
+//发送有效期或者阅后即焚消息，ttl为0时不过期，只支持单聊和群聊
+func (c *Client) SendEphemeral(mt int32, rid int64, pl []byte, ext []byte, ttl time.Duration, burn bool) (*AckFuture, error) {
+	p := &tcpserver.Packet{Ext: ext}
+	p.SetTTL(int64(ttl / time.Millisecond))
+	if burn {
+		p.SetFlags(p.Flags() | tcpserver.EXT_FLAG_BURN_AFTER_READ)
+	}
+	return c.Send(mt, rid, pl, p.Ext)
+}
+
+//发送媒体消息，media为MediaUploader上传完成后返回的媒体信息，payload为MediaInfo(json)
+//接收者通过MediaUploader.DownloadUrl获取下载链接
+func (c *Client) SendMedia(mt int32, rid int64, media *tcpserver.MediaInfo, ext []byte) (*AckFuture, error) {
+	p := &tcpserver.Packet{Ext: ext}
+	if err := p.SetMediaId(media.Id); err != nil {
+		return nil, err
+	}
+	if err := p.SetContentType(media.ContentType); err != nil {
+		return nil, err
+	}
+	pl, _ := json.Marshal(media)
+	return c.Send(mt, rid, pl, p.Ext)
+}
+
+//阅后即焚消息已读，服务端从所有存储删除这条消息，mt和cid为消息所在的会话
+func (c *Client) BurnRead(mt int32, cid int64, mid int64) error {
+	c.mutex.Lock()
+	conn := c.conn
+	codec := c.codec
+	c.mutex.Unlock()
+	if conn == nil || !c.IsOnline() {
+		return ErrNotConnected
+	}
+
+	data, _ := json.Marshal(&tcpserver.ConvRead{Mt: mt, Cid: cid, Mid: mid})
+	return c.write(conn, codec.Encode(&tcpserver.Packet{
+		Ver: c.config.Ver,
+		Mt:  tcpserver.MESSAGE_TYPE_BURN_READ,
+		Mid: mid,
+		Ct:  time.Now().UnixNano() / 1000000,
+		Sid: c.config.Uid,
+		Pl:  data,
+	}))
+}
+
+//同步会话列表，s为nil时返回最新的会话
+func (c *Client) SyncConversations(s *tcpserver.ConvSync) (*tcpserver.ConvList, error) {
+	if s == nil {
+		s = &tcpserver.ConvSync{}
+	}
+	data, _ := json.Marshal(s)
+	return c.convRequest(tcpserver.MESSAGE_TYPE_CONV_SYNC, data)
+}
+
+//上报会话已读，mid为已经看到的最后一条消息，返回的列表只有未读总数
+func (c *Client) ReadConversation(mt int32, cid int64, mid int64) (*tcpserver.ConvList, error) {
+	data, _ := json.Marshal(&tcpserver.ConvRead{Mt: mt, Cid: cid, Mid: mid})
+	return c.convRequest(tcpserver.MESSAGE_TYPE_CONV_READ, data)
+}
+
+func (c *Client) convRequest(mt int32, data []byte) (*tcpserver.ConvList, error) {
+	future, err := c.Send(mt, 0, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	p, err := future.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	list := &tcpserver.ConvList{}
+	if err := json.Unmarshal(p.Pl, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Client) removePending(mid int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.pending[mid]; ok {
+		delete(c.pending, mid)
+		return true
+	}
+	return false
+}
+
+//连接断开时所有等待中的消息返回失败
+func (c *Client) failPending(err error) {
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = make(map[int64]*AckFuture)
+	c.mutex.Unlock()
+
+	for _, future := range pending {
+		future.complete(nil, err)
+	}
+}
+
+func (c *Client) write(conn net.Conn, p *tcpserver.Packet) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	if c.config.HeartbeatInterval > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.config.HeartbeatInterval))
+	}
+	return c.proto.WritePacket(conn, p)
+}
+
+//维持连接，断开后按指数退避重连
+func (c *Client) run() {
+	defer c.wg.Done()
+
+	backoff := c.config.ReconnectMin
+	for {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		start := time.Now()
+		err := c.session()
+		atomic.StoreInt32(&c.online, 0)
+		c.failPending(ErrDisconnected)
+		if c.callbacks.OnDisconnect != nil {
+			c.callbacks.OnDisconnect(err)
+		}
+
+		//连接稳定运行过一段时间，重置退避时间
+		if time.Now().Sub(start) > c.config.ReconnectMax {
+			backoff = c.config.ReconnectMin
+		}
+
+		//加上随机抖动，避免大量客户端同时重连
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > c.config.ReconnectMax {
+			backoff = c.config.ReconnectMax
+		}
+	}
+}
 
-	conn, err := net.Dial("tcp", *listenAddr)
+//建立一次连接，注册鉴权后读取消息直到连接断开
+func (c *Client) session() error {
+	conn, err := c.dial()
 	if err != nil {
-		fmt.Println(err)
+		return err
+	}
+
+	c.mutex.Lock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		c.mutex.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.conn = nil
+		c.codec = nil
+		c.mutex.Unlock()
+		conn.Close()
+	}()
+
+	if err := c.login(conn); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&c.online, 1)
+	if c.callbacks.OnConnect != nil {
+		c.callbacks.OnConnect()
+	}
+
+	heartbeatQuit := make(chan struct{})
+	defer close(heartbeatQuit)
+	go c.heartbeat(conn, heartbeatQuit)
+
+	for {
+		if c.config.HeartbeatInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(3 * c.config.HeartbeatInterval))
+		}
+
+		p, err := c.proto.ReadPacket(conn)
+		if err != nil {
+			return err
+		}
+
+		c.handle(p)
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.config.Tls == nil {
+		return net.DialTimeout("tcp", c.config.Addr, c.config.DialTimeout)
+	}
+
+	dialer := &net.Dialer{Timeout: c.config.DialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", c.config.Addr, c.config.Tls)
+}
+
+//注册设备，然后鉴权，等待两个回执
+//有恢复token时先尝试恢复会话，不需要注册和鉴权，恢复失败时在同一个连接上重新注册和鉴权
+func (c *Client) login(conn net.Conn) error {
+	if c.config.LoginTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.config.LoginTimeout))
+		defer conn.SetReadDeadline(time.Time{})
 	}
 
-	proto := &tcpserver.CustomProto{}
+	//token只能使用一次
+	c.mutex.Lock()
+	resume := c.resume
+	c.resume = ""
+	c.mutex.Unlock()
+	if resume != "" {
+		resp, err := c.auth(conn, resume)
+		if resp == nil || resp.Status != tcpserver.AUTH_STATUS_RESUME_FAILED {
+			return err
+		}
+	}
 
-	//绑定设备信息
-	deviceToken := tcpserver.DeviceInfo{
-		Token: fmt.Sprintf("%d", *uid),
+	bs, _ := json.Marshal(tcpserver.DeviceInfo{Token: c.config.DeviceToken})
+	if err := c.write(conn, &tcpserver.Packet{Ver: c.config.Ver, Mt: tcpserver.MESSAGE_TYPE_REGISTER, Pl: bs}); err != nil {
+		return err
 	}
+	if _, err := c.waitStatus(conn, tcpserver.MESSAGE_TYPE_REGISTER_STATUS); err != nil {
+		return err
+	}
+
+	_, err := c.auth(conn, "")
+	return err
+}
 
-	bs, err := json.Marshal(deviceToken)
+//配置了comet公钥时必须协商加密，签名不对说明公钥被替换
+func (c *Client) verifyKeyExchange(clientKey string, resp *tcpserver.ResponseInfo) error {
+	pub, err := tcpserver.ParseVerifyKey(c.config.ServerKey)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
+	if clientKey == "" || resp.Caps&tcpserver.CAP_AES_GCM == 0 {
+		return errors.New("server key configured but encryption not negotiated")
+	}
+	return tcpserver.VerifyKeyExchange(pub, resp.Key, clientKey, resp.KeySig)
+}
 
-	p := &tcpserver.Packet{
-		Ver: 1,
-		Mt:  tcpserver.MESSAGE_TYPE_REGISTER,
-		Mid: 0,
-		Sid: 0,
-		Rid: 0,
-		Pl:  bs,
-	}
-
-	proto.WritePacket(conn, p)
-
-	// go func() {
-	// 	for {
-	// 		time.Sleep(time.Second * 3)
-	//
-	// 		p := &tcpserver.Packet{
-	// 			Ver: 1,
-	// 			Mt:  tcpserver.MESSAGE_TYPE_PING,
-	// 			Mid: 0,
-	// 			Sid: 0,
-	// 			Rid: 0,
-	// 		}
-	//
-	// 		proto.WritePacket(conn, p)
-	// 	}
-	// }()
-
-	resp := tcpserver.ResponseInfo{}
-
-	go func() {
-		for {
-			p, err := proto.ReadPacket(conn)
-			if err != nil {
-				fmt.Println(err)
-				return
+//鉴权并协商payload编解码，resume不为空时恢复会话
+func (c *Client) auth(conn net.Conn, resume string) (*tcpserver.ResponseInfo, error) {
+	auth := tcpserver.AuthInfo{Uid: c.config.Uid, Token: c.config.Token, Platform: c.config.Platform, AppVersion: c.config.AppVersion, Resume: resume}
+	var kx *tcpserver.KeyExchange
+	if c.config.Ver >= tcpserver.PROTO_VERSION_CAPS {
+		if c.config.CompressThreshold > 0 {
+			auth.Caps |= tcpserver.CAP_DEFLATE
+		}
+		if c.config.Encrypt {
+			var err error
+			if kx, err = tcpserver.NewKeyExchange(); err != nil {
+				return nil, err
 			}
+			auth.Caps |= tcpserver.CAP_AES_GCM
+			auth.Key = kx.PublicKey()
+		}
+	}
+
+	bs, _ := json.Marshal(auth)
+	if err := c.write(conn, &tcpserver.Packet{Ver: c.config.Ver, Mt: tcpserver.MESSAGE_TYPE_AUTH, Pl: bs}); err != nil {
+		return nil, err
+	}
+	resp, err := c.waitStatus(conn, tcpserver.MESSAGE_TYPE_AUTH_STATUS)
+	if err != nil {
+		return resp, err
+	}
+
+	//按comet返回的协商结果处理之后的payload，老版本comet不返回Caps
+	var key []byte
+	if c.config.ServerKey != "" {
+		if err := c.verifyKeyExchange(auth.Key, resp); err != nil {
+			return resp, err
+		}
+	}
+	if resp.Caps&tcpserver.CAP_AES_GCM != 0 {
+		if kx == nil {
+			return resp, errors.New("server enabled encryption without a key exchange")
+		}
+		if key, err = kx.SessionKey(resp.Key); err != nil {
+			return resp, err
+		}
+	}
+	codec, err := tcpserver.NewPayloadCodec(resp.Caps&auth.Caps, c.config.CompressThreshold, key)
+	if err != nil {
+		return resp, err
+	}
+
+	c.mutex.Lock()
+	c.codec = codec
+	c.resume = resp.Resume
+	c.mutex.Unlock()
+	return resp, nil
+}
+
+//等待回执，status不为0时同时返回回执和错误
+func (c *Client) waitStatus(conn net.Conn, mt int32) (*tcpserver.ResponseInfo, error) {
+	for {
+		p, err := c.proto.ReadPacket(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Mt != mt {
+			//回执之前收到的其他消息照常处理
+			c.handle(p)
+			continue
+		}
+
+		resp := &tcpserver.ResponseInfo{}
+		if err := json.Unmarshal(p.Pl, resp); err != nil {
+			return nil, err
+		}
+		if resp.Status != 0 {
+			return resp, fmt.Errorf("login failed, type: %d, status: %d, msg: %s", mt, resp.Status, resp.Msg)
+		}
+		return resp, nil
+	}
+}
 
-			fmt.Printf("%+v\n", *p)
-			//注册设备信息
-			if p.Mt == tcpserver.MESSAGE_TYPE_REGISTER_STATUS {
-				json.Unmarshal(p.Pl, &resp)
-				fmt.Printf("%+v\n", resp)
-				if resp.Status == 0 {
-					//鉴权
-					authInfo := tcpserver.AuthInfo{
-						Uid:   *uid,
-						Token: "123",
-					}
-
-					bs, err := json.Marshal(authInfo)
-					if err != nil {
-						fmt.Println(err)
-					}
-
-					p := &tcpserver.Packet{
-						Ver: 1,
-						Mt:  tcpserver.MESSAGE_TYPE_AUTH,
-						Mid: 0,
-						Sid: 0,
-						Rid: 0,
-						Pl:  bs,
-					}
-
-					proto.WritePacket(conn, p)
-				}
-			} else if p.Mt == tcpserver.MESSAGE_TYPE_AUTH_STATUS {
-				json.Unmarshal(p.Pl, &resp)
-				if resp.Status == 0 {
-					p := &tcpserver.Packet{
-						Ver: 1,
-						Mt:  tcpserver.MESSAGE_TYPE_P2P,
-						Mid: 0,
-						Sid: *uid,
-						Rid: *rid,
-					}
-
-					proto.WritePacket(conn, p)
-				}
+func (c *Client) heartbeat(conn net.Conn, quit chan struct{}) {
+	if c.config.HeartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-c.quit:
+			return
+		case <-ticker.C:
+			if err := c.write(conn, &tcpserver.Packet{Ver: c.config.Ver, Mt: tcpserver.MESSAGE_TYPE_PING}); err != nil {
+				conn.Close()
+				return
 			}
 		}
-	}()
+	}
+}
 
-	errc := make(chan error)
+func (c *Client) handle(p *tcpserver.Packet) {
+	c.mutex.Lock()
+	conn := c.conn
+	codec := c.codec
+	c.mutex.Unlock()
+	if err := codec.Decode(p); err != nil {
+		//payload无法还原说明会话密钥不一致，断开后重连重新协商
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
 
-	// Interrupt handler.
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errc <- fmt.Errorf("%s", <-c)
-	}()
+	switch p.Mt {
+	case tcpserver.MESSAGE_TYPE_PONG:
+	case tcpserver.MESSAGE_TYPE_ACK, tcpserver.MESSAGE_TYPE_CONV_LIST:
+		//会话请求的回复和消息ack一样按Mid完成等待中的future
+		c.mutex.Lock()
+		future, ok := c.pending[p.Mid]
+		delete(c.pending, p.Mid)
+		c.mutex.Unlock()
+		if ok {
+			future.complete(p, nil)
+		}
+	case tcpserver.MESSAGE_TYPE_P2P:
+		c.ack(p)
+		if c.seen(p.Mid) {
+			return
+		}
+		if c.callbacks.OnP2p != nil {
+			c.callbacks.OnP2p(p)
+		}
+	case tcpserver.MESSAGE_TYPE_GROUP:
+		c.ack(p)
+		if c.seen(p.Mid) {
+			return
+		}
+		if c.callbacks.OnGroup != nil {
+			c.callbacks.OnGroup(p)
+		}
+	case tcpserver.MESSAGE_TYPE_ROOM:
+		if c.callbacks.OnRoom != nil {
+			c.callbacks.OnRoom(p)
+		}
+	case tcpserver.MESSAGE_TYPE_BROADCAST:
+		//上线时离线广播可能和在线广播重复下发，广播id不计入LastMid
+		if c.remember(p.Mid) {
+			return
+		}
+		if c.callbacks.OnBroadcast != nil {
+			c.callbacks.OnBroadcast(p)
+		}
+	case tcpserver.MESSAGE_TYPE_OFFLINE_GAP:
+		var gap tcpserver.OfflineGap
+		if err := json.Unmarshal(p.Pl, &gap); err != nil {
+			return
+		}
+		if c.callbacks.OnOfflineGap != nil {
+			c.callbacks.OnOfflineGap(&gap)
+		}
+	case tcpserver.MESSAGE_TYPE_REJECT:
+		resp := tcpserver.ResponseInfo{}
+		if err := json.Unmarshal(p.Pl, &resp); err != nil {
+			return
+		}
+		if c.callbacks.OnReject != nil {
+			c.callbacks.OnReject(p.Mid, &resp)
+		}
+	default:
+		if c.callbacks.OnPacket != nil {
+			c.callbacks.OnPacket(p)
+		}
+	}
+}
+
+//回执收到的消息，重复下发的消息也回执
+func (c *Client) ack(p *tcpserver.Packet) {
+	if !c.config.AutoAck || p.Mid == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+
+	c.write(conn, &tcpserver.Packet{
+		Ver: c.config.Ver,
+		Mt:  tcpserver.MESSAGE_TYPE_ACK,
+		Mid: p.Mid,
+		Sid: c.config.Uid,
+		Rid: p.Sid,
+	})
+}
 
-	fmt.Printf("exit: %v", <-errc)
+//离线消息同步：鉴权后服务端会补发离线消息，重连时可能和已经收到的消息重复，按mid去重
+func (c *Client) seen(mid int64) bool {
+	if mid == 0 {
+		return false
+	}
+
+	if c.remember(mid) {
+		return true
+	}
+
+	c.mutex.Lock()
+	if mid > c.lastMid {
+		c.lastMid = mid
+	}
+	c.mutex.Unlock()
+	return false
+}
+
+//记录最近收到的id，已经收到过时返回true
+func (c *Client) remember(mid int64) bool {
+	if mid == 0 {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.recent[mid] {
+		return true
+	}
+
+	c.recent[mid] = true
+	c.recentQ = append(c.recentQ, mid)
+	if len(c.recentQ) > c.config.DedupSize {
+		delete(c.recent, c.recentQ[0])
+		c.recentQ = c.recentQ[1:]
+	}
+	return false
 }
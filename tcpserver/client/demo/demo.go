@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/tcpserver"
+	"go/tcpserver/client"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	var (
+		listenAddr = flag.String("listen.addr", ":12000", "tcp listen address")
+		uid        = flag.Int64("sid", 1, "user id")
+		rid        = flag.Int64("rid", 2, "user id")
+	)
+	flag.Parse()
+
+	config := client.NewConfig(*listenAddr, *uid, "123", fmt.Sprintf("%d", *uid))
+
+	var c *client.Client
+	c = client.NewClient(config, client.Callbacks{
+		OnConnect: func() {
+			fmt.Println("login success")
+			go func() {
+				future, err := c.SendP2p(*rid, nil, nil)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				ack, err := future.Wait()
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				fmt.Printf("ack: %+v\n", *ack)
+			}()
+		},
+		OnDisconnect: func(err error) {
+			fmt.Printf("disconnect: %v\n", err)
+		},
+		OnP2p: func(p *tcpserver.Packet) {
+			fmt.Printf("%+v\n", *p)
+		},
+		OnGroup: func(p *tcpserver.Packet) {
+			fmt.Printf("%+v\n", *p)
+		},
+		OnRoom: func(p *tcpserver.Packet) {
+			fmt.Printf("%+v\n", *p)
+		},
+		OnOfflineGap: func(gap *tcpserver.OfflineGap) {
+			fmt.Printf("offline gap: %+v\n", *gap)
+		},
+	})
+	c.Start()
+	defer c.Close()
+
+	errc := make(chan error)
+
+	// Interrupt handler.
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errc <- fmt.Errorf("%s", <-c)
+	}()
+
+	fmt.Printf("exit: %v", <-errc)
+}
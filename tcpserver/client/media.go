@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/tcpserver"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMediaUpload = errors.New("media upload failed")
+)
+
+//media服务的分片上传，中断后可以用UploadId继续上传
+type MediaUploader struct {
+	Url     string //media服务地址，例如 https://media.example.com
+	Token   string //上传凭证，业务服务登录后下发
+	Retries int    //每个分片失败后的重试次数，重试前查询服务端的进度
+
+	Http *http.Client
+}
+
+func NewMediaUploader(url string, token string) *MediaUploader {
+	return &MediaUploader{
+		Url:     strings.TrimRight(url, "/"),
+		Token:   token,
+		Retries: 3,
+		Http:    &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+//上传文件，返回媒体信息，用SendMedia发送
+func (u *MediaUploader) Upload(r io.ReaderAt, size int64, contentType string, name string) (*tcpserver.MediaInfo, error) {
+	body, _ := json.Marshal(&tcpserver.MediaUploadRequest{Size: size, ContentType: contentType, Name: name})
+	resp, err := u.do("POST", tcpserver.MEDIA_PATH_UPLOADS, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	return u.Resume(resp.UploadId, r)
+}
+
+//继续上传，从服务端记录的进度开始，r为完整的文件内容
+func (u *MediaUploader) Resume(uploadId string, r io.ReaderAt) (*tcpserver.MediaInfo, error) {
+	path := tcpserver.MEDIA_PATH_UPLOADS + "/" + uploadId
+	resp, err := u.do("GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := 0
+	for resp.Media == nil {
+		n := resp.Size - resp.Offset
+		if n > resp.ChunkSize {
+			n = resp.ChunkSize
+		}
+		chunk := make([]byte, n)
+		if _, err := r.ReadAt(chunk, resp.Offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		next, err := u.do("PUT", path, map[string]string{tcpserver.MEDIA_HEADER_OFFSET: strconv.FormatInt(resp.Offset, 10)}, chunk)
+		if err != nil {
+			failures++
+			if failures > u.Retries {
+				return nil, err
+			}
+			//分片可能已经写入，按服务端的进度继续
+			if next, err = u.do("GET", path, nil, nil); err != nil {
+				return nil, err
+			}
+		} else {
+			failures = 0
+		}
+		next.ChunkSize = resp.ChunkSize
+		resp = next
+	}
+	return resp.Media, nil
+}
+
+//获取下载链接和过期时间(秒)
+func (u *MediaUploader) DownloadUrl(mediaId string) (string, int64, error) {
+	resp, err := u.do("GET", tcpserver.MEDIA_PATH_MEDIA+mediaId+tcpserver.MEDIA_URL_SUFFIX, nil, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	return resp.Url, resp.Expires, nil
+}
+
+//Status不为0时返回错误，分片位置不一致时返回服务端的进度
+func (u *MediaUploader) do(method string, path string, headers map[string]string, body []byte) (*tcpserver.MediaResponse, error) {
+	req, err := http.NewRequest(method, u.Url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.Token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := u.Http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &tcpserver.MediaResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("%s: http status %d", ErrMediaUpload.Error(), res.StatusCode)
+	}
+	if resp.Status == tcpserver.MEDIA_STATUS_OFFSET {
+		return resp, nil
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("%s: status %d, %s", ErrMediaUpload.Error(), resp.Status, resp.Msg)
+	}
+	return resp, nil
+}
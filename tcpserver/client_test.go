@@ -0,0 +1,104 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"go/redisclient"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//不连接redis，所有命令返回空结果
+type fakeRedisConn struct{}
+
+func (fakeRedisConn) Close() error                                            { return nil }
+func (fakeRedisConn) Err() error                                              { return nil }
+func (fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) { return nil, nil }
+func (fakeRedisConn) Send(cmd string, args ...interface{}) error              { return nil }
+func (fakeRedisConn) Flush() error                                            { return nil }
+func (fakeRedisConn) Receive() (interface{}, error)                           { return nil, nil }
+
+//不连接nsqd，redis使用假的连接
+func newTestServer() *TCPServer {
+	config := NewCometConfig()
+	config.NsqdHost = ""
+	server := NewTCPServer(config)
+	server.pool = redisclient.NewWithDial(&config.Redis, func() (redis.Conn, error) {
+		return fakeRedisConn{}, nil
+	})
+	return server
+}
+
+func newPipeClient(server *TCPServer) *Client {
+	conn, peer := net.Pipe()
+	peer.Close()
+	return NewClient(server, conn)
+}
+
+func authPacket(uid int64) *Packet {
+	pl, _ := json.Marshal(AuthInfo{Uid: uid, Token: "123"})
+	return &Packet{Ver: PROTO_VERSION, Mt: MESSAGE_TYPE_AUTH, Pl: pl}
+}
+
+//同一个用户和设备的连接并发注册、鉴权和关闭，映射表中不能留下已经关闭的连接
+//go test -race ./tcpserver/ 检查并发访问
+func TestClientConcurrentAuthClose(t *testing.T) {
+	server := newTestServer()
+	const uid, dt = 1, "device"
+
+	for round := 0; round < 50; round++ {
+		clients := make([]*Client, 8)
+		var wg sync.WaitGroup
+		for i := range clients {
+			c := newPipeClient(server)
+			clients[i] = c
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				c.registerDevice(dt)
+			}()
+			go func() {
+				defer wg.Done()
+				c.handleAuth(authPacket(uid))
+			}()
+			go func(i int) {
+				defer wg.Done()
+				//一半的连接在注册鉴权过程中关闭
+				if i%2 == 0 {
+					c.Close()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if c := server.GetClientByUid(uid); c != nil && c.IsClose() {
+			t.Fatalf("round %d: closed client registered by uid", round)
+		}
+		if c := server.GetClientByDt(dt); c != nil && c.IsClose() {
+			t.Fatalf("round %d: closed client registered by device token", round)
+		}
+
+		//剩下的连接和注销并发关闭，最后映射表为空
+		for _, c := range clients {
+			wg.Add(2)
+			go func(c *Client) {
+				defer wg.Done()
+				c.Close()
+			}(c)
+			go func(c *Client) {
+				defer wg.Done()
+				server.UnRegisterClient(c)
+			}(c)
+		}
+		wg.Wait()
+
+		if n := server.clients.CountUid(); n != 0 {
+			t.Fatalf("round %d: %d clients left after close", round, n)
+		}
+		if c := server.GetClientByDt(dt); c != nil {
+			t.Fatalf("round %d: device token still registered after close", round)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package tcpserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//payload压缩和加密
+//协议版本不低于PROTO_VERSION_CAPS的客户端在鉴权时通过AuthInfo.Caps声明支持的能力，加密时带上X25519公钥
+//comet取双方都支持的能力，在鉴权回执中返回协商结果和comet的公钥，双方用ECDH + HKDF得到会话密钥
+//之后的消息按Ext标记位处理payload: 先压缩再加密；控制类消息(回执、pong)不处理
+//老版本客户端不协商，comet不会压缩或者加密发给它的消息
+//密钥交换本身不验证comet身份，只能防被动窃听；comet配置签名私钥后在回执中对双方公钥签名，
+//客户端配置对应公钥时校验签名并要求加密，中间人无法替换公钥或者去掉CAP_AES_GCM
+//鉴权信息(token)在协商之前发送，不受加密保护，需要保护token时使用TLS
+var (
+	PROTO_VERSION_CAPS int32 = 2 //支持能力协商的协议版本
+
+	CAP_DEFLATE uint32 = 1 << 0 //payload压缩
+	CAP_AES_GCM uint32 = 1 << 1 //payload加密
+
+	CODEC_MAX_PAYLOAD = 4 * 1024 * 1024          //解压后payload的最大字节数
+	CODEC_KEY_INFO    = "tcpserver session key"  //HKDF的info
+	CODEC_KEY_SIZE    = 32                       //AES-256
+	CODEC_SIGN_INFO   = "tcpserver key exchange" //签名内容的前缀，避免签名被用在其他地方
+)
+
+var (
+	ErrCodecNotNegotiated = errors.New("payload codec not negotiated")
+	ErrCodecTooLarge      = errors.New("decompressed payload too large")
+	ErrCodecDecrypt       = errors.New("payload decrypt failed")
+	ErrCodecSignature     = errors.New("key exchange signature invalid")
+)
+
+//一个连接协商后的payload编解码，为nil时不做任何处理
+type PayloadCodec struct {
+	caps      uint32
+	threshold int //payload超过这个字节数时压缩
+	aead      cipher.AEAD
+}
+
+//caps为0时返回nil；包含CAP_AES_GCM时key为会话密钥
+func NewPayloadCodec(caps uint32, threshold int, key []byte) (*PayloadCodec, error) {
+	if caps == 0 {
+		return nil, nil
+	}
+
+	c := &PayloadCodec{caps: caps, threshold: threshold}
+	if caps&CAP_AES_GCM != 0 {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aead = aead
+	}
+	return c, nil
+}
+
+func (c *PayloadCodec) Caps() uint32 {
+	if c == nil {
+		return 0
+	}
+	return c.caps
+}
+
+//返回处理后的packet，需要处理时返回新的packet，不修改p
+func (c *PayloadCodec) Encode(p *Packet) *Packet {
+	if c == nil || len(p.Pl) == 0 || isControlPacket(p) {
+		return p
+	}
+
+	pl := p.Pl
+	var flags uint32
+	if c.caps&CAP_DEFLATE != 0 && c.threshold > 0 && len(pl) > c.threshold {
+		//压缩后没有变小时发送原始数据
+		if z := deflate(pl); len(z) < len(pl) {
+			pl = z
+			flags |= EXT_FLAG_DEFLATE
+		}
+	}
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(pl)+c.aead.Overhead())
+		rand.Read(nonce)
+		pl = c.aead.Seal(nonce, nonce, pl, nil)
+		flags |= EXT_FLAG_AES_GCM
+	}
+	if flags == 0 {
+		return p
+	}
+
+	cp := *p
+	cp.Pl = pl
+	cp.SetFlags(p.Flags()&^EXT_FLAG_TRANSPORT_MASK | flags)
+	return &cp
+}
+
+//按Ext标记位还原payload并去掉传输层标记，直接修改p
+func (c *PayloadCodec) Decode(p *Packet) error {
+	flags := p.Flags()
+	if flags&EXT_FLAG_TRANSPORT_MASK == 0 {
+		return nil
+	}
+
+	pl := p.Pl
+	if flags&EXT_FLAG_AES_GCM != 0 {
+		if c == nil || c.aead == nil {
+			return ErrCodecNotNegotiated
+		}
+		n := c.aead.NonceSize()
+		if len(pl) < n {
+			return ErrCodecDecrypt
+		}
+		plain, err := c.aead.Open(nil, pl[:n], pl[n:], nil)
+		if err != nil {
+			return ErrCodecDecrypt
+		}
+		pl = plain
+	}
+	if flags&EXT_FLAG_DEFLATE != 0 {
+		if c == nil || c.caps&CAP_DEFLATE == 0 {
+			return ErrCodecNotNegotiated
+		}
+		plain, err := inflate(pl)
+		if err != nil {
+			return err
+		}
+		pl = plain
+	}
+
+	p.Pl = pl
+	p.SetFlags(flags &^ EXT_FLAG_TRANSPORT_MASK)
+	return nil
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+//限制解压后的大小，避免压缩炸弹
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	plain, err := ioutil.ReadAll(io.LimitReader(r, int64(CODEC_MAX_PAYLOAD)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > CODEC_MAX_PAYLOAD {
+		return nil, ErrCodecTooLarge
+	}
+	return plain, nil
+}
+
+//一次性的X25519密钥，每个连接鉴权时重新生成
+type KeyExchange struct {
+	priv *ecdh.PrivateKey
+}
+
+func NewKeyExchange() (*KeyExchange, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{priv: priv}, nil
+}
+
+//base64编码的公钥，放在AuthInfo.Key和ResponseInfo.Key中
+func (k *KeyExchange) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.priv.PublicKey().Bytes())
+}
+
+//和对方的公钥计算会话密钥
+func (k *KeyExchange) SessionKey(peer string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(peer)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := k.priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, CODEC_KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(CODEC_KEY_INFO)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//签名私钥为base64编码的32字节ed25519 seed
+func ParseSignKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("sign key must be a base64 encoded 32 byte ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+//验证公钥为base64编码的ed25519公钥
+func ParseVerifyKey(s string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("verify key must be a base64 encoded ed25519 public key")
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+//签名覆盖双方的公钥，回执不能被用在其他连接
+func keyExchangeMessage(serverKey string, clientKey string) []byte {
+	return []byte(CODEC_SIGN_INFO + "\n" + serverKey + "\n" + clientKey)
+}
+
+//comet对自己和客户端的公钥签名，放在ResponseInfo.KeySig中
+func SignKeyExchange(priv ed25519.PrivateKey, serverKey string, clientKey string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, keyExchangeMessage(serverKey, clientKey)))
+}
+
+func VerifyKeyExchange(pub ed25519.PublicKey, serverKey string, clientKey string, sig string) error {
+	data, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(pub, keyExchangeMessage(serverKey, clientKey), data) {
+		return ErrCodecSignature
+	}
+	return nil
+}
@@ -9,7 +9,13 @@ import (
 )
 
 func main() {
-	config := tcpserver.NewCometConfig()
+	config, loader, err := tcpserver.LoadCometConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("config: %s\n", tcpserver.ConfigString(config))
+
 	server := tcpserver.NewTCPServer(config)
 	defer func() {
 		server.Close()
@@ -18,6 +24,10 @@ func main() {
 	go func() {
 		errc <- fmt.Errorf("%s", server.Serve())
 	}()
+	// Reload handler.
+	go tcpserver.HandleReload(loader, config, func(c interface{}) {
+		server.Reload(c.(*tcpserver.CometConfig))
+	})
 	// Interrupt handler.
 	go func() {
 		c := make(chan os.Signal, 1)
@@ -1,84 +1,631 @@
 package tcpserver
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/redisclient"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//配置加载顺序：默认值 < yaml配置文件 < 环境变量 < 命令行参数
+//字段名使用yaml tag，环境变量为 IM_ + tag大写，例如 redis_pwd 对应 IM_REDIS_PWD，命令行参数为 -redis_pwd
+//嵌套的配置(例如redis)字段名为 父tag_子tag，yaml中按层级书写
+//secret tag标记的字段不会输出到日志
+//reload tag标记的字段可以通过SIGHUP重新加载
+
+var (
+	CONFIG_ENV_PREFIX = "IM_"
+	CONFIG_SECRET     = "******"
+)
+
+type Validator interface {
+	Validate() error
+}
+
 type CometConfig struct {
-	TcpHost  string
-	NsqdHost string
+	TcpHost  string `yaml:"tcp_host"`
+	NsqdHost string `yaml:"nsqd_host"`
+
+	WriteFlushSize    int           `yaml:"write_flush_size" reload:"true"`    //单个连接合并写的最大字节数
+	WriteFlushLatency time.Duration `yaml:"write_flush_latency" reload:"true"` //合并写最多等待的时间
+
+	EventLoop        bool `yaml:"event_loop"`         //是否使用epoll事件循环模式，只支持linux
+	EventLoopPollers int  `yaml:"event_loop_pollers"` //poller goroutine数量
+	EventLoopWorkers int  `yaml:"event_loop_workers"` //处理消息的worker数量
+
+	IdleTimeout time.Duration `yaml:"idle_timeout"` //超过这个时间没有收到任何数据(包括心跳)时断开连接，0表示不检查
+
+	CompressThreshold int    `yaml:"compress_threshold"`             //协商压缩后payload超过这个字节数时压缩，0表示不支持压缩
+	Encrypt           bool   `yaml:"encrypt"`                        //是否支持协商payload加密
+	EncryptSignKey    string `yaml:"encrypt_sign_key" secret:"true"` //对密钥交换签名的ed25519私钥(base64编码的32字节seed)，为空时不签名
 
-	RedisHost string
-	RedisPwd  string
-	RedisDb   int
+	Tls TlsConfig `yaml:"tls"` //TLS监听，可以和tcp_host同时开启
+
+	ResumeTtl time.Duration `yaml:"resume_ttl"` //断线后保留会话状态的时间，客户端在这段时间内重连可以恢复会话，0表示不支持
+
+	Redis redisclient.Config `yaml:"redis"`
+	Trace TraceConfig        `yaml:"trace"` //消息链路追踪
 }
 
 type DispatchConfig struct {
-	WorkerId int64
-	NsqdHost string
+	WorkerId    int64         `yaml:"worker_id"`     //snowflake workerId，-1表示从redis自动租用
+	WorkerIdTtl time.Duration `yaml:"worker_id_ttl"` //自动租用workerId的租期
+	NsqdHost    string        `yaml:"nsqd_host"`
 
-	RedisHost string
-	RedisPwd  string
-	RedisDb   int
+	Redis    redisclient.Config `yaml:"redis"`
+	Trace    TraceConfig        `yaml:"trace"`
+	Filter   FilterConfig       `yaml:"filter"`   //消息内容过滤
+	Relation RelationConfig     `yaml:"relation"` //单聊关系检查
 }
 
 type StoreConfig struct {
-	NsqdHost string
+	NsqdHost string `yaml:"nsqd_host"`
+
+	Redis redisclient.Config `yaml:"redis"`
+	Trace TraceConfig        `yaml:"trace"`
 
-	RedisHost string
-	RedisPwd  string
-	RedisDb   int
+	DbHost    string `yaml:"db_host"`
+	DbUser    string `yaml:"db_user"`
+	DbPwd     string `yaml:"db_pwd" secret:"true"`
+	DbName    string `yaml:"db_name"`
+	DbCharset string `yaml:"db_charset"`
 
-	DbHost    string
-	DbUser    string
-	DbPwd     string
-	DbName    string
-	DbCharset string
+	OfflineP2p   OfflineRetention `yaml:"offline_p2p"`   //单聊离线消息保留策略
+	OfflineGroup OfflineRetention `yaml:"offline_group"` //群聊离线消息保留策略
+
+	Conversation ConversationConfig `yaml:"conversation"` //会话列表和未读数
+	Ephemeral    EphemeralConfig    `yaml:"ephemeral"`    //有效期消息的清理
 }
 
 type PushConfig struct {
-	NsqdHost string
+	NsqdHost string `yaml:"nsqd_host"`
+	Badge    bool   `yaml:"badge"` //推送时带上未读总数作为角标，需要store开启conversation
+
+	Redis redisclient.Config `yaml:"redis"`
+}
+
+type ApiConfig struct {
+	HttpHost    string `yaml:"http_host"`
+	NsqdHost    string `yaml:"nsqd_host"`
+	ApiKeys     string `yaml:"api_keys" secret:"true" reload:"true"` //调用方的api key，逗号分隔，格式为 名称:key
+	MaxBodySize int64  `yaml:"max_body_size"`                        //请求body的最大字节数
+
+	Webhook WebhookConfig `yaml:"webhook"`
+}
 
-	RedisHost string
-	RedisPwd  string
-	RedisDb   int
+type MediaConfig struct {
+	HttpHost  string `yaml:"http_host"`
+	PublicUrl string `yaml:"public_url"`           //下载链接的地址前缀，例如 https://media.example.com，为空时使用请求的Host
+	Secret    string `yaml:"secret" secret:"true"` //上传凭证和下载链接的签名密钥，业务服务使用相同的密钥生成上传凭证
+	Storage   string `yaml:"storage"`              //存储后端，目前只支持local
+	LocalDir  string `yaml:"local_dir"`            //local存储的目录
+
+	MaxSize       int64         `yaml:"max_size"`       //单个文件的最大字节数
+	ChunkSize     int64         `yaml:"chunk_size"`     //每个分片的最大字节数
+	UrlTtl        time.Duration `yaml:"url_ttl"`        //下载链接的有效期
+	UploadTtl     time.Duration `yaml:"upload_ttl"`     //上传中断后保留的时间，超过后删除
+	OrphanTtl     time.Duration `yaml:"orphan_ttl"`     //上传完成后没有被消息引用的保留时间，超过后删除
+	CleanInterval time.Duration `yaml:"clean_interval"` //清理的间隔
+
+	Redis redisclient.Config `yaml:"redis"`
 }
 
+//默认配置不包含任何密码，密码通过配置文件或者环境变量设置
 func NewCometConfig() *CometConfig {
 	return &CometConfig{
-		TcpHost:   ":12000",
-		NsqdHost:  ":4150",
-		RedisHost: "127.0.0.1:6379",
-		RedisPwd:  "123456",
-		RedisDb:   1,
+		TcpHost:           ":12000",
+		NsqdHost:          ":4150",
+		WriteFlushSize:    16 * 1024,
+		WriteFlushLatency: 2 * time.Millisecond,
+		EventLoop:         false,
+		EventLoopPollers:  4,
+		EventLoopWorkers:  64,
+		IdleTimeout:       3 * time.Minute,
+		CompressThreshold: 1024,
+		Encrypt:           true,
+		Tls:               NewTlsConfig(),
+		ResumeTtl:         2 * time.Minute,
+		Redis:             *redisclient.NewConfig("127.0.0.1:6379", "", 1),
+		Trace:             NewTraceConfig(),
 	}
 }
 
 func NewDispatchConfig() *DispatchConfig {
 	return &DispatchConfig{
-		WorkerId:  1,
-		NsqdHost:  ":4150",
-		RedisHost: "127.0.0.1:6379",
-		RedisPwd:  "123456",
-		RedisDb:   1,
+		WorkerId:    -1,
+		WorkerIdTtl: 30 * time.Second,
+		NsqdHost:    ":4150",
+		Redis:       *redisclient.NewConfig("127.0.0.1:6379", "", 1),
+		Trace:       NewTraceConfig(),
+		Filter:      NewFilterConfig(),
+		Relation:    NewRelationConfig(),
 	}
 }
 
 func NewStoreConfig() *StoreConfig {
 	return &StoreConfig{
 		NsqdHost:  ":4150",
-		RedisHost: "127.0.0.1:6379",
-		RedisPwd:  "123456",
-		RedisDb:   1,
+		Redis:     *redisclient.NewConfig("127.0.0.1:6379", "", 1),
+		Trace:     NewTraceConfig(),
 		DbHost:    "127.0.0.1:3306",
 		DbUser:    "root",
-		DbPwd:     "1160616612",
 		DbName:    "im",
 		DbCharset: "utf8mb4",
+		OfflineP2p: OfflineRetention{
+			MaxCount: 200,
+			MaxAge:   7 * 24 * time.Hour,
+			Keep:     OFFLINE_KEEP_NEWEST,
+		},
+		OfflineGroup: OfflineRetention{
+			MaxCount: 500,
+			MaxAge:   7 * 24 * time.Hour,
+			Keep:     OFFLINE_KEEP_NEWEST,
+		},
+		Conversation: NewConversationConfig(),
+		Ephemeral:    NewEphemeralConfig(),
+	}
+}
+
+func NewApiConfig() *ApiConfig {
+	return &ApiConfig{
+		HttpHost:    ":12080",
+		NsqdHost:    ":4150",
+		MaxBodySize: 64 * 1024,
+		Webhook:     NewWebhookConfig(),
+	}
+}
+
+func NewMediaConfig() *MediaConfig {
+	return &MediaConfig{
+		HttpHost:      ":12090",
+		Storage:       MEDIA_STORAGE_LOCAL,
+		LocalDir:      "./data/media",
+		MaxSize:       100 * 1024 * 1024,
+		ChunkSize:     512 * 1024,
+		UrlTtl:        time.Hour,
+		UploadTtl:     24 * time.Hour,
+		OrphanTtl:     24 * time.Hour,
+		CleanInterval: 10 * time.Minute,
+		Redis:         *redisclient.NewConfig("127.0.0.1:6379", "", 1),
 	}
 }
 
 func NewPushConfig() *PushConfig {
 	return &PushConfig{
-		NsqdHost:  ":4150",
-		RedisHost: "127.0.0.1:6379",
-		RedisPwd:  "123456",
-		RedisDb:   1,
+		NsqdHost: ":4150",
+		Redis:    *redisclient.NewConfig("127.0.0.1:6379", "", 1),
+	}
+}
+
+func (c *CometConfig) Validate() error {
+	if c.TcpHost == "" && c.Tls.Host == "" {
+		return errors.New("comet config: tcp_host or tls_host is required")
+	}
+	if err := c.Tls.Validate(); err != nil {
+		return fmt.Errorf("comet config: %s", err.Error())
+	}
+	if c.WriteFlushSize <= 0 {
+		return fmt.Errorf("comet config: write_flush_size must be positive, got %d", c.WriteFlushSize)
+	}
+	if c.WriteFlushLatency < 0 {
+		return fmt.Errorf("comet config: write_flush_latency must not be negative, got %v", c.WriteFlushLatency)
+	}
+	if c.EventLoop && (c.EventLoopPollers <= 0 || c.EventLoopWorkers <= 0) {
+		return errors.New("comet config: event_loop_pollers and event_loop_workers must be positive")
+	}
+	if c.CompressThreshold < 0 {
+		return fmt.Errorf("comet config: compress_threshold must not be negative, got %d", c.CompressThreshold)
+	}
+	if c.EncryptSignKey != "" {
+		if _, err := ParseSignKey(c.EncryptSignKey); err != nil {
+			return fmt.Errorf("comet config: encrypt_sign_key: %s", err.Error())
+		}
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("comet config: idle_timeout must not be negative, got %v", c.IdleTimeout)
+	}
+	if c.ResumeTtl < 0 {
+		return fmt.Errorf("comet config: resume_ttl must not be negative, got %v", c.ResumeTtl)
+	}
+	if err := validateTrace("comet", &c.Trace); err != nil {
+		return err
+	}
+	return validateRedis("comet", &c.Redis)
+}
+
+func (c *DispatchConfig) Validate() error {
+	if c.WorkerId < -1 || c.WorkerId >= MAX_WORKER_ID {
+		return fmt.Errorf("dispatch config: worker_id must be -1 (auto) or in [0, %d), got %d", MAX_WORKER_ID, c.WorkerId)
+	}
+	if c.WorkerId == -1 && c.WorkerIdTtl < 3*time.Second {
+		return fmt.Errorf("dispatch config: worker_id_ttl must be at least 3s, got %v", c.WorkerIdTtl)
+	}
+	if c.NsqdHost == "" {
+		return errors.New("dispatch config: nsqd_host is required")
+	}
+	if err := validateTrace("dispatch", &c.Trace); err != nil {
+		return err
+	}
+	if err := c.Filter.Validate(); err != nil {
+		return fmt.Errorf("dispatch config: %s", err.Error())
+	}
+	if err := c.Relation.Validate(); err != nil {
+		return fmt.Errorf("dispatch config: %s", err.Error())
+	}
+	return validateRedis("dispatch", &c.Redis)
+}
+
+func (c *StoreConfig) Validate() error {
+	if c.NsqdHost == "" {
+		return errors.New("store config: nsqd_host is required")
+	}
+	if c.DbHost == "" || c.DbUser == "" || c.DbName == "" {
+		return errors.New("store config: db_host, db_user and db_name are required")
+	}
+	if err := c.OfflineP2p.Validate(); err != nil {
+		return fmt.Errorf("store config: offline_p2p %s", err.Error())
+	}
+	if err := c.OfflineGroup.Validate(); err != nil {
+		return fmt.Errorf("store config: offline_group %s", err.Error())
+	}
+	if err := c.Conversation.Validate(); err != nil {
+		return fmt.Errorf("store config: %s", err.Error())
+	}
+	if err := c.Ephemeral.Validate(); err != nil {
+		return fmt.Errorf("store config: %s", err.Error())
+	}
+	if err := validateTrace("store", &c.Trace); err != nil {
+		return err
+	}
+	return validateRedis("store", &c.Redis)
+}
+
+func (c *PushConfig) Validate() error {
+	if c.NsqdHost == "" {
+		return errors.New("push config: nsqd_host is required")
+	}
+	return validateRedis("push", &c.Redis)
+}
+
+func (c *ApiConfig) Validate() error {
+	if c.HttpHost == "" {
+		return errors.New("api config: http_host is required")
+	}
+	if c.NsqdHost == "" {
+		return errors.New("api config: nsqd_host is required")
+	}
+	if _, err := parseApiKeys(c.ApiKeys); err != nil {
+		return fmt.Errorf("api config: %s", err.Error())
+	}
+	if c.MaxBodySize <= 0 {
+		return fmt.Errorf("api config: max_body_size must be positive, got %d", c.MaxBodySize)
+	}
+	if err := c.Webhook.Validate(); err != nil {
+		return fmt.Errorf("api config: %s", err.Error())
+	}
+	return nil
+}
+
+func (c *MediaConfig) Validate() error {
+	if c.HttpHost == "" {
+		return errors.New("media config: http_host is required")
+	}
+	if c.Secret == "" {
+		return errors.New("media config: secret is required")
+	}
+	switch c.Storage {
+	case MEDIA_STORAGE_LOCAL:
+		if c.LocalDir == "" {
+			return errors.New("media config: local_dir is required for local storage")
+		}
+	default:
+		return fmt.Errorf("media config: unknown storage %q", c.Storage)
+	}
+	if c.MaxSize <= 0 || c.ChunkSize <= 0 {
+		return errors.New("media config: max_size and chunk_size must be positive")
+	}
+	if c.UrlTtl <= 0 || c.UploadTtl <= 0 || c.OrphanTtl <= 0 || c.CleanInterval <= 0 {
+		return errors.New("media config: url_ttl, upload_ttl, orphan_ttl and clean_interval must be positive")
+	}
+	return validateRedis("media", &c.Redis)
+}
+
+func validateRedis(role string, config *redisclient.Config) error {
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("%s config: %s", role, err.Error())
+	}
+	return nil
+}
+
+func validateTrace(role string, config *TraceConfig) error {
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("%s config: %s", role, err.Error())
+	}
+	return nil
+}
+
+//配置加载器，记录配置文件和命令行参数，SIGHUP时按相同的来源重新加载
+type ConfigLoader struct {
+	role     string
+	defaults func() interface{}
+	path     string
+	flags    map[string]string //命令行设置过的参数
+}
+
+func NewConfigLoader(role string, defaults func() interface{}) *ConfigLoader {
+	return &ConfigLoader{
+		role:     role,
+		defaults: defaults,
+		flags:    make(map[string]string),
+	}
+}
+
+//解析命令行参数并加载配置，-config指定yaml配置文件
+func (l *ConfigLoader) Load(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet(l.role, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(CONFIG_ENV_PREFIX+"CONFIG"), "yaml config file")
+
+	values := make(map[string]*string)
+	for _, field := range configFields(l.defaults()) {
+		values[field.name] = fs.String(field.name, "", fmt.Sprintf("override %s, env %s", field.name, field.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	l.path = *path
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := values[f.Name]; ok {
+			l.flags[f.Name] = *v
+		}
+	})
+
+	return l.Reload()
+}
+
+//按默认值、配置文件、环境变量、命令行参数的顺序重新生成配置
+func (l *ConfigLoader) Reload() (interface{}, error) {
+	config := l.defaults()
+
+	if l.path != "" {
+		data, err := ioutil.ReadFile(l.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s config: read %s error: %s", l.role, l.path, err.Error())
+		}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("%s config: parse %s error: %s", l.role, l.path, err.Error())
+		}
+	}
+
+	for _, field := range configFields(config) {
+		if v, ok := os.LookupEnv(field.env); ok {
+			if err := field.set(v); err != nil {
+				return nil, fmt.Errorf("%s config: env %s: %s", l.role, field.env, err.Error())
+			}
+		}
+		if v, ok := l.flags[field.name]; ok {
+			if err := field.set(v); err != nil {
+				return nil, fmt.Errorf("%s config: flag -%s: %s", l.role, field.name, err.Error())
+			}
+		}
+	}
+
+	if v, ok := config.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+func LoadCometConfig(args []string) (*CometConfig, *ConfigLoader, error) {
+	l := NewConfigLoader("comet", func() interface{} { return NewCometConfig() })
+	c, err := l.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*CometConfig), l, nil
+}
+
+func LoadDispatchConfig(args []string) (*DispatchConfig, *ConfigLoader, error) {
+	l := NewConfigLoader("dispatch", func() interface{} { return NewDispatchConfig() })
+	c, err := l.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*DispatchConfig), l, nil
+}
+
+func LoadStoreConfig(args []string) (*StoreConfig, *ConfigLoader, error) {
+	l := NewConfigLoader("store", func() interface{} { return NewStoreConfig() })
+	c, err := l.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*StoreConfig), l, nil
+}
+
+func LoadPushConfig(args []string) (*PushConfig, *ConfigLoader, error) {
+	l := NewConfigLoader("push", func() interface{} { return NewPushConfig() })
+	c, err := l.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*PushConfig), l, nil
+}
+
+func LoadMediaConfig(args []string) (*MediaConfig, *ConfigLoader, error) {
+	l := NewConfigLoader("media", func() interface{} { return NewMediaConfig() })
+	c, err := l.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*MediaConfig), l, nil
+}
+
+func LoadApiConfig(args []string) (*ApiConfig, *ConfigLoader, error) {
+	l := NewConfigLoader("api", func() interface{} { return NewApiConfig() })
+	c, err := l.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*ApiConfig), l, nil
+}
+
+//输出配置，secret字段用******代替
+func ConfigString(config interface{}) string {
+	parts := []string{}
+	for _, field := range configFields(config) {
+		v := field.value.Interface()
+		if field.secret && field.value.String() != "" {
+			v = CONFIG_SECRET
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", field.name, v))
+	}
+	return strings.Join(parts, " ")
+}
+
+//列出和old相比发生变化的字段，返回不能热加载的字段名
+func ConfigChanges(old interface{}, new interface{}) (changed []string, unsafe []string) {
+	oldFields := configFields(old)
+	newFields := configFields(new)
+	for i, field := range newFields {
+		if reflect.DeepEqual(field.value.Interface(), oldFields[i].value.Interface()) {
+			continue
+		}
+		changed = append(changed, field.name)
+		if !field.reload {
+			unsafe = append(unsafe, field.name)
+		}
+	}
+	return changed, unsafe
+}
+
+//把new中可以热加载的字段复制到config，其他字段保持不变
+func applyReloadable(config interface{}, new interface{}) {
+	newFields := configFields(new)
+	for i, field := range configFields(config) {
+		if field.reload {
+			field.value.Set(newFields[i].value)
+		}
+	}
+}
+
+//收到SIGHUP时重新加载配置，一直阻塞，在单独的goroutine中调用
+//运行中的配置只更新可以热加载的字段，每次生成新的配置传给reload，config是启动时的配置，不会修改
+//不能热加载的字段一直和启动时的配置比较，修改后每次都提示需要重启
+func HandleReload(loader *ConfigLoader, config interface{}, reload func(config interface{})) {
+	current := config
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		nc, err := loader.Reload()
+		if err != nil {
+			fmt.Printf("reload config error: %s\n", err.Error())
+			continue
+		}
+		_, unsafe := ConfigChanges(config, nc)
+		if len(unsafe) > 0 {
+			fmt.Printf("reload config: %v changed, restart required to apply\n", unsafe)
+		}
+
+		next := reflect.New(reflect.TypeOf(current).Elem())
+		next.Elem().Set(reflect.ValueOf(current).Elem())
+		applyReloadable(next.Interface(), nc)
+		changed, _ := ConfigChanges(current, next.Interface())
+		current = next.Interface()
+		reload(current)
+		fmt.Printf("reload config: %v changed\n", changed)
+	}
+}
+
+type configField struct {
+	name   string
+	env    string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+func configFields(config interface{}) []configField {
+	return structFields(reflect.ValueOf(config).Elem(), "")
+}
+
+func structFields(v reflect.Value, prefix string) []configField {
+	t := v.Type()
+
+	fields := []configField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		name = prefix + name
+
+		if f.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(v.Field(i), name+"_")...)
+			continue
+		}
+
+		fields = append(fields, configField{
+			name:   name,
+			env:    CONFIG_ENV_PREFIX + strings.ToUpper(name),
+			secret: f.Tag.Get("secret") == "true",
+			reload: f.Tag.Get("reload") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+//从字符串设置字段值，错误信息不包含字段值，避免泄露密码
+func (field configField) set(s string) error {
+	v := field.value
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.New("invalid duration")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("invalid integer")
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("invalid bool")
+		}
+		v.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("invalid float")
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
 	}
+	return nil
 }
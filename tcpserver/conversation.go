@@ -0,0 +1,300 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//会话列表和未读数
+//store保存消息后更新接收者(单聊还有发送者)的会话索引：最后一条消息摘要和未读数，客户端通过comet同步和上报已读
+//会话索引按最后一条消息的时间排序，未读数按会话保存，total字段为所有会话的未读总数，push作为角标
+//每个会话记录最后一条消息的mid，重试或者乱序到达的更早的消息不会重复计数
+//群消息中被@时单独记录最后一条@消息的mid，上报已读到这条消息之后清除
+//key使用{uid}作为hash tag，集群模式下同一个用户的key在同一个slot
+var (
+	KEY_PREFIX_CONV_INDEX  = "conv#index#"  //conv#index#{uid}，sorted set，member为会话标识 mt#cid，score为最后一条消息的时间(ms)
+	KEY_PREFIX_CONV_LAST   = "conv#last#"   //conv#last#{uid}，hash，会话标识 -> 最后一条消息摘要(json)
+	KEY_PREFIX_CONV_UNREAD = "conv#unread#" //conv#unread#{uid}，hash，会话标识 -> 未读数，会话标识#mid -> 最后一条消息mid，会话标识#at -> 最后一条@自己的消息mid，total -> 未读总数
+
+	CONV_PREVIEW_RUNES    = 50  //文本消息摘要的最大字符数
+	CONV_SYNC_LIMIT       = 20  //同步会话列表没有指定数量时返回的条数
+	CONV_SYNC_MAX_LIMIT   = 100 //同步会话列表一次最多返回的条数
+	CONV_TEXT_TYPE_PREFIX = "text/"
+)
+
+type ConversationConfig struct {
+	Enable   bool `yaml:"enable"`
+	MaxCount int  `yaml:"max_count"` //每个用户最多保留的会话数，超出时删除最久没有消息的会话，0表示不限制
+}
+
+func NewConversationConfig() ConversationConfig {
+	return ConversationConfig{
+		Enable:   false,
+		MaxCount: 1000,
+	}
+}
+
+func (c *ConversationConfig) Validate() error {
+	if c.MaxCount < 0 {
+		return fmt.Errorf("conversation max_count must not be negative, got %d", c.MaxCount)
+	}
+	return nil
+}
+
+//会话列表中的一个会话
+type Conversation struct {
+	Mt          int32  `json:"mt"`           //会话类型
+	Cid         int64  `json:"cid"`          //会话id，单聊为对方uid，群聊为群id
+	Mid         int64  `json:"mid"`          //最后一条消息id
+	From        int64  `json:"from"`         //最后一条消息的发送者，群消息为0
+	Ct          int64  `json:"ct"`           //最后一条消息的时间 ms
+	ContentType string `json:"content_type"` //最后一条消息的内容类型
+	Preview     string `json:"preview"`      //文本消息的摘要，其他类型为空，客户端按内容类型显示
+	Unread      int64  `json:"unread"`
+	Mentioned   bool   `json:"mentioned"` //有未读的@自己的消息
+}
+
+//同步会话列表，MESSAGE_TYPE_CONV_SYNC的payload
+//按最后一条消息时间倒序返回，Before翻页，Since增量同步，都为0时返回最新的会话
+type ConvSync struct {
+	Before int64 `json:"before"` //只返回最后一条消息早于这个时间的会话，上一页最后一个会话的Ct
+	Since  int64 `json:"since"`  //只返回最后一条消息晚于这个时间的会话，上次同步的第一个会话的Ct
+	Limit  int   `json:"limit"`
+}
+
+//已读回执，MESSAGE_TYPE_CONV_READ的payload，Mid为客户端已经看到的最后一条消息
+//会话在Mid之后又有新消息时不清除未读数
+type ConvRead struct {
+	Mt  int32 `json:"mt"`
+	Cid int64 `json:"cid"`
+	Mid int64 `json:"mid"`
+}
+
+//MESSAGE_TYPE_CONV_LIST的payload，回复同步和已读回执，回复已读回执时只有未读总数
+type ConvList struct {
+	Convs  []*Conversation `json:"convs"`
+	Unread int64           `json:"unread"` //所有会话的未读总数
+	More   bool            `json:"more"`   //还有更早的会话
+}
+
+var (
+	//mid超过lua number的精度，按字符串比较
+	convGtLua = `
+local function gt(a, b)
+	if #a ~= #b then
+		return #a > #b
+	end
+	return a > b
+end
+`
+
+	//KEYS: index last unread
+	//ARGV: conv ct mid summary incr max_count mentioned
+	//incr为0表示自己发送的消息，同时清除这个会话的未读数和@标记
+	updateConvScript = redis.NewScript(3, convGtLua+`
+local last = redis.call('HGET', KEYS[3], ARGV[1] .. '#mid')
+if last and not gt(ARGV[3], last) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[4])
+redis.call('HSET', KEYS[3], ARGV[1] .. '#mid', ARGV[3])
+if ARGV[5] == '1' then
+	redis.call('HINCRBY', KEYS[3], ARGV[1], 1)
+	redis.call('HINCRBY', KEYS[3], 'total', 1)
+	if ARGV[7] == '1' then
+		redis.call('HSET', KEYS[3], ARGV[1] .. '#at', ARGV[3])
+	end
+else
+	redis.call('HDEL', KEYS[3], ARGV[1] .. '#at')
+	local unread = tonumber(redis.call('HGET', KEYS[3], ARGV[1]) or 0)
+	if unread > 0 then
+		redis.call('HINCRBY', KEYS[3], 'total', -unread)
+		redis.call('HDEL', KEYS[3], ARGV[1])
+	end
+end
+local max = tonumber(ARGV[6])
+if max > 0 then
+	local n = redis.call('ZCARD', KEYS[1])
+	if n > max then
+		local old = redis.call('ZRANGE', KEYS[1], 0, n - max - 1)
+		for _, c in ipairs(old) do
+			local unread = tonumber(redis.call('HGET', KEYS[3], c) or 0)
+			if unread > 0 then
+				redis.call('HINCRBY', KEYS[3], 'total', -unread)
+			end
+			redis.call('HDEL', KEYS[3], c, c .. '#mid', c .. '#at')
+			redis.call('HDEL', KEYS[2], c)
+		end
+		redis.call('ZREMRANGEBYRANK', KEYS[1], 0, n - max - 1)
+	end
+end
+return 1`)
+
+	//KEYS: unread
+	//ARGV: conv mid
+	readConvScript = redis.NewScript(1, convGtLua+`
+local last = redis.call('HGET', KEYS[1], ARGV[1] .. '#mid')
+if not (last and gt(last, ARGV[2])) then
+	local unread = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or 0)
+	if unread > 0 then
+		redis.call('HINCRBY', KEYS[1], 'total', -unread)
+		redis.call('HDEL', KEYS[1], ARGV[1])
+	end
+end
+local at = redis.call('HGET', KEYS[1], ARGV[1] .. '#at')
+if at and not gt(at, ARGV[2]) then
+	redis.call('HDEL', KEYS[1], ARGV[1] .. '#at')
+end
+return redis.call('HGET', KEYS[1], 'total') or '0'`)
+
+	//KEYS: index last unread
+	//ARGV: max min limit
+	//返回 total, 摘要1, 未读数1, @标记1, 摘要2, 未读数2, @标记2 ...
+	listConvScript = redis.NewScript(3, `
+local convs = redis.call('ZREVRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[2], 'LIMIT', 0, ARGV[3])
+local res = {redis.call('HGET', KEYS[3], 'total') or '0'}
+for _, c in ipairs(convs) do
+	res[#res + 1] = redis.call('HGET', KEYS[2], c) or ''
+	res[#res + 1] = redis.call('HGET', KEYS[3], c) or '0'
+	res[#res + 1] = tostring(redis.call('HEXISTS', KEYS[3], c .. '#at'))
+end
+return res`)
+
+	//KEYS: unread
+	//ARGV: conv mid
+	//返回 total, mid是否还没有计入未读数
+	badgeScript = redis.NewScript(1, convGtLua+`
+local last = redis.call('HGET', KEYS[1], ARGV[1] .. '#mid')
+local pending = 0
+if not last or gt(ARGV[2], last) then
+	pending = 1
+end
+return {tonumber(redis.call('HGET', KEYS[1], 'total') or 0), pending}`)
+)
+
+func convIndexKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_CONV_INDEX, uid)
+}
+
+func convLastKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_CONV_LAST, uid)
+}
+
+func convUnreadKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_CONV_UNREAD, uid)
+}
+
+//消息摘要，文本消息截取前CONV_PREVIEW_RUNES个字符
+func convSummary(p *Packet, mt int32, cid int64, from int64) *Conversation {
+	c := &Conversation{
+		Mt:          mt,
+		Cid:         cid,
+		Mid:         p.Mid,
+		From:        from,
+		Ct:          p.Ct,
+		ContentType: p.ContentType(),
+	}
+	//有效期和阅后即焚的消息不保存摘要，避免内容在消息删除后还留在会话列表中
+	if p.IsEphemeral() {
+		return c
+	}
+	if (c.ContentType == "" || strings.HasPrefix(c.ContentType, CONV_TEXT_TYPE_PREFIX)) && utf8.Valid(p.Pl) {
+		text := []rune(string(p.Pl))
+		if len(text) > CONV_PREVIEW_RUNES {
+			text = text[:CONV_PREVIEW_RUNES]
+		}
+		c.Preview = string(text)
+	}
+	return c
+}
+
+//更新一条消息涉及的会话，p.Rid为接收者，p.Sid为会话id(单聊对方uid，群id)
+//单聊同时更新发送者的会话，发送者的会话不增加未读数
+func UpdateConversation(conn redis.Conn, p *Packet, maxCount int) error {
+	var from int64
+	if p.Mt == MESSAGE_TYPE_P2P {
+		from = p.Sid
+	}
+	if err := updateConversation(conn, p.Rid, convSummary(p, p.Mt, p.Sid, from), true, p.IsMentioned(), maxCount); err != nil {
+		return err
+	}
+	if p.Mt == MESSAGE_TYPE_P2P && p.Sid != p.Rid {
+		return updateConversation(conn, p.Sid, convSummary(p, p.Mt, p.Rid, from), false, false, maxCount)
+	}
+	return nil
+}
+
+func updateConversation(conn redis.Conn, uid int64, c *Conversation, incr bool, mentioned bool, maxCount int) error {
+	data, _ := json.Marshal(c)
+	n, at := 0, 0
+	if incr {
+		n = 1
+	}
+	if mentioned {
+		at = 1
+	}
+	_, err := updateConvScript.Do(conn, convIndexKey(uid), convLastKey(uid), convUnreadKey(uid),
+		offlineConv(c.Mt, c.Cid), c.Ct, c.Mid, data, n, maxCount, at)
+	return err
+}
+
+//上报已读，返回未读总数
+func ReadConversation(conn redis.Conn, uid int64, r *ConvRead) (int64, error) {
+	return redis.Int64(readConvScript.Do(conn, convUnreadKey(uid), offlineConv(r.Mt, r.Cid), r.Mid))
+}
+
+//按ConvSync查询会话列表
+func ListConversations(conn redis.Conn, uid int64, s *ConvSync) (*ConvList, error) {
+	limit := s.Limit
+	if limit <= 0 {
+		limit = CONV_SYNC_LIMIT
+	}
+	if limit > CONV_SYNC_MAX_LIMIT {
+		limit = CONV_SYNC_MAX_LIMIT
+	}
+	max, min := "+inf", "-inf"
+	if s.Before > 0 {
+		max = "(" + strconv.FormatInt(s.Before, 10)
+	}
+	if s.Since > 0 {
+		min = "(" + strconv.FormatInt(s.Since, 10)
+	}
+
+	//多取一条判断是否还有更早的会话
+	values, err := redis.Strings(listConvScript.Do(conn, convIndexKey(uid), convLastKey(uid), convUnreadKey(uid), max, min, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	list := &ConvList{Convs: []*Conversation{}}
+	list.Unread, _ = strconv.ParseInt(values[0], 10, 64)
+	for i := 1; i+2 < len(values); i += 3 {
+		if len(list.Convs) == limit {
+			list.More = true
+			break
+		}
+		c := &Conversation{}
+		if err := json.Unmarshal([]byte(values[i]), c); err != nil {
+			continue
+		}
+		c.Unread, _ = strconv.ParseInt(values[i+1], 10, 64)
+		c.Mentioned = values[i+2] == "1"
+		list.Convs = append(list.Convs, c)
+	}
+	return list, nil
+}
+
+//推送角标，p为正在推送的离线消息，store还没有计入未读数时加上这一条
+func ConversationBadge(conn redis.Conn, p *Packet) (int64, error) {
+	values, err := Int64s(badgeScript.Do(conn, convUnreadKey(p.Rid), offlineConv(p.Mt, p.Sid), p.Mid))
+	if err != nil {
+		return 0, err
+	}
+	return values[0] + values[1], nil
+}
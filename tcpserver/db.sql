@@ -5,9 +5,37 @@ CREATE TABLE `message` (
   `mid` bigint(20) NOT NULL DEFAULT '0' COMMENT '消息id',
   `sid` bigint(20) NOT NULL DEFAULT '0' COMMENT '发送者',
   `rid` bigint(20) NOT NULL DEFAULT '0' COMMENT '接收者',
-  `ext` text NOT NULL COMMENT '扩展属性',
+  `ext` blob NOT NULL COMMENT '扩展属性，二进制TLV编码',
   `pl` text NOT NULL COMMENT 'payload内容',
   `ct` bigint(20) NOT NULL DEFAULT '0' COMMENT '创建时间，ms',
+  `expire_at` bigint(20) NOT NULL DEFAULT '0' COMMENT '过期时间，ms，0表示不过期',
   PRIMARY KEY (`id`),
-  KEY `idx_rid_mid` (`rid`,`mid`)
+  UNIQUE KEY `uk_mid` (`mid`),
+  KEY `idx_rid_mid` (`rid`,`mid`),
+  KEY `idx_expire_at` (`expire_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- 已有的表增加mid唯一索引，消息重试写入时去重
+-- ALTER TABLE `message` ADD UNIQUE KEY `uk_mid` (`mid`);
+
+-- ext改为二进制编码后不能使用text保存
+-- ALTER TABLE `message` MODIFY `ext` blob NOT NULL COMMENT '扩展属性，二进制TLV编码';
+
+-- 有效期消息，store后台按过期时间清理
+-- ALTER TABLE `message` ADD `expire_at` bigint(20) NOT NULL DEFAULT '0' COMMENT '过期时间，ms，0表示不过期', ADD KEY `idx_expire_at` (`expire_at`);
+
+CREATE TABLE `filter_audit` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `mt` int(11) NOT NULL DEFAULT '0' COMMENT '消息类型',
+  `client_mid` bigint(20) NOT NULL DEFAULT '0' COMMENT '客户端消息序号',
+  `sid` bigint(20) NOT NULL DEFAULT '0' COMMENT '发送者',
+  `rid` bigint(20) NOT NULL DEFAULT '0' COMMENT '接收者',
+  `action` varchar(16) NOT NULL DEFAULT '' COMMENT '处理方式，mask、reject、review',
+  `hits` text NOT NULL COMMENT '命中的规则，json',
+  `pl` blob NOT NULL COMMENT '过滤前的payload',
+  `status` tinyint(4) NOT NULL DEFAULT '0' COMMENT '0 待审核，1 已处理',
+  `ct` bigint(20) NOT NULL DEFAULT '0' COMMENT '消息时间，ms',
+  PRIMARY KEY (`id`),
+  KEY `idx_status_ct` (`status`,`ct`),
+  KEY `idx_sid_ct` (`sid`,`ct`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
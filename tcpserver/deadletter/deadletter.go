@@ -0,0 +1,185 @@
+package main
+
+//死信查看和重放工具
+//inspect: 输出死信内容，死信重新放回死信topic
+//replay:  把死信中的原始消息重新发布到原来的topic，可以用-topic只重放指定topic的死信
+//discard: 丢弃死信，可以用-topic只丢弃指定topic的死信
+//例如: deadletter -nsqd_host :4150 -mode replay -topic message_topic_logic -limit 100
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/tcpserver"
+	"os"
+	"sync"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+var (
+	MODE_INSPECT = "inspect"
+	MODE_REPLAY  = "replay"
+	MODE_DISCARD = "discard"
+)
+
+type tool struct {
+	mode     string
+	topic    string
+	limit    int
+	producer *nsq.Producer
+	proto    tcpserver.Protocol
+
+	mutex sync.Mutex
+	seen  map[string]bool //已经处理过的死信，重新放回后再次读到说明已经遍历一遍
+	count int
+	done  chan bool
+	last  chan bool
+}
+
+func main() {
+	nsqdHost := flag.String("nsqd_host", ":4150", "nsqd address")
+	mode := flag.String("mode", MODE_INSPECT, "inspect, replay or discard")
+	topic := flag.String("topic", "", "only replay or discard dead letters from this topic, empty for all")
+	limit := flag.Int("limit", 100, "max dead letters to handle")
+	idle := flag.Duration("idle", 3*time.Second, "exit after no dead letter received for this duration")
+	flag.Parse()
+
+	if *mode != MODE_INSPECT && *mode != MODE_REPLAY && *mode != MODE_DISCARD {
+		fmt.Printf("unknown mode: %s\n", *mode)
+		os.Exit(1)
+	}
+
+	cfg := nsq.NewConfig()
+	cfg.MaxInFlight = 1
+	producer, err := nsq.NewProducer(*nsqdHost, cfg)
+	if err != nil {
+		fmt.Printf("nsq producer error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer producer.Stop()
+
+	consumer, err := nsq.NewConsumer(tcpserver.MESSAGE_TOPIC_DEAD_LETTER, tcpserver.MESSAGE_CHANNEL_DEAD_LETTER, cfg)
+	if err != nil {
+		fmt.Printf("nsq consumer error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	consumer.SetLogger(nil, nsq.LogLevelError)
+
+	t := &tool{
+		mode:     *mode,
+		topic:    *topic,
+		limit:    *limit,
+		producer: producer,
+		proto:    &tcpserver.CustomProto{},
+		seen:     make(map[string]bool),
+		done:     make(chan bool),
+		last:     make(chan bool, 1),
+	}
+	consumer.AddHandler(nsq.HandlerFunc(t.handle))
+
+	if err := consumer.ConnectToNSQD(*nsqdHost); err != nil {
+		fmt.Printf("nsq consumer ConnectToNSQD error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	timer := time.NewTimer(*idle)
+	defer timer.Stop()
+loop:
+	for {
+		select {
+		case <-t.done:
+			break loop
+		case <-t.last:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(*idle)
+		case <-timer.C:
+			break loop
+		}
+	}
+
+	consumer.Stop()
+	<-consumer.StopChan
+	fmt.Printf("%s %d dead letters\n", t.mode, t.count)
+}
+
+func (t *tool) handle(message *nsq.Message) error {
+	message.DisableAutoResponse()
+
+	select {
+	case t.last <- true:
+	default:
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var dl tcpserver.DeadLetter
+	if err := json.Unmarshal(message.Body, &dl); err != nil {
+		fmt.Printf("invalid dead letter: %s, %q\n", err.Error(), message.Body)
+		if t.mode != MODE_DISCARD {
+			t.producer.Publish(tcpserver.MESSAGE_TOPIC_DEAD_LETTER, message.Body)
+		}
+		message.Finish()
+		t.count++
+		if t.count >= t.limit {
+			t.stop()
+		}
+		return nil
+	}
+
+	if t.seen[dl.Id] || t.count >= t.limit {
+		//已经遍历过一遍或者达到数量上限，放回队列后退出
+		message.RequeueWithoutBackoff(0)
+		t.stop()
+		return nil
+	}
+	t.seen[dl.Id] = true
+
+	match := t.topic == "" || t.topic == dl.Topic
+	var err error
+	switch {
+	case t.mode == MODE_REPLAY && match:
+		err = t.producer.Publish(dl.Topic, dl.Body)
+	case t.mode == MODE_DISCARD && match:
+	default:
+		//inspect或者不匹配的死信放回死信topic
+		err = t.producer.Publish(tcpserver.MESSAGE_TOPIC_DEAD_LETTER, message.Body)
+	}
+	if err != nil {
+		fmt.Printf("publish error: %s\n", err.Error())
+		message.RequeueWithoutBackoff(0)
+		t.stop()
+		return nil
+	}
+	message.Finish()
+
+	if match || t.mode == MODE_INSPECT {
+		t.count++
+		t.print(&dl)
+	}
+	return nil
+}
+
+func (t *tool) print(dl *tcpserver.DeadLetter) {
+	ct := time.Unix(0, dl.Ct*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+	fmt.Printf("[%s] id=%s topic=%s channel=%s attempts=%d error=%s\n", ct, dl.Id, dl.Topic, dl.Channel, dl.Attempts, dl.Error)
+
+	p, err := t.proto.Unserialize(dl.Body)
+	if err != nil {
+		fmt.Printf("    body: %d bytes, %s\n", len(dl.Body), err.Error())
+		return
+	}
+	fmt.Printf("    packet: ver=%d mt=%d mid=%d sid=%d rid=%d ct=%d ext=%q pl=%q\n", p.Ver, p.Mt, p.Mid, p.Sid, p.Rid, p.Ct, p.Ext, p.Pl)
+}
+
+func (t *tool) stop() {
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+}
@@ -1,8 +1,11 @@
 package tcpserver
 
 import (
+	"encoding/json"
 	"fmt"
+	"go/redisclient"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -11,80 +14,298 @@ import (
 
 //消息逻辑处理层，存储消息，分发消息，离线消息发送到push
 type Dispatch struct {
-	iw      *goSnowFlake.IdWorker
+	iw      *goSnowFlake.IdWorker //租约丢失时为nil，停止生成消息id
+	iwMutex sync.RWMutex
 	sub     *Subscribe
-	outChan chan *Packet
 	quit    chan bool
-	pool    *redis.Pool
+	pool    *redisclient.Client
+	tracer  *Tracer
+
+	filters    *FilterChain //内容过滤，没有开启时为nil
+	wordFilter *WordFilter
+	linkFilter *LinkFilter
+
+	relations *relationChecker //单聊关系检查，没有开启时为nil
+	group     Group
+
+	lease     WorkerIdLease //自动分配workerId，静态配置时为nil
+	leaseTtl  time.Duration
+	leaseQuit chan bool
+	workerId  int64
 }
 
-//0 < workerId < 1024
+//0 <= workerId < 1024，配置为-1时从redis自动租用
 func NewDispatch(config *DispatchConfig) *Dispatch {
-	iw, err := goSnowFlake.NewIdWorker(config.WorkerId)
+	d := &Dispatch{
+		quit:      make(chan bool),
+		leaseQuit: make(chan bool),
+		pool:      NewRedisClient(&config.Redis),
+	}
+	d.tracer = NewTracer("dispatch", d.pool, &config.Trace)
+	d.group = &RedisGroup{pool: d.pool}
+
+	if config.Filter.Enable {
+		d.filters = NewFilterChain()
+		if config.Filter.WordFile != "" {
+			wf, err := NewWordFilter(&config.Filter)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			d.wordFilter = wf
+			d.filters.Add(wf)
+		}
+		if config.Filter.LinkAction != "" {
+			d.linkFilter = NewLinkFilter(&config.Filter)
+			d.filters.Add(d.linkFilter)
+		}
+	}
+
+	if config.Relation.Enable {
+		d.relations = newRelationChecker(NewRedisRelation(d.pool), &config.Relation)
+	}
+
+	workerId := config.WorkerId
+	if workerId < 0 {
+		//没有空闲workerId时直接退出，避免和其他节点生成重复的消息id
+		d.lease = NewRedisWorkerIdLease(d.pool, config.WorkerIdTtl)
+		d.leaseTtl = config.WorkerIdTtl
+		id, err := d.lease.Acquire()
+		if err != nil {
+			fmt.Printf("acquire worker id error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		workerId = id
+	}
+
+	iw, err := goSnowFlake.NewIdWorker(workerId)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	d.iw = iw
+	d.workerId = workerId
+	fmt.Printf("dispatch worker id: %d\n", workerId)
 
-	d := &Dispatch{
-		iw:      iw,
-		outChan: make(chan *Packet, 1024),
-		quit:    make(chan bool),
-		pool: &redis.Pool{
-			MaxIdle:     5,
-			IdleTimeout: 300 * time.Second,
-			// Other pool configuration not shown in this example.
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", config.RedisHost)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := c.Do("AUTH", config.RedisPwd); err != nil {
-					c.Close()
-					return nil, err
-				}
-				if _, err := c.Do("SELECT", config.RedisDb); err != nil {
-					c.Close()
-					return nil, err
-				}
-				return c, nil
-			},
-		},
-	}
-	d.sub = NewSubscribe(&CustomProto{}, config.NsqdHost, MESSAGE_TOPIC_LOGIC, MESSAGE_CHANNEL_LOGIC_IM, d.outChan)
+	if d.lease != nil {
+		go d.keepAlive()
+	}
+
+	//处理失败的消息由nsq重试，多次失败后进入死信
+	d.sub = NewSubscribeHandler(&CustomProto{}, config.NsqdHost, MESSAGE_TOPIC_LOGIC, MESSAGE_CHANNEL_LOGIC_IM, d.handle)
 
 	return d
 }
 
-func (d *Dispatch) Run() {
+//生成消息id，workerId租约丢失期间返回错误
+func (d *Dispatch) nextId() (int64, error) {
+	d.iwMutex.RLock()
+	defer d.iwMutex.RUnlock()
+
+	if d.iw == nil {
+		return 0, ErrWorkerIdLost
+	}
+	return d.iw.NextId()
+}
+
+//扩散前一次分配所有接收者的id，租约丢失时一条也不发布，整条消息重试
+func (d *Dispatch) nextIds(n int) ([]int64, error) {
+	d.iwMutex.RLock()
+	defer d.iwMutex.RUnlock()
+
+	if d.iw == nil {
+		return nil, ErrWorkerIdLost
+	}
+	ids := make([]int64, n)
+	for i := range ids {
+		id, err := d.iw.NextId()
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+//定期续约workerId，超过ttl的一半没有续约成功就停止生成id，然后重新申请
+func (d *Dispatch) keepAlive() {
+	ticker := time.NewTicker(d.leaseTtl / 3)
+	defer ticker.Stop()
+
+	lastRenew := time.Now()
 	for {
 		select {
-		case p := <-d.outChan:
-			d.handle(p)
-		case <-d.quit:
+		case <-d.leaseQuit:
 			return
+		case <-ticker.C:
+		}
+
+		//续约成功时租约从发出请求前开始算，偏保守
+		start := time.Now()
+		err := d.lease.KeepAlive(d.workerId)
+		if err == nil {
+			lastRenew = start
+			continue
+		}
+
+		fmt.Printf("keepalive worker id %d error: %s\n", d.workerId, err.Error())
+		if err != ErrWorkerIdLost && time.Now().Sub(lastRenew) < d.leaseTtl/2 {
+			//redis暂时不可用，租约还没有过期，至少留出一个tick的余量
+			continue
+		}
+
+		d.iwMutex.Lock()
+		d.iw = nil
+		d.iwMutex.Unlock()
+
+		if !d.reacquire() {
+			return
+		}
+		lastRenew = time.Now()
+	}
+}
+
+//重新申请workerId，成功前一直重试
+func (d *Dispatch) reacquire() bool {
+	for {
+		id, err := d.lease.Acquire()
+		if err == nil {
+			iw, err := goSnowFlake.NewIdWorker(id)
+			if err == nil {
+				d.iwMutex.Lock()
+				d.iw = iw
+				d.workerId = id
+				d.iwMutex.Unlock()
+				fmt.Printf("dispatch worker id reacquired: %d\n", id)
+				return true
+			}
+		}
+		fmt.Printf("reacquire worker id error: %v\n", err)
+
+		select {
+		case <-d.leaseQuit:
+			return false
+		case <-time.After(d.leaseTtl / 3):
 		}
 	}
 }
 
-//处理消息分发
-func (d *Dispatch) handle(p *Packet) {
+//消息在nsq的handler中处理，Run等待退出
+func (d *Dispatch) Run() {
+	<-d.quit
+}
+
+//处理消息分发，返回错误时消息重新入队
+func (d *Dispatch) handle(p *Packet) error {
 	p.Ct = (time.Now().UnixNano() / 1000000) //设置ms时间戳
+	//Mid会被替换为服务端消息id，客户端的序号保存在Ext，Ext中的其他字段原样转发
+	if p.ClientMid() == 0 {
+		p.SetClientMid(p.Mid)
+	}
+	//被@标记只由群消息扩散时设置
+	if p.IsMentioned() {
+		p.SetFlags(p.Flags() &^ EXT_FLAG_MENTIONED)
+	}
+
+	//路由之前过滤内容，审核记录写入失败时重试，避免漏记
+	if d.filters != nil {
+		v, err := d.filter(p)
+		if err != nil {
+			return err
+		}
+		if v.Action() == FILTER_ACTION_REJECT {
+			d.reject(p, REJECT_STATUS_FILTERED, ErrFilterRejected)
+			return nil
+		}
+	}
+	//媒体消息引用的文件必须已经上传完成，引用后不再作为没有引用的文件清理
+	if id := p.MediaId(); id != "" {
+		ok, err := d.referenceMedia(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			d.reject(p, REJECT_STATUS_MEDIA_INVALID, ErrMediaNotFound)
+			return nil
+		}
+	}
 	switch p.Mt {
 	case MESSAGE_TYPE_P2P:
 		//单聊
-		d.handleP2p(p)
+		return d.handleP2p(p)
 	case MESSAGE_TYPE_GROUP:
 		//群消息
-		d.handleGroup(p)
+		return d.handleGroup(p)
 	case MESSAGE_TYPE_ROOM:
 		//聊天室消息
-		d.handleRoom(p)
+		return d.handleRoom(p)
 	default:
-		fmt.Printf("unknown message type: %d\n", p.Mt)
+		return Permanent(fmt.Errorf("unknown message type: %d", p.Mt))
+	}
+}
+
+//执行过滤器，有命中时发布审核记录
+func (d *Dispatch) filter(p *Packet) (*FilterVerdict, error) {
+	original := p.Pl
+	v := d.filters.Run(p)
+	if len(v.Hits) == 0 {
+		return v, nil
+	}
+
+	audit := FilterAudit{
+		Mt:        p.Mt,
+		ClientMid: p.ClientMid(),
+		Sid:       p.Sid,
+		Rid:       p.Rid,
+		Action:    v.Action(),
+		Hits:      v.Hits,
+		Pl:        original,
+		Ct:        p.Ct,
+	}
+	data, _ := json.Marshal(audit)
+	if err := d.sub.PublishBody(MESSAGE_TOPIC_FILTER_AUDIT, data); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//通知发送者消息被拒绝和拒绝原因，发送者不在线时写入离线消息，上线后下发
+func (d *Dispatch) reject(p *Packet, status int64, reason error) {
+	packet := &Packet{
+		Ver: PROTO_VERSION,
+		Mt:  MESSAGE_TYPE_REJECT,
+		Mid: p.ClientMid(),
+		Ct:  p.Ct,
+		Sid: p.Rid,
+		Rid: p.Sid,
+		Pl:  buildResponseInfo(status, reason.Error()),
+	}
+	topic := MESSAGE_TOPIC_OFFLINE
+	if d.isOnline(p.Sid) {
+		topic = MESSAGE_TOPIC_DISPATCH
+	}
+	if err := d.sub.Publish(topic, packet); err != nil {
+		fmt.Printf("publish reject error: %s, sid=%d\n", err.Error(), p.Sid)
+	}
+}
+
+//SIGHUP重新加载过滤配置
+func (d *Dispatch) Reload(config *DispatchConfig) {
+	if d.wordFilter != nil {
+		d.wordFilter.Reload(&config.Filter)
+	}
+	if d.linkFilter != nil {
+		d.linkFilter.Reload(&config.Filter)
 	}
 }
 
+func (d *Dispatch) referenceMedia(id string) (bool, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+
+	return ReferenceMedia(conn, id)
+}
+
 func (d *Dispatch) isOnline(uid int64) bool {
 	conn := d.pool.Get()
 	defer conn.Close()
@@ -94,77 +315,133 @@ func (d *Dispatch) isOnline(uid int64) bool {
 	return b
 }
 
-func (d *Dispatch) handleP2p(p *Packet) {
-	if id, err := d.iw.NextId(); err != nil {
-		fmt.Println(err)
-		return
+//单聊关系检查拒绝的原因
+var relationRejects = map[error]int64{
+	ErrRelationBlocked:       REJECT_STATUS_BLOCKED,
+	ErrRelationFriendsOnly:   REJECT_STATUS_FRIENDS_ONLY,
+	ErrRelationStrangerLimit: REJECT_STATUS_STRANGER_LIMIT,
+}
+
+//workerId租约丢失、读取关系失败或者发布失败时返回错误，重试时重新生成消息id
+func (d *Dispatch) handleP2p(p *Packet) error {
+	start := time.Now()
+	if d.relations != nil {
+		if err := d.relations.check(p.Sid, p.Rid); err != nil {
+			status, ok := relationRejects[err]
+			if !ok {
+				return err
+			}
+			d.reject(p, status, err)
+			return nil
+		}
+	}
+	if id, err := d.nextId(); err != nil {
+		return err
 	} else {
 		p.Mid = id
 	}
 
+	topic := MESSAGE_TOPIC_OFFLINE
 	if d.isOnline(p.Rid) {
-		d.sub.Publish(MESSAGE_TOPIC_DISPATCH, p)
-	} else {
-		d.sub.Publish(MESSAGE_TOPIC_OFFLINE, p)
+		topic = MESSAGE_TOPIC_DISPATCH
 	}
+	err := d.sub.Publish(topic, p)
+	d.tracer.Record(p.TraceId(), SPAN_DISPATCH_ROUTE, p, start, err, "topic", topic)
+	return err
 }
 
-func (d *Dispatch) handleGroup(p *Packet) {
-	//获取群成员
-	members := []int64{}
-	for _, member := range members {
-		if member == p.Sid {
-			continue
-		}
+//扩散消息部分成员失败时不重试整条消息，避免其他成员收到重复消息
+func (d *Dispatch) publish(p *Packet) {
+	start := time.Now()
+	topic := MESSAGE_TOPIC_OFFLINE
+	if d.isOnline(p.Rid) {
+		topic = MESSAGE_TOPIC_DISPATCH
+	}
+	err := d.sub.Publish(topic, p)
+	if err != nil {
+		fmt.Printf("publish message error: %s, mid=%d rid=%d\n", err.Error(), p.Mid, p.Rid)
+	}
+	d.tracer.Record(p.TraceId(), SPAN_DISPATCH_ROUTE, p, start, err, "topic", topic)
+}
 
-		if id, err := d.iw.NextId(); err == nil {
-			packet := &Packet{
-				Ver: p.Ver,
-				Mt:  p.Mt,
-				Mid: id,
-				Sid: p.Rid,
-				Rid: member,
-				Ext: p.Ext,
-				Pl:  p.Pl,
-			}
+//群成员读取失败或者分配id失败时返回错误重试，这时还没有扩散
+func (d *Dispatch) handleGroup(p *Packet) error {
+	members, err := d.group.GetMembers(p.Rid)
+	if err != nil {
+		return err
+	}
 
-			if d.isOnline(packet.Rid) {
-				d.sub.Publish(MESSAGE_TOPIC_DISPATCH, packet)
-			} else {
-				d.sub.Publish(MESSAGE_TOPIC_OFFLINE, packet)
-			}
+	//@列表只保留群成员，被@的接收者单独标记，推送时不受免打扰限制
+	mentions, all := filterMentions(p.Mentions(), members)
+	p.SetMentions(mentions)
+	mentioned := make(map[int64]bool, len(mentions))
+	for _, uid := range mentions {
+		mentioned[uid] = true
+	}
+
+	members = fanOutMembers(members, p.Sid)
+	ids, err := d.nextIds(len(members))
+	if err != nil {
+		return err
+	}
+	for i, member := range members {
+		packet := fanOutPacket(p, ids[i], member)
+		if all || mentioned[member] {
+			packet.SetFlags(packet.Flags() | EXT_FLAG_MENTIONED)
 		}
+		d.publish(packet)
 	}
+	return nil
 }
 
-func (d *Dispatch) handleRoom(p *Packet) {
+func (d *Dispatch) handleRoom(p *Packet) error {
 	//获取聊天室成员
-	members := []int64{}
+	members := fanOutMembers([]int64{}, p.Sid)
+	ids, err := d.nextIds(len(members))
+	if err != nil {
+		return err
+	}
+	for i, member := range members {
+		d.publish(fanOutPacket(p, ids[i], member))
+	}
+	return nil
+}
+
+//去掉发送者自己
+func fanOutMembers(members []int64, sid int64) []int64 {
+	rids := make([]int64, 0, len(members))
 	for _, member := range members {
-		if member == p.Sid {
-			continue
+		if member != sid {
+			rids = append(rids, member)
 		}
+	}
+	return rids
+}
 
-		if id, err := d.iw.NextId(); err == nil {
-			packet := &Packet{
-				Ver: p.Ver,
-				Mt:  p.Mt,
-				Mid: id,
-				Sid: p.Rid,
-				Rid: member,
-				Ext: p.Ext,
-				Pl:  p.Pl,
-			}
-
-			if d.isOnline(packet.Rid) {
-				d.sub.Publish(MESSAGE_TOPIC_DISPATCH, packet)
-			} else {
-				d.sub.Publish(MESSAGE_TOPIC_OFFLINE, packet)
-			}
-		}
+func fanOutPacket(p *Packet, id int64, member int64) *Packet {
+	return &Packet{
+		Ver: p.Ver,
+		Mt:  p.Mt,
+		Mid: id,
+		Sid: p.Rid,
+		Rid: member,
+		Ext: p.Ext,
+		Pl:  p.Pl,
+		Ct:  p.Ct,
 	}
 }
 
 func (d *Dispatch) Close() {
+	d.sub.Close()
+	if d.wordFilter != nil {
+		d.wordFilter.Close()
+	}
 	d.quit <- true
+	if d.lease != nil {
+		close(d.leaseQuit)
+		d.iwMutex.RLock()
+		workerId := d.workerId
+		d.iwMutex.RUnlock()
+		d.lease.Release(workerId)
+	}
 }
@@ -0,0 +1,164 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//有效期消息和阅后即焚消息
+//客户端在Ext中设置EXT_KEY_TTL(从Ct开始的有效期)或者EXT_FLAG_BURN_AFTER_READ标记，单聊和群聊有效
+//过期的消息不再下发和同步，store后台定时从数据库和redis离线消息中清理
+//阅后即焚的消息由接收者发送MESSAGE_TYPE_BURN_READ，comet发布到MESSAGE_TOPIC_BURN，store从所有存储删除
+//这两种消息都不保存会话列表中的摘要
+var (
+	MESSAGE_TOPIC_BURN         = "message_topic_burn"         //阅后即焚已读，内容为BurnEvent(json)
+	MESSAGE_CHANNEL_BURN_STORE = "message_channel_burn_store" //从存储删除已读的阅后即焚消息
+
+	KEY_OFFLINE_EPHEMERAL = "offline#ephemeral" //sorted set，member为 uid#mt#cid#mid，score为过期时间(ms)，后台清理离线消息时使用
+	KEY_PREFIX_BURN_DONE  = "burn#done#"        //burn#done#uid#mid，已经删除的阅后即焚消息，区分重试和消息还没有存储
+	BURN_DONE_TTL         = 24 * time.Hour      //标记保留时间，大于nsq重试的总时长
+)
+
+var (
+	ErrBurnNotSaved = errors.New("burn after read message not saved yet")
+)
+
+type EphemeralConfig struct {
+	PurgeInterval time.Duration `yaml:"purge_interval"` //清理过期消息的间隔
+	PurgeBatch    int           `yaml:"purge_batch"`    //每次删除的最大条数，删除满一批时继续下一批
+}
+
+func NewEphemeralConfig() EphemeralConfig {
+	return EphemeralConfig{
+		PurgeInterval: time.Minute,
+		PurgeBatch:    1000,
+	}
+}
+
+func (c *EphemeralConfig) Validate() error {
+	if c.PurgeInterval <= 0 {
+		return fmt.Errorf("ephemeral purge_interval must be positive, got %v", c.PurgeInterval)
+	}
+	if c.PurgeBatch <= 0 {
+		return fmt.Errorf("ephemeral purge_batch must be positive, got %d", c.PurgeBatch)
+	}
+	return nil
+}
+
+//MESSAGE_TOPIC_BURN的消息内容，Uid为上报已读的接收者
+type BurnEvent struct {
+	Uid int64 `json:"uid"`
+	Mt  int32 `json:"mt"`
+	Cid int64 `json:"cid"`
+	Mid int64 `json:"mid"`
+}
+
+var (
+	//KEYS: msgs convs gaps
+	//ARGV: conv member1 member2 ...
+	//会话的离线消息删空并且没有缺失记录时从会话索引中删除
+	removeOfflineScript = redis.NewScript(3, `
+local n = 0
+for i = 2, #ARGV do
+	n = n + redis.call('ZREM', KEYS[1], ARGV[i])
+end
+if redis.call('ZCARD', KEYS[1]) == 0 and redis.call('HEXISTS', KEYS[3], ARGV[1]) == 0 and redis.call('HEXISTS', KEYS[3], ARGV[1] .. '#after') == 0 then
+	redis.call('SREM', KEYS[2], ARGV[1])
+end
+return n`)
+)
+
+func ephemeralMember(uid int64, p *Packet) string {
+	return fmt.Sprintf("%d#%s#%d", uid, offlineConv(p.Mt, p.Sid), p.Mid)
+}
+
+//记录有效期离线消息，过期后由PurgeOfflineExpired删除
+func IndexEphemeralOffline(conn redis.Conn, p *Packet) error {
+	expireAt := p.ExpireAt()
+	if expireAt == 0 {
+		return nil
+	}
+	_, err := conn.Do("ZADD", KEY_OFFLINE_EPHEMERAL, expireAt, ephemeralMember(p.Rid, p))
+	return err
+}
+
+//删除会话中match返回true的离线消息，返回删除的条数
+//离线消息按序列化后的内容保存，需要读出来逐条判断
+func removeOffline(conn redis.Conn, proto Protocol, uid int64, conv string, match func(p *Packet) bool) (int64, error) {
+	msgs, err := redis.ByteSlices(conn.Do("ZRANGE", offlineMsgsKey(uid, conv), 0, -1))
+	if err != nil {
+		return 0, err
+	}
+
+	args := []interface{}{offlineMsgsKey(uid, conv), offlineConvsKey(uid), offlineGapsKey(uid), conv}
+	for _, buf := range msgs {
+		if p, err := proto.Unserialize(buf); err == nil && match(p) {
+			args = append(args, buf)
+		}
+	}
+	if len(args) == 4 {
+		return 0, nil
+	}
+	return redis.Int64(removeOfflineScript.Do(conn, args...))
+}
+
+//删除已经过期的离线消息，最多处理limit条过期记录，返回删除的条数和处理的记录数
+func PurgeOfflineExpired(conn redis.Conn, proto Protocol, now int64, limit int) (int64, int, error) {
+	members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", KEY_OFFLINE_EPHEMERAL, "-inf", now, "LIMIT", 0, limit))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, member := range members {
+		var uid, cid, mid int64
+		var mt int32
+		if _, err := fmt.Sscanf(member, "%d#%d#%d#%d", &uid, &mt, &cid, &mid); err == nil {
+			//同一个会话的消息一起删除，同一会话的其他过期记录随后删除不到消息，不影响结果
+			n, err := removeOffline(conn, proto, uid, offlineConv(mt, cid), func(p *Packet) bool {
+				return p.Expired(now)
+			})
+			if err != nil {
+				return total, 0, err
+			}
+			total += n
+		}
+		if _, err := conn.Do("ZREM", KEY_OFFLINE_EPHEMERAL, member); err != nil {
+			return total, 0, err
+		}
+	}
+	return total, len(members), nil
+}
+
+//删除已读的阅后即焚离线消息，通常已经在上线时取出，这里处理重复登录和重试的情况
+func BurnOffline(conn redis.Conn, proto Protocol, p *Packet) error {
+	_, err := removeOffline(conn, proto, p.Rid, offlineConv(p.Mt, p.Sid), func(m *Packet) bool {
+		return m.Mid == p.Mid
+	})
+	if err != nil {
+		return err
+	}
+	if p.ExpireAt() > 0 {
+		conn.Do("ZREM", KEY_OFFLINE_EPHEMERAL, ephemeralMember(p.Rid, p))
+	}
+	return nil
+}
+
+func burnDoneKey(uid int64, mid int64) string {
+	return fmt.Sprintf("%s%d#%d", KEY_PREFIX_BURN_DONE, uid, mid)
+}
+
+func decodeBurnEvent(body []byte) (*BurnEvent, error) {
+	e := &BurnEvent{}
+	if err := json.Unmarshal(body, e); err != nil {
+		return nil, err
+	}
+	if e.Uid <= 0 || e.Mid == 0 {
+		return nil, fmt.Errorf("burn event invalid: uid=%d mid=%d", e.Uid, e.Mid)
+	}
+	return e, nil
+}
@@ -0,0 +1,394 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	EVENT_LOOP_READ_BUFFER  = 64 * 1024  //每个poller共享的读缓冲区大小
+	EVENT_LOOP_WORKER_QUEUE = 4096       //每个worker的任务队列长度
+	EVENT_LOOP_KEEP_BUFFER  = 4 * 1024   //连接空闲时保留的缓冲区上限，超过直接释放
+	EVENT_LOOP_CONN_PENDING = int32(256) //单个连接在worker队列中等待处理的packet上限，超过时暂停读取，处理到一半以下时恢复
+)
+
+var (
+	ErrEventLoopOverload = errors.New("event loop worker queue full")
+)
+
+//事件循环模式下的连接状态，替代每个连接的读写goroutine和channel
+type loopConn struct {
+	client *Client
+	fd     int
+	poller *poller
+	mutex  sync.Mutex
+	inBuf  []byte //还没有解析完整的读数据
+	outBuf []byte //还没有写完的数据
+	outOn  bool   //是否已经注册了可写事件
+	closed bool
+
+	pending  int32 //已经投递到worker还没有处理的packet数量
+	paused   int32 //为1时暂停读取，worker处理完积压后恢复
+	lastRead int64 //最后一次读到数据的时间，纳秒，空闲检查使用
+
+	laneBufs [][]byte //等待可写事件期间按通道暂存的数据，outBuf写完后按优先级合并
+}
+
+//handler任务，p为nil表示关闭连接
+type loopTask struct {
+	lc *loopConn
+	p  *Packet
+}
+
+//epoll事件循环，少量poller goroutine负责所有连接的读写就绪事件，
+//解析出的packet交给worker池调用Client回调，同一连接固定落在同一个worker，保证消息顺序
+type EventLoop struct {
+	server      *TCPServer
+	pollers     []*poller
+	workers     []chan loopTask
+	idleTimeout time.Duration //为0时不检查空闲连接
+	quit        chan bool
+}
+
+func NewEventLoop(server *TCPServer, pollers int, workers int, idleTimeout time.Duration) (*EventLoop, error) {
+	if pollers <= 0 {
+		pollers = 1
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+
+	loop := &EventLoop{
+		server:      server,
+		pollers:     make([]*poller, 0, pollers),
+		workers:     make([]chan loopTask, workers),
+		idleTimeout: idleTimeout,
+		quit:        make(chan bool),
+	}
+
+	for i := 0; i < pollers; i++ {
+		p, err := newPoller(loop)
+		if err != nil {
+			for _, p := range loop.pollers {
+				p.close()
+			}
+			return nil, err
+		}
+		loop.pollers = append(loop.pollers, p)
+	}
+
+	for i := range loop.workers {
+		loop.workers[i] = make(chan loopTask, EVENT_LOOP_WORKER_QUEUE)
+		go loop.workerLoop(loop.workers[i])
+	}
+
+	for _, p := range loop.pollers {
+		go p.run()
+	}
+	if idleTimeout > 0 {
+		go loop.sweepLoop()
+	}
+
+	return loop, nil
+}
+
+//把客户端连接加入事件循环
+func (loop *EventLoop) Add(client *Client) error {
+	fd, err := connFd(client.conn)
+	if err != nil {
+		return err
+	}
+
+	lc := &loopConn{
+		client:   client,
+		fd:       fd,
+		poller:   loop.pollers[fd%len(loop.pollers)],
+		lastRead: time.Now().UnixNano(),
+	}
+	client.lc = lc
+
+	return lc.poller.add(lc)
+}
+
+func (loop *EventLoop) Close() {
+	close(loop.quit)
+	for _, p := range loop.pollers {
+		p.close()
+	}
+}
+
+//投递packet到连接对应的worker，不阻塞poller，队列满时返回false
+func (loop *EventLoop) dispatch(lc *loopConn, p *Packet) bool {
+	select {
+	case loop.workers[lc.fd%len(loop.workers)] <- loopTask{lc: lc, p: p}:
+		atomic.AddInt32(&lc.pending, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+//投递关闭任务，排在连接已经投递的packet之后，队列满时在新的goroutine里等待
+func (loop *EventLoop) dispatchClose(lc *loopConn) {
+	tasks := loop.workers[lc.fd%len(loop.workers)]
+	select {
+	case tasks <- loopTask{lc: lc}:
+	default:
+		go func() {
+			tasks <- loopTask{lc: lc}
+		}()
+	}
+}
+
+//和goroutine模式的读超时一样，超过idleTimeout没有读到数据的连接关闭
+func (loop *EventLoop) sweepLoop() {
+	interval := loop.idleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			before := time.Now().Add(-loop.idleTimeout).UnixNano()
+			for _, p := range loop.pollers {
+				for _, lc := range p.idleConns(before) {
+					fmt.Printf("close idle connection, uid=%d\n", lc.client.Uid())
+					p.closeConn(lc)
+				}
+			}
+		case <-loop.quit:
+			return
+		}
+	}
+}
+
+func (loop *EventLoop) workerLoop(tasks chan loopTask) {
+	for task := range tasks {
+		loop.handleTask(task)
+	}
+}
+
+func (loop *EventLoop) handleTask(task loopTask) {
+	client := task.lc.client
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("event loop handle panic: %v\n", err)
+			client.Close()
+		}
+	}()
+
+	if task.p == nil {
+		client.Close()
+		return
+	}
+	defer task.lc.done()
+
+	if client.IsClose() {
+		return
+	}
+
+	if !client.OnMessage(task.p) {
+		client.Close()
+	}
+}
+
+//worker处理完一个packet，积压降到一半以下时恢复读取
+func (lc *loopConn) done() {
+	n := atomic.AddInt32(&lc.pending, -1)
+	if n <= EVENT_LOOP_CONN_PENDING/2 && atomic.LoadInt32(&lc.paused) == 1 {
+		lc.resume()
+	}
+}
+
+//暂停读取，数据留在socket缓冲区，由tcp流控让客户端放慢发送
+func (lc *loopConn) pause() {
+	lc.mutex.Lock()
+	if lc.closed || atomic.LoadInt32(&lc.paused) == 1 {
+		lc.mutex.Unlock()
+		return
+	}
+	atomic.StoreInt32(&lc.paused, 1)
+	lc.poller.update(lc)
+	lc.mutex.Unlock()
+
+	//设置标记之前worker可能已经处理完积压，这里再检查一次，避免一直暂停
+	if atomic.LoadInt32(&lc.pending) <= EVENT_LOOP_CONN_PENDING/2 {
+		lc.resume()
+	}
+}
+
+func (lc *loopConn) resume() {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	if lc.closed || atomic.LoadInt32(&lc.paused) == 0 {
+		return
+	}
+	atomic.StoreInt32(&lc.paused, 0)
+	lc.poller.update(lc)
+}
+
+//处理读就绪，data为本次从socket读到的数据
+func (lc *loopConn) onRead(loop *EventLoop, data []byte) error {
+	atomic.StoreInt64(&lc.lastRead, time.Now().UnixNano())
+	buf := data
+	if len(lc.inBuf) > 0 {
+		lc.inBuf = append(lc.inBuf, data...)
+		buf = lc.inBuf
+	}
+
+	for len(buf) > 0 {
+		p, n, err := decodeFramedPacket(loop.server.protocol, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		buf = buf[n:]
+		if !loop.dispatch(lc, p) {
+			return ErrEventLoopOverload
+		}
+	}
+	if atomic.LoadInt32(&lc.pending) >= EVENT_LOOP_CONN_PENDING {
+		lc.pause()
+	}
+
+	//保留不完整的packet，等待后续数据
+	if len(buf) == 0 {
+		if cap(lc.inBuf) > EVENT_LOOP_KEEP_BUFFER {
+			lc.inBuf = nil
+		} else {
+			lc.inBuf = lc.inBuf[:0]
+		}
+	} else if len(lc.inBuf) == 0 {
+		lc.inBuf = append(lc.inBuf, buf...)
+	} else {
+		lc.inBuf = lc.inBuf[:copy(lc.inBuf, buf)]
+	}
+
+	return nil
+}
+
+//写入packet，能直接写出就直接写，写不完的部分等待可写事件
+func (lc *loopConn) send(p *Packet, lane Lane) error {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	if lc.closed {
+		return errors.New("connection closed")
+	}
+
+	if lc.outOn {
+		//已经在等待可写事件，按通道暂存，在onWrite里按优先级写出
+		if lc.laneBufs == nil {
+			lc.laneBufs = make([][]byte, LANE_COUNT)
+		}
+		lc.laneBufs[lane] = appendPacket(lc.client.server.protocol, lc.laneBufs[lane], p)
+		return nil
+	}
+
+	lc.outBuf = appendPacket(lc.client.server.protocol, lc.outBuf, p)
+	return lc.flush()
+}
+
+//outBuf写完后取出暂存的数据，高优先级的通道在前
+func (lc *loopConn) refill() bool {
+	if lc.laneBufs == nil {
+		return false
+	}
+	for i, b := range lc.laneBufs {
+		lc.outBuf = append(lc.outBuf, b...)
+		lc.laneBufs[i] = nil
+	}
+	lc.laneBufs = nil
+	return len(lc.outBuf) > 0
+}
+
+//处理写就绪
+func (lc *loopConn) onWrite() error {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	if lc.closed {
+		return nil
+	}
+
+	return lc.flush()
+}
+
+//调用方需要持有mutex
+func (lc *loopConn) flush() error {
+	for len(lc.outBuf) > 0 || lc.refill() {
+		n, err := syscall.Write(lc.fd, lc.outBuf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			if !lc.outOn {
+				lc.outOn = true
+				return lc.poller.update(lc)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lc.outBuf = lc.outBuf[n:]
+	}
+
+	if cap(lc.outBuf) > EVENT_LOOP_KEEP_BUFFER {
+		lc.outBuf = nil
+	} else {
+		lc.outBuf = lc.outBuf[:0]
+	}
+
+	if lc.outOn {
+		lc.outOn = false
+		return lc.poller.update(lc)
+	}
+
+	return nil
+}
+
+//从事件循环移除连接，由Client.Close调用
+func (lc *loopConn) close() {
+	lc.mutex.Lock()
+	lc.closed = true
+	lc.outBuf = nil
+	lc.laneBufs = nil
+	lc.mutex.Unlock()
+
+	lc.poller.remove(lc)
+}
+
+//获取连接的文件描述符，net包已经把fd设置成非阻塞
+func connFd(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("connection not support syscall")
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	fd := -1
+	err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return fd, nil
+}
@@ -0,0 +1,327 @@
+package tcpserver
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//Packet.Ext编码: 1字节版本号 + 若干个字段，每个字段为 2字节key + 2字节长度 + value，整数都是大端
+//不认识的key原样保留，服务端各层只修改自己关心的key
+//不是这个格式的Ext(老版本客户端自定义的内容)作为EXT_KEY_LEGACY保留，写入新字段时一起转换
+var (
+	EXT_VERSION   byte = 1
+	EXT_FIELD_MAX      = 0xffff //单个value的最大长度
+
+	EXT_KEY_LEGACY       uint16 = 0 //无法解析的老格式Ext
+	EXT_KEY_TRACE_ID     uint16 = 1 //服务端链路追踪id，uint64，下发给客户端前去掉
+	EXT_KEY_CLIENT_MID   uint16 = 2 //客户端生成的消息序号，int64，dispatch分配mid前写入
+	EXT_KEY_CONV_SEQ     uint16 = 3 //会话内的消息序号，int64
+	EXT_KEY_MENTIONS     uint16 = 4 //@的用户id列表，int64数组
+	EXT_KEY_CONTENT_TYPE uint16 = 5 //内容类型，字符串，例如 text/plain
+	EXT_KEY_FLAGS        uint16 = 6 //消息标记位，uint32
+	EXT_KEY_TTL          uint16 = 7 //消息有效期 ms，int64，从Ct开始计算，过期后不再下发和同步
+	EXT_KEY_MEDIA_ID     uint16 = 8 //引用的媒体文件id，字符串，media服务上传完成后返回
+
+	EXT_KEY_CUSTOM uint16 = 0x8000 //业务自定义的key从这里开始，服务端不会使用
+
+	//EXT_KEY_FLAGS的标记位，低8位为传输层标记，只在comet和客户端之间有效，comet收到后去掉
+	EXT_FLAG_DEFLATE        uint32 = 1 << 0 //payload经过deflate压缩
+	EXT_FLAG_AES_GCM        uint32 = 1 << 1 //payload经过aes-gcm加密，nonce在payload开头
+	EXT_FLAG_TRANSPORT_MASK uint32 = 0xff
+
+	EXT_FLAG_BURN_AFTER_READ uint32 = 1 << 8 //阅后即焚，接收者上报已读后从所有存储删除
+	EXT_FLAG_MENTIONED       uint32 = 1 << 9 //接收者被@，只由dispatch在群消息扩散时设置，客户端设置的会被清除
+
+	MENTION_ALL int64 = -1 //写在EXT_KEY_MENTIONS中表示@所有人
+)
+
+var (
+	ErrExtInvalid  = errors.New("ext invalid")
+	ErrExtTooLarge = errors.New("ext value too large")
+)
+
+type ExtField struct {
+	Key   uint16
+	Value []byte
+}
+
+//解析后的Ext，按写入顺序保存字段
+type Ext []ExtField
+
+//解析Ext，空Ext返回nil，格式错误返回ErrExtInvalid
+//返回的value引用data，不做拷贝
+func ParseExt(data []byte) (Ext, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[0] != EXT_VERSION {
+		return nil, ErrExtInvalid
+	}
+
+	var e Ext
+	for i := 1; i < len(data); {
+		if len(data)-i < 4 {
+			return nil, ErrExtInvalid
+		}
+		key := binary.BigEndian.Uint16(data[i:])
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		i += 4
+		if len(data)-i < n {
+			return nil, ErrExtInvalid
+		}
+		e = append(e, ExtField{Key: key, Value: data[i : i+n : i+n]})
+		i += n
+	}
+	return e, nil
+}
+
+//和ParseExt相同，格式错误时把整个data作为EXT_KEY_LEGACY，保证不丢内容
+func parseExtLenient(data []byte) Ext {
+	e, err := ParseExt(data)
+	if err != nil {
+		return Ext{{Key: EXT_KEY_LEGACY, Value: data}}
+	}
+	return e
+}
+
+func (e Ext) Get(key uint16) ([]byte, bool) {
+	for _, f := range e {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+//替换已有的key，不存在时追加到最后
+func (e *Ext) Set(key uint16, value []byte) error {
+	if len(value) > EXT_FIELD_MAX {
+		return ErrExtTooLarge
+	}
+	for i := range *e {
+		if (*e)[i].Key == key {
+			(*e)[i].Value = value
+			return nil
+		}
+	}
+	*e = append(*e, ExtField{Key: key, Value: value})
+	return nil
+}
+
+func (e *Ext) Del(key uint16) {
+	fields := (*e)[:0]
+	for _, f := range *e {
+		if f.Key != key {
+			fields = append(fields, f)
+		}
+	}
+	*e = fields
+}
+
+//编码为新分配的切片，没有字段时返回nil
+func (e Ext) Bytes() []byte {
+	if len(e) == 0 {
+		return nil
+	}
+
+	size := 1
+	for _, f := range e {
+		size += 4 + len(f.Value)
+	}
+	buf := make([]byte, size)
+	buf[0] = EXT_VERSION
+	i := 1
+	for _, f := range e {
+		binary.BigEndian.PutUint16(buf[i:], f.Key)
+		binary.BigEndian.PutUint16(buf[i+2:], uint16(len(f.Value)))
+		i += 4
+		i += copy(buf[i:], f.Value)
+	}
+	return buf
+}
+
+//读取Ext中的字段，Ext格式错误时只能读到EXT_KEY_LEGACY
+func (p *Packet) ExtValue(key uint16) ([]byte, bool) {
+	return parseExtLenient(p.Ext).Get(key)
+}
+
+//写入Ext字段，Ext重新分配，不修改其他packet共享的数据
+func (p *Packet) SetExtValue(key uint16, value []byte) error {
+	e := parseExtLenient(p.Ext)
+	//老格式的Ext太长时无法转换
+	if legacy, ok := e.Get(EXT_KEY_LEGACY); ok && len(legacy) > EXT_FIELD_MAX {
+		return ErrExtTooLarge
+	}
+	if err := e.Set(key, value); err != nil {
+		return err
+	}
+	p.Ext = e.Bytes()
+	return nil
+}
+
+func (p *Packet) DelExtValue(key uint16) {
+	e := parseExtLenient(p.Ext)
+	if _, ok := e.Get(key); !ok {
+		return
+	}
+	e.Del(key)
+	p.Ext = e.Bytes()
+}
+
+func (p *Packet) extUint64(key uint16) uint64 {
+	v, ok := p.ExtValue(key)
+	if !ok || len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+//0表示删除
+func (p *Packet) setExtUint64(key uint16, n uint64) {
+	if n == 0 {
+		p.DelExtValue(key)
+		return
+	}
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], n)
+	p.SetExtValue(key, v[:])
+}
+
+func (p *Packet) TraceId() uint64 {
+	return p.extUint64(EXT_KEY_TRACE_ID)
+}
+
+func (p *Packet) SetTraceId(id uint64) {
+	p.setExtUint64(EXT_KEY_TRACE_ID, id)
+}
+
+func (p *Packet) ClientMid() int64 {
+	return int64(p.extUint64(EXT_KEY_CLIENT_MID))
+}
+
+func (p *Packet) SetClientMid(mid int64) {
+	p.setExtUint64(EXT_KEY_CLIENT_MID, uint64(mid))
+}
+
+func (p *Packet) ConvSeq() int64 {
+	return int64(p.extUint64(EXT_KEY_CONV_SEQ))
+}
+
+func (p *Packet) SetConvSeq(seq int64) {
+	p.setExtUint64(EXT_KEY_CONV_SEQ, uint64(seq))
+}
+
+func (p *Packet) Mentions() []int64 {
+	v, ok := p.ExtValue(EXT_KEY_MENTIONS)
+	if !ok || len(v)%8 != 0 {
+		return nil
+	}
+	uids := make([]int64, len(v)/8)
+	for i := range uids {
+		uids[i] = int64(binary.BigEndian.Uint64(v[i*8:]))
+	}
+	return uids
+}
+
+//空列表表示删除，超过EXT_FIELD_MAX/8个用户时返回ErrExtTooLarge
+func (p *Packet) SetMentions(uids []int64) error {
+	if len(uids) == 0 {
+		p.DelExtValue(EXT_KEY_MENTIONS)
+		return nil
+	}
+	v := make([]byte, len(uids)*8)
+	for i, uid := range uids {
+		binary.BigEndian.PutUint64(v[i*8:], uint64(uid))
+	}
+	return p.SetExtValue(EXT_KEY_MENTIONS, v)
+}
+
+func (p *Packet) ContentType() string {
+	v, _ := p.ExtValue(EXT_KEY_CONTENT_TYPE)
+	return string(v)
+}
+
+//空字符串表示删除
+func (p *Packet) SetContentType(ct string) error {
+	if ct == "" {
+		p.DelExtValue(EXT_KEY_CONTENT_TYPE)
+		return nil
+	}
+	return p.SetExtValue(EXT_KEY_CONTENT_TYPE, []byte(ct))
+}
+
+func (p *Packet) MediaId() string {
+	v, _ := p.ExtValue(EXT_KEY_MEDIA_ID)
+	return string(v)
+}
+
+//空字符串表示删除
+func (p *Packet) SetMediaId(id string) error {
+	if id == "" {
+		p.DelExtValue(EXT_KEY_MEDIA_ID)
+		return nil
+	}
+	return p.SetExtValue(EXT_KEY_MEDIA_ID, []byte(id))
+}
+
+func (p *Packet) Flags() uint32 {
+	v, ok := p.ExtValue(EXT_KEY_FLAGS)
+	if !ok || len(v) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+//0表示删除
+func (p *Packet) SetFlags(flags uint32) {
+	if flags == 0 {
+		p.DelExtValue(EXT_KEY_FLAGS)
+		return
+	}
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], flags)
+	p.SetExtValue(EXT_KEY_FLAGS, v[:])
+}
+
+func (p *Packet) HasFlag(flag uint32) bool {
+	return p.Flags()&flag != 0
+}
+
+func (p *Packet) IsMentioned() bool {
+	return p.HasFlag(EXT_FLAG_MENTIONED)
+}
+
+func (p *Packet) TTL() int64 {
+	return int64(p.extUint64(EXT_KEY_TTL))
+}
+
+//0表示删除，消息不过期
+func (p *Packet) SetTTL(ttl int64) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	p.setExtUint64(EXT_KEY_TTL, uint64(ttl))
+}
+
+//过期时间 ms，没有设置有效期时返回0
+func (p *Packet) ExpireAt() int64 {
+	ttl := p.TTL()
+	if ttl <= 0 {
+		return 0
+	}
+	return p.Ct + ttl
+}
+
+func (p *Packet) Expired(now int64) bool {
+	expireAt := p.ExpireAt()
+	return expireAt > 0 && expireAt <= now
+}
+
+func (p *Packet) IsBurnAfterRead() bool {
+	return p.HasFlag(EXT_FLAG_BURN_AFTER_READ)
+}
+
+//有效期或者阅后即焚的消息，不保存摘要
+func (p *Packet) IsEphemeral() bool {
+	return p.TTL() > 0 || p.IsBurnAfterRead()
+}
@@ -0,0 +1,145 @@
+package tcpserver
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExtRoundTrip(t *testing.T) {
+	tests := []Ext{
+		nil,
+		{{Key: EXT_KEY_CLIENT_MID, Value: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{{Key: EXT_KEY_CONTENT_TYPE, Value: []byte("text/plain")}, {Key: EXT_KEY_CUSTOM, Value: []byte{}}, {Key: 0xffff, Value: []byte("x")}},
+		{{Key: EXT_KEY_CUSTOM + 1, Value: bytes.Repeat([]byte{0xab}, EXT_FIELD_MAX)}},
+	}
+	for i, e := range tests {
+		data := e.Bytes()
+		got, err := ParseExt(data)
+		if err != nil {
+			t.Fatalf("ext %d: %s", i, err.Error())
+		}
+		if len(got) != len(e) {
+			t.Fatalf("ext %d: got %d fields, want %d", i, len(got), len(e))
+		}
+		for j := range e {
+			if got[j].Key != e[j].Key || !bytes.Equal(got[j].Value, e[j].Value) {
+				t.Fatalf("ext %d field %d: got %v, want %v", i, j, got[j], e[j])
+			}
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Fatalf("ext %d: encoding not stable", i)
+		}
+	}
+}
+
+func TestParseExtInvalid(t *testing.T) {
+	tests := [][]byte{
+		{2},                                 //未知版本
+		{EXT_VERSION, 0, 1},                 //字段头不完整
+		{EXT_VERSION, 0, 1, 0, 3, 'a', 'b'}, //value不完整
+	}
+	for _, data := range tests {
+		if _, err := ParseExt(data); err != ErrExtInvalid {
+			t.Errorf("%v: got %v, want ErrExtInvalid", data, err)
+		}
+	}
+}
+
+//只修改指定的key，不认识的key和顺序保持不变
+func TestExtPreservesUnknownKeys(t *testing.T) {
+	custom := Ext{{Key: EXT_KEY_CUSTOM + 7, Value: []byte("biz")}, {Key: 0x1234, Value: []byte{9}}}
+	p := &Packet{Ext: custom.Bytes()}
+
+	p.SetClientMid(42)
+	p.SetContentType("text/plain")
+	p.SetClientMid(43)
+	p.DelExtValue(EXT_KEY_CONTENT_TYPE)
+	p.DelExtValue(EXT_KEY_TRACE_ID)
+
+	e, err := ParseExt(p.Ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []uint16{}
+	for _, f := range e {
+		keys = append(keys, f.Key)
+	}
+	if want := []uint16{EXT_KEY_CUSTOM + 7, 0x1234, EXT_KEY_CLIENT_MID}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys %v, want %v", keys, want)
+	}
+	if v, _ := e.Get(EXT_KEY_CUSTOM + 7); string(v) != "biz" {
+		t.Fatalf("custom value %q", v)
+	}
+	if p.ClientMid() != 43 {
+		t.Fatalf("client mid %d", p.ClientMid())
+	}
+}
+
+//SetExtValue重新分配Ext，不修改共享的数据
+func TestSetExtValueCopies(t *testing.T) {
+	shared := Ext{{Key: EXT_KEY_CONTENT_TYPE, Value: []byte("text/plain")}}.Bytes()
+	orig := append([]byte(nil), shared...)
+	a, b := &Packet{Ext: shared}, &Packet{Ext: shared}
+
+	a.SetContentType("image/png")
+	if !bytes.Equal(shared, orig) || b.ContentType() != "text/plain" {
+		t.Fatal("SetExtValue modified shared ext")
+	}
+}
+
+//老格式的Ext作为EXT_KEY_LEGACY保留，写入新字段时一起转换
+func TestExtLegacyFallback(t *testing.T) {
+	legacy := []byte(`{"custom":"json"}`)
+	p := &Packet{Ext: legacy}
+
+	if v, ok := p.ExtValue(EXT_KEY_LEGACY); !ok || !bytes.Equal(v, legacy) {
+		t.Fatalf("legacy value %q, %v", v, ok)
+	}
+	if _, ok := p.ExtValue(EXT_KEY_CLIENT_MID); ok {
+		t.Fatal("legacy ext has no other keys")
+	}
+
+	//没有要删除的key时不转换
+	p.DelExtValue(EXT_KEY_TRACE_ID)
+	if !bytes.Equal(p.Ext, legacy) {
+		t.Fatal("DelExtValue converted legacy ext without a change")
+	}
+
+	p.SetClientMid(7)
+	e, err := ParseExt(p.Ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := e.Get(EXT_KEY_LEGACY); !ok || !bytes.Equal(v, legacy) {
+		t.Fatalf("legacy content lost after conversion: %q", v)
+	}
+	if p.ClientMid() != 7 {
+		t.Fatalf("client mid %d", p.ClientMid())
+	}
+}
+
+func TestExtTooLarge(t *testing.T) {
+	e := Ext{}
+	if err := e.Set(EXT_KEY_CUSTOM, make([]byte, EXT_FIELD_MAX+1)); err != ErrExtTooLarge {
+		t.Fatalf("Set: got %v", err)
+	}
+	if err := e.Set(EXT_KEY_CUSTOM, make([]byte, EXT_FIELD_MAX)); err != nil {
+		t.Fatalf("Set max: %s", err.Error())
+	}
+
+	p := &Packet{}
+	if err := p.SetExtValue(EXT_KEY_CUSTOM, make([]byte, EXT_FIELD_MAX+1)); err != ErrExtTooLarge || p.Ext != nil {
+		t.Fatalf("SetExtValue: got %v, ext %d bytes", err, len(p.Ext))
+	}
+
+	//老格式的Ext超过单个value的最大长度时不能转换，保持不变
+	legacy := bytes.Repeat([]byte{0xff}, EXT_FIELD_MAX+1)
+	p = &Packet{Ext: legacy}
+	if err := p.SetExtValue(EXT_KEY_CLIENT_MID, []byte{1}); err != ErrExtTooLarge {
+		t.Fatalf("SetExtValue legacy: got %v", err)
+	}
+	if !bytes.Equal(p.Ext, legacy) {
+		t.Fatal("legacy ext modified on error")
+	}
+}
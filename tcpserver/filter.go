@@ -0,0 +1,505 @@
+package tcpserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+//消息内容过滤，dispatch在路由之前按顺序执行过滤器
+//每条规则配置命中后的处理方式: mask 用*替换命中的内容后继续投递，reject 不投递并通知发送者，review 继续投递并标记待审核
+//所有命中都写入审核记录(MESSAGE_TOPIC_FILTER_AUDIT)，store保存到filter_audit表
+var (
+	FILTER_ACTION_MASK   = "mask"
+	FILTER_ACTION_REJECT = "reject"
+	FILTER_ACTION_REVIEW = "review"
+
+	FILTER_MASK_RUNE = '*'
+
+	//没有Ext内容类型的消息按文本处理，其他内容类型只过滤这些
+	FILTER_CONTENT_TYPES = []string{"text/", "application/json"}
+
+	FILTER_LINK_PATTERN = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s"'<>]+`)
+)
+
+var (
+	ErrFilterRejected = errors.New("message rejected by content filter")
+)
+
+type FilterConfig struct {
+	Enable           bool          `yaml:"enable"`
+	WordFile         string        `yaml:"word_file" reload:"true"`          //敏感词文件，每行 词[,处理方式]，#开头为注释
+	DefaultAction    string        `yaml:"default_action" reload:"true"`     //词没有指定处理方式时使用
+	CheckInterval    time.Duration `yaml:"check_interval"`                   //检查敏感词文件变化的间隔，0表示只在SIGHUP时重新加载
+	LinkAction       string        `yaml:"link_action"`                      //消息中的链接的处理方式，为空时不过滤链接
+	LinkAllowDomains string        `yaml:"link_allow_domains" reload:"true"` //不过滤的链接域名，逗号分隔，包含子域名
+}
+
+func NewFilterConfig() FilterConfig {
+	return FilterConfig{
+		Enable:        false,
+		DefaultAction: FILTER_ACTION_MASK,
+		CheckInterval: time.Minute,
+	}
+}
+
+func (c *FilterConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if !validFilterAction(c.DefaultAction) {
+		return fmt.Errorf("filter default_action must be mask, reject or review, got %q", c.DefaultAction)
+	}
+	if c.LinkAction != "" && !validFilterAction(c.LinkAction) {
+		return fmt.Errorf("filter link_action must be empty, mask, reject or review, got %q", c.LinkAction)
+	}
+	if c.WordFile == "" && c.LinkAction == "" {
+		return errors.New("filter needs word_file or link_action")
+	}
+	if c.CheckInterval < 0 {
+		return fmt.Errorf("filter check_interval must not be negative, got %v", c.CheckInterval)
+	}
+	return nil
+}
+
+func validFilterAction(action string) bool {
+	return action == FILTER_ACTION_MASK || action == FILTER_ACTION_REJECT || action == FILTER_ACTION_REVIEW
+}
+
+//一次命中
+type FilterHit struct {
+	Filter string `json:"filter"` //过滤器名称
+	Word   string `json:"word"`   //命中的规则
+	Text   string `json:"text"`   //消息中命中的原文
+	Action string `json:"action"`
+}
+
+//过滤结果，多个过滤器的命中合并在一起
+type FilterVerdict struct {
+	Hits []FilterHit
+}
+
+func (v *FilterVerdict) add(hit FilterHit) {
+	v.Hits = append(v.Hits, hit)
+}
+
+//最严格的处理方式，reject > mask > review，没有命中时为空
+func (v *FilterVerdict) Action() string {
+	action := ""
+	for _, hit := range v.Hits {
+		switch {
+		case hit.Action == FILTER_ACTION_REJECT:
+			return FILTER_ACTION_REJECT
+		case hit.Action == FILTER_ACTION_MASK:
+			action = FILTER_ACTION_MASK
+		case action == "":
+			action = hit.Action
+		}
+	}
+	return action
+}
+
+//过滤器，命中时写入verdict，mask时直接修改p.Pl
+//payload已经确认是合法的utf8文本
+type PacketFilter interface {
+	Name() string
+	Filter(p *Packet, v *FilterVerdict)
+}
+
+type FilterChain struct {
+	filters []PacketFilter
+}
+
+func NewFilterChain(filters ...PacketFilter) *FilterChain {
+	return &FilterChain{filters: filters}
+}
+
+func (c *FilterChain) Add(f PacketFilter) {
+	c.filters = append(c.filters, f)
+}
+
+//按顺序执行过滤器，有reject命中时不再执行后面的过滤器
+func (c *FilterChain) Run(p *Packet) *FilterVerdict {
+	v := &FilterVerdict{}
+	if !filterable(p) {
+		return v
+	}
+
+	for _, f := range c.filters {
+		f.Filter(p, v)
+		if v.Action() == FILTER_ACTION_REJECT {
+			break
+		}
+	}
+	return v
+}
+
+//只过滤文本类型的聊天消息
+func filterable(p *Packet) bool {
+	if !isChatPacket(p) {
+		return false
+	}
+	if len(p.Pl) == 0 || !utf8.Valid(p.Pl) {
+		return false
+	}
+
+	ct := p.ContentType()
+	if ct == "" {
+		return true
+	}
+	for _, prefix := range FILTER_CONTENT_TYPES {
+		if strings.HasPrefix(ct, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//把text中[start, end)的rune替换为FILTER_MASK_RUNE
+func maskRunes(text []rune, start int, end int) {
+	for i := start; i < end; i++ {
+		text[i] = FILTER_MASK_RUNE
+	}
+}
+
+type FilterRule struct {
+	Word   string
+	Action string
+}
+
+//多模式匹配，Aho–Corasick自动机，按rune匹配，不区分大小写
+type wordMatcher struct {
+	nodes []acNode
+	rules []FilterRule
+}
+
+type acNode struct {
+	next  map[rune]int32
+	fail  int32
+	depth int32
+	out   []int32 //以这个节点结尾的规则，包含fail链上的规则
+}
+
+type wordMatch struct {
+	rule  int32
+	start int //rune下标
+	end   int
+}
+
+func newWordMatcher(rules []FilterRule) *wordMatcher {
+	m := &wordMatcher{nodes: []acNode{{}}, rules: rules}
+	for i, rule := range rules {
+		cur := int32(0)
+		for _, r := range rule.Word {
+			r = unicode.ToLower(r)
+			next, ok := m.nodes[cur].next[r]
+			if !ok {
+				if m.nodes[cur].next == nil {
+					m.nodes[cur].next = make(map[rune]int32)
+				}
+				next = int32(len(m.nodes))
+				m.nodes[cur].next[r] = next
+				m.nodes = append(m.nodes, acNode{depth: m.nodes[cur].depth + 1})
+			}
+			cur = next
+		}
+		if cur != 0 {
+			m.nodes[cur].out = append(m.nodes[cur].out, int32(i))
+		}
+	}
+
+	//按层构建fail指针
+	queue := []int32{}
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for r, child := range m.nodes[cur].next {
+			fail := m.nodes[cur].fail
+			for fail != 0 {
+				if _, ok := m.nodes[fail].next[r]; ok {
+					break
+				}
+				fail = m.nodes[fail].fail
+			}
+			if next, ok := m.nodes[fail].next[r]; ok && next != child {
+				m.nodes[child].fail = next
+			}
+			m.nodes[child].out = append(m.nodes[child].out, m.nodes[m.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+func (m *wordMatcher) match(text []rune) []wordMatch {
+	matches := []wordMatch{}
+	cur := int32(0)
+	for i, r := range text {
+		r = unicode.ToLower(r)
+		for {
+			if next, ok := m.nodes[cur].next[r]; ok {
+				cur = next
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		for _, rule := range m.nodes[cur].out {
+			n := utf8.RuneCountInString(m.rules[rule].Word)
+			matches = append(matches, wordMatch{rule: rule, start: i + 1 - n, end: i + 1})
+		}
+	}
+	return matches
+}
+
+//读取敏感词文件，每行 词[,处理方式]
+func loadFilterRules(path string, defaultAction string) ([]FilterRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []FilterRule{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule := FilterRule{Word: text, Action: defaultAction}
+		if i := strings.LastIndex(text, ","); i >= 0 {
+			rule.Word = strings.TrimSpace(text[:i])
+			rule.Action = strings.TrimSpace(text[i+1:])
+		}
+		if rule.Word == "" || !validFilterAction(rule.Action) {
+			return nil, fmt.Errorf("%s:%d: invalid rule %q", path, line, text)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+//敏感词过滤，词表文件修改后自动重新加载，加载失败时继续使用原来的词表
+type WordFilter struct {
+	mutex         sync.RWMutex
+	matcher       *wordMatcher
+	path          string
+	defaultAction string
+	modTime       time.Time
+	quit          chan bool
+}
+
+func NewWordFilter(config *FilterConfig) (*WordFilter, error) {
+	f := &WordFilter{quit: make(chan bool)}
+	if err := f.load(config.WordFile, config.DefaultAction); err != nil {
+		return nil, err
+	}
+
+	if config.CheckInterval > 0 {
+		go f.watch(config.CheckInterval)
+	}
+	return f, nil
+}
+
+func (f *WordFilter) Name() string {
+	return "word"
+}
+
+func (f *WordFilter) load(path string, defaultAction string) error {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	rules, err := loadFilterRules(path, defaultAction)
+	if err != nil {
+		return fmt.Errorf("load filter words error: %s", err.Error())
+	}
+	matcher := newWordMatcher(rules)
+
+	f.mutex.Lock()
+	f.matcher = matcher
+	f.path = path
+	f.defaultAction = defaultAction
+	f.modTime = modTime
+	f.mutex.Unlock()
+
+	fmt.Printf("load filter words: %s, %d rules\n", path, len(rules))
+	return nil
+}
+
+//SIGHUP重新加载配置时调用
+func (f *WordFilter) Reload(config *FilterConfig) {
+	if err := f.load(config.WordFile, config.DefaultAction); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (f *WordFilter) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-ticker.C:
+			f.mutex.RLock()
+			path, defaultAction, modTime := f.path, f.defaultAction, f.modTime
+			f.mutex.RUnlock()
+
+			fi, err := os.Stat(path)
+			if err != nil || !fi.ModTime().After(modTime) {
+				continue
+			}
+			if err := f.load(path, defaultAction); err != nil {
+				//加载失败时等文件再次修改后重试
+				fmt.Println(err)
+				f.mutex.Lock()
+				f.modTime = fi.ModTime()
+				f.mutex.Unlock()
+			}
+		}
+	}
+}
+
+func (f *WordFilter) Close() {
+	close(f.quit)
+}
+
+func (f *WordFilter) Filter(p *Packet, v *FilterVerdict) {
+	f.mutex.RLock()
+	m := f.matcher
+	f.mutex.RUnlock()
+
+	text := []rune(string(p.Pl))
+	matches := m.match(text)
+	if len(matches) == 0 {
+		return
+	}
+
+	masked := false
+	original := append([]rune(nil), text...)
+	for _, match := range matches {
+		rule := m.rules[match.rule]
+		v.add(FilterHit{
+			Filter: f.Name(),
+			Word:   rule.Word,
+			Text:   string(original[match.start:match.end]),
+			Action: rule.Action,
+		})
+		if rule.Action == FILTER_ACTION_MASK {
+			maskRunes(text, match.start, match.end)
+			masked = true
+		}
+	}
+	if masked {
+		p.Pl = []byte(string(text))
+	}
+}
+
+//链接过滤，允许的域名及其子域名不过滤
+type LinkFilter struct {
+	mutex   sync.RWMutex
+	action  string
+	domains []string
+}
+
+func NewLinkFilter(config *FilterConfig) *LinkFilter {
+	f := &LinkFilter{action: config.LinkAction}
+	f.Reload(config)
+	return f
+}
+
+func (f *LinkFilter) Name() string {
+	return "link"
+}
+
+func (f *LinkFilter) Reload(config *FilterConfig) {
+	domains := []string{}
+	for _, d := range strings.Split(config.LinkAllowDomains, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	f.mutex.Lock()
+	f.domains = domains
+	f.mutex.Unlock()
+}
+
+func (f *LinkFilter) allowed(link string) bool {
+	host := strings.ToLower(link)
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?#:"); i >= 0 {
+		host = host[:i]
+	}
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	for _, d := range f.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *LinkFilter) Filter(p *Packet, v *FilterVerdict) {
+	text := string(p.Pl)
+	locs := FILTER_LINK_PATTERN.FindAllStringIndex(text, -1)
+	if len(locs) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range locs {
+		link := text[loc[0]:loc[1]]
+		if f.allowed(link) {
+			continue
+		}
+		v.add(FilterHit{Filter: f.Name(), Word: link, Text: link, Action: f.action})
+		if f.action == FILTER_ACTION_MASK {
+			b.WriteString(text[last:loc[0]])
+			b.WriteString(strings.Repeat(string(FILTER_MASK_RUNE), utf8.RuneCountInString(link)))
+			last = loc[1]
+		}
+	}
+	if last > 0 {
+		b.WriteString(text[last:])
+		p.Pl = []byte(b.String())
+	}
+}
+
+//审核记录，MESSAGE_TOPIC_FILTER_AUDIT中的消息内容(json)
+type FilterAudit struct {
+	Mt        int32       `json:"mt"`
+	ClientMid int64       `json:"client_mid"`
+	Sid       int64       `json:"sid"`
+	Rid       int64       `json:"rid"`
+	Action    string      `json:"action"` //最终的处理方式
+	Hits      []FilterHit `json:"hits"`
+	Pl        []byte      `json:"pl"` //过滤前的原始payload
+	Ct        int64       `json:"ct"`
+}
@@ -0,0 +1,198 @@
+package tcpserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWordMatcher(t *testing.T) {
+	tests := []struct {
+		name  string
+		words []string
+		text  string
+		want  []wordMatch //rule为words的下标
+	}{
+		{"no match", []string{"abc"}, "xyz", []wordMatch{}},
+		{"overlapping", []string{"he", "she", "his", "hers"}, "ushers", []wordMatch{{1, 1, 4}, {0, 2, 4}, {3, 2, 6}}},
+		{"fail link to suffix", []string{"abcd", "bc"}, "abcx", []wordMatch{{1, 1, 3}}},
+		{"fail link continues", []string{"abcd", "cde"}, "abcde", []wordMatch{{0, 0, 4}, {1, 2, 5}}},
+		{"repeated", []string{"aa"}, "aaa", []wordMatch{{0, 0, 2}, {0, 1, 3}}},
+		{"case folding", []string{"Hello"}, "say HeLLO", []wordMatch{{0, 4, 9}}},
+		{"multibyte", []string{"敏感词"}, "😀这是敏感词啊", []wordMatch{{0, 3, 6}}},
+		{"empty word ignored", []string{""}, "abc", []wordMatch{}},
+	}
+	for _, tt := range tests {
+		rules := []FilterRule{}
+		for _, w := range tt.words {
+			rules = append(rules, FilterRule{Word: w, Action: FILTER_ACTION_MASK})
+		}
+		got := newWordMatcher(rules).match([]rune(tt.text))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWordFilterMask(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []FilterRule
+		text   string
+		want   string   //过滤后的payload
+		hits   []string //命中的原文
+		action string
+	}{
+		{
+			name:   "multibyte offsets",
+			rules:  []FilterRule{{"敏感词", FILTER_ACTION_MASK}},
+			text:   "😀这是敏感词啊",
+			want:   "😀这是***啊",
+			hits:   []string{"敏感词"},
+			action: FILTER_ACTION_MASK,
+		},
+		{
+			name:   "case folding keeps original text",
+			rules:  []FilterRule{{"bad", FILTER_ACTION_MASK}},
+			text:   "so BaD",
+			want:   "so ***",
+			hits:   []string{"BaD"},
+			action: FILTER_ACTION_MASK,
+		},
+		{
+			name:   "overlap with review",
+			rules:  []FilterRule{{"ab", FILTER_ACTION_MASK}, {"bc", FILTER_ACTION_REVIEW}},
+			text:   "abc",
+			want:   "**c",
+			hits:   []string{"ab", "bc"},
+			action: FILTER_ACTION_MASK,
+		},
+		{
+			name:   "review only",
+			rules:  []FilterRule{{"meh", FILTER_ACTION_REVIEW}},
+			text:   "meh",
+			want:   "meh",
+			hits:   []string{"meh"},
+			action: FILTER_ACTION_REVIEW,
+		},
+		{
+			name:   "reject wins",
+			rules:  []FilterRule{{"bad", FILTER_ACTION_MASK}, {"worse", FILTER_ACTION_REJECT}},
+			text:   "bad worse",
+			want:   "*** worse",
+			hits:   []string{"bad", "worse"},
+			action: FILTER_ACTION_REJECT,
+		},
+	}
+	for _, tt := range tests {
+		f := &WordFilter{matcher: newWordMatcher(tt.rules)}
+		p := &Packet{Mt: MESSAGE_TYPE_P2P, Pl: []byte(tt.text)}
+		v := &FilterVerdict{}
+		f.Filter(p, v)
+
+		if string(p.Pl) != tt.want {
+			t.Errorf("%s: payload %q, want %q", tt.name, p.Pl, tt.want)
+		}
+		hits := []string{}
+		for _, hit := range v.Hits {
+			hits = append(hits, hit.Text)
+		}
+		if !reflect.DeepEqual(hits, tt.hits) {
+			t.Errorf("%s: hits %v, want %v", tt.name, hits, tt.hits)
+		}
+		if v.Action() != tt.action {
+			t.Errorf("%s: action %q, want %q", tt.name, v.Action(), tt.action)
+		}
+	}
+}
+
+func TestFilterVerdictAction(t *testing.T) {
+	tests := []struct {
+		actions []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{FILTER_ACTION_REVIEW}, FILTER_ACTION_REVIEW},
+		{[]string{FILTER_ACTION_REVIEW, FILTER_ACTION_MASK}, FILTER_ACTION_MASK},
+		{[]string{FILTER_ACTION_MASK, FILTER_ACTION_REVIEW}, FILTER_ACTION_MASK},
+		{[]string{FILTER_ACTION_MASK, FILTER_ACTION_REJECT, FILTER_ACTION_REVIEW}, FILTER_ACTION_REJECT},
+		{[]string{FILTER_ACTION_REVIEW, FILTER_ACTION_REJECT}, FILTER_ACTION_REJECT},
+	}
+	for _, tt := range tests {
+		v := &FilterVerdict{}
+		for _, action := range tt.actions {
+			v.add(FilterHit{Action: action})
+		}
+		if got := v.Action(); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.actions, got, tt.want)
+		}
+	}
+}
+
+func TestLoadFilterRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    []FilterRule
+		err     string //错误信息包含的内容，为空时不应该出错
+	}{
+		{
+			name:    "comments and default action",
+			content: "# 注释\n\nfoo\n  bar , reject \n",
+			want:    []FilterRule{{"foo", FILTER_ACTION_MASK}, {"bar", FILTER_ACTION_REJECT}},
+		},
+		{
+			name:    "comma in word",
+			content: "a,b,review\n",
+			want:    []FilterRule{{"a,b", FILTER_ACTION_REVIEW}},
+		},
+		{
+			name:    "unknown action",
+			content: "foo\nbar,block\n",
+			err:     ":2: invalid rule",
+		},
+		{
+			name:    "empty word",
+			content: ",mask\n",
+			err:     ":1: invalid rule",
+		},
+		{
+			name:    "empty action",
+			content: "foo,\n",
+			err:     ":1: invalid rule",
+		},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, strings.Repeat("w", i+1))
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := loadFilterRules(path, FILTER_ACTION_MASK)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(rules, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, rules, tt.want)
+		}
+	}
+
+	if _, err := loadFilterRules(filepath.Join(dir, "missing"), FILTER_ACTION_MASK); err == nil {
+		t.Error("missing file: expected error")
+	}
+}
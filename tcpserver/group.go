@@ -2,7 +2,8 @@ package tcpserver
 
 import (
 	"fmt"
-	"time"
+	"go/redisclient"
+	"os"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -16,34 +17,25 @@ var (
 )
 
 type RedisGroup struct {
-	pool *redis.Pool
+	pool *redisclient.Client
 }
 
-func NewRedisGroup(host string, pwd string, db int) *RedisGroup {
+func NewRedisGroup(config *redisclient.Config) *RedisGroup {
 	return &RedisGroup{
-		pool: &redis.Pool{
-			MaxIdle:     5,
-			IdleTimeout: 300 * time.Second,
-			// Other pool configuration not shown in this example.
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", host)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := c.Do("AUTH", pwd); err != nil {
-					c.Close()
-					return nil, err
-				}
-				if _, err := c.Do("SELECT", db); err != nil {
-					c.Close()
-					return nil, err
-				}
-				return c, nil
-			},
-		},
+		pool: NewRedisClient(config),
 	}
 }
 
+//根据配置创建redis客户端，配置错误或者集群不可用时退出
+func NewRedisClient(config *redisclient.Config) *redisclient.Client {
+	client, err := redisclient.New(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return client
+}
+
 func (g *RedisGroup) GetMembers(id int64) ([]int64, error) {
 	conn := g.pool.Get()
 	defer conn.Close()
@@ -63,3 +55,57 @@ func Int64s(reply interface{}, err error) ([]int64, error) {
 	}
 	return int64s, nil
 }
+
+var (
+	KEY_PREFIX_GROUP_MUTED = "group#muted#" //group#muted#gid，关闭群消息通知的成员set
+)
+
+//关闭或者打开群消息通知，关闭后只有被@时推送
+func (g *RedisGroup) SetMuted(id int64, uid int64, muted bool) error {
+	conn := g.pool.Get()
+	defer conn.Close()
+
+	cmd := "SREM"
+	if muted {
+		cmd = "SADD"
+	}
+	_, err := conn.Do(cmd, groupMutedKey(id), uid)
+	return err
+}
+
+func IsGroupMuted(conn redis.Conn, id int64, uid int64) (bool, error) {
+	return redis.Bool(conn.Do("SISMEMBER", groupMutedKey(id), uid))
+}
+
+func groupMutedKey(id int64) string {
+	return fmt.Sprintf("%s%d", KEY_PREFIX_GROUP_MUTED, id)
+}
+
+//按群成员过滤@列表，去掉不在群里的用户和重复的uid，返回过滤后的列表和是否@所有人
+func filterMentions(mentions []int64, members []int64) ([]int64, bool) {
+	if len(mentions) == 0 {
+		return nil, false
+	}
+
+	memberSet := make(map[int64]bool, len(members))
+	for _, member := range members {
+		memberSet[member] = true
+	}
+
+	all := false
+	valid := make([]int64, 0, len(mentions))
+	seen := make(map[int64]bool, len(mentions))
+	for _, uid := range mentions {
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		if uid == MENTION_ALL {
+			all = true
+			valid = append(valid, uid)
+		} else if memberSet[uid] {
+			valid = append(valid, uid)
+		}
+	}
+	return valid, all
+}
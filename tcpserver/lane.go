@@ -0,0 +1,119 @@
+package tcpserver
+
+//下发队列分为多个优先级通道，避免大量批量消息(聊天室、广播、离线同步)延迟控制消息导致客户端心跳超时
+//控制通道严格优先，聊天和批量通道按权重轮流取，批量消息不会被饿死
+//事件循环模式没有写goroutine，写不出去的数据按通道暂存，可写时按优先级合并写出
+type Lane int
+
+var (
+	LANE_CONTROL Lane = 0 //控制消息：鉴权和注册回执、pong、ack
+	LANE_CHAT    Lane = 1 //聊天消息和会话请求的回复
+	LANE_BULK    Lane = 2 //批量消息：聊天室、广播、离线消息同步
+	LANE_COUNT        = 3
+
+	LANE_QUEUE_SIZE = []int{256, 1024, 1024} //每个通道的队列长度
+	LANE_WEIGHTS    = []int{0, 8, 1}         //聊天和批量通道的权重，至少为1，控制通道严格优先不使用权重
+)
+
+//按消息类型选择默认通道
+func packetLane(p *Packet) Lane {
+	if isControlPacket(p) {
+		return LANE_CONTROL
+	}
+	switch p.Mt {
+	case MESSAGE_TYPE_ROOM, MESSAGE_TYPE_BROADCAST, MESSAGE_TYPE_OFFLINE_GAP:
+		return LANE_BULK
+	}
+	return LANE_CHAT
+}
+
+func validLane(lane Lane) Lane {
+	if lane < 0 || int(lane) >= LANE_COUNT {
+		return LANE_CHAT
+	}
+	return lane
+}
+
+//每个连接的下发队列，push可以并发调用，pop只在写goroutine中调用
+type laneQueue struct {
+	lanes   []chan *Packet
+	signal  chan struct{} //有新消息时通知写goroutine，容量为1
+	credits []int         //本轮剩余的权重额度
+}
+
+func newLaneQueue() *laneQueue {
+	q := &laneQueue{
+		lanes:   make([]chan *Packet, LANE_COUNT),
+		signal:  make(chan struct{}, 1),
+		credits: make([]int, LANE_COUNT),
+	}
+	for i := range q.lanes {
+		q.lanes[i] = make(chan *Packet, LANE_QUEUE_SIZE[i])
+	}
+	copy(q.credits, LANE_WEIGHTS)
+	return q
+}
+
+//入队，队列满时等待，quit关闭时放弃
+func (q *laneQueue) push(p *Packet, lane Lane, quit chan bool) bool {
+	select {
+	case q.lanes[lane] <- p:
+	case <-quit:
+		return false
+	}
+	q.notify()
+	return true
+}
+
+//非阻塞入队，队列满时返回false
+func (q *laneQueue) tryPush(p *Packet, lane Lane) bool {
+	select {
+	case q.lanes[lane] <- p:
+	default:
+		return false
+	}
+	q.notify()
+	return true
+}
+
+func (q *laneQueue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+//取下一个packet，没有时返回nil
+func (q *laneQueue) pop() *Packet {
+	select {
+	case p := <-q.lanes[LANE_CONTROL]:
+		return p
+	default:
+	}
+
+	//有消息的通道都用完额度时重新分配，最多两轮
+	for round := 0; round < 2; round++ {
+		for lane := LANE_CHAT; int(lane) < LANE_COUNT; lane++ {
+			if q.credits[lane] <= 0 {
+				continue
+			}
+			select {
+			case p := <-q.lanes[lane]:
+				q.credits[lane]--
+				return p
+			default:
+			}
+		}
+		copy(q.credits, LANE_WEIGHTS)
+	}
+	return nil
+}
+
+func (q *laneQueue) pending() bool {
+	for _, lane := range q.lanes {
+		if len(lane) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -9,7 +9,13 @@ import (
 )
 
 func main() {
-	config := tcpserver.NewDispatchConfig()
+	config, loader, err := tcpserver.LoadDispatchConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("config: %s\n", tcpserver.ConfigString(config))
+
 	d := tcpserver.NewDispatch(config)
 	defer func() {
 		d.Close()
@@ -20,6 +26,10 @@ func main() {
 		d.Run()
 	}()
 
+	// Reload handler.
+	go tcpserver.HandleReload(loader, config, func(c interface{}) {
+		d.Reload(c.(*tcpserver.DispatchConfig))
+	})
 	// Interrupt handler.
 	go func() {
 		c := make(chan os.Signal, 1)
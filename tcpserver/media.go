@@ -0,0 +1,629 @@
+package tcpserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/redisclient"
+	"hash/fnv"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//媒体文件服务，图片、语音、文件不放在消息payload中，客户端分片上传到media服务，消息只引用媒体id
+//上传: POST /v1/uploads 创建上传，PUT /v1/uploads/id 按X-Im-Offset逐个上传分片，中断后GET /v1/uploads/id 查询已上传的大小继续上传
+//上传使用业务服务生成的凭证(SignMediaToken)，请求头 Authorization: Bearer <token>
+//下载使用有时效的签名链接，GET /v1/media/id/url 生成，消息中只保存媒体id，打开时再获取链接
+//中断超过upload_ttl的上传和完成后超过orphan_ttl没有被消息引用的文件由后台清理
+//本地存储时分片按进程内的锁串行写入，只能部署一个media节点
+var (
+	MEDIA_PATH_UPLOADS  = "/v1/uploads"
+	MEDIA_PATH_MEDIA    = "/v1/media/"
+	MEDIA_HEADER_OFFSET = "X-Im-Offset" //分片在文件中的起始位置
+	MEDIA_URL_SUFFIX    = "/url"
+
+	MEDIA_ID_BYTES         = 16
+	MEDIA_REQUEST_MAX_SIZE = int64(4096) //创建上传请求body的最大字节数
+	MEDIA_CLEAN_BATCH      = 1000
+	MEDIA_LOCK_STRIPES     = 64
+	MEDIA_READ_TIMEOUT     = 60 * time.Second
+	MEDIA_WRITE_TIMEOUT    = 10 * time.Minute //下载大文件需要较长时间
+	MEDIA_CONTENT_TYPE     = "application/octet-stream"
+
+	//key使用{media}作为hash tag，集群模式下清理脚本涉及的集合和记录在同一个slot
+	KEY_PREFIX_MEDIA_UPLOAD = "{media}#upload#" //{media}#upload#id，hash，上传中的文件: uid size offset content_type name
+	KEY_PREFIX_MEDIA_INFO   = "{media}#info#"   //{media}#info#id，MediaInfo(json)
+	KEY_MEDIA_UPLOADS       = "{media}#uploads" //sorted set，上传中的id，score为最后写入时间(ms)
+	KEY_MEDIA_ORPHANS       = "{media}#orphans" //sorted set，上传完成还没有被消息引用的id，score为完成时间(ms)
+
+	//MediaResponse.Status
+	MEDIA_STATUS_INVALID   int64 = -1 //请求参数错误
+	MEDIA_STATUS_AUTH      int64 = -2 //凭证无效，或者不是自己的上传
+	MEDIA_STATUS_STORAGE   int64 = -3 //存储失败，可以重试
+	MEDIA_STATUS_OFFSET    int64 = -4 //分片位置和服务端不一致，按Offset继续上传
+	MEDIA_STATUS_NOT_FOUND int64 = -5 //上传或者媒体文件不存在
+)
+
+var (
+	ErrMediaToken = errors.New("media token invalid")
+)
+
+//上传完成的媒体文件，媒体消息的payload
+type MediaInfo struct {
+	Id          string `json:"id"`
+	Uid         int64  `json:"uid"` //上传者
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Name        string `json:"name"` //原始文件名，可以为空
+	Ct          int64  `json:"ct"`   //上传完成的时间 ms
+}
+
+//创建上传，POST /v1/uploads 的body
+type MediaUploadRequest struct {
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"` //为空时按application/octet-stream处理
+	Name        string `json:"name"`
+}
+
+//media服务的响应，和ApiResponse相同，按请求返回对应的字段
+type MediaResponse struct {
+	Status    int64
+	Msg       string
+	UploadId  string     `json:",omitempty"`
+	Offset    int64      `json:",omitempty"` //已经上传的字节数，下一个分片的起始位置
+	Size      int64      `json:",omitempty"`
+	ChunkSize int64      `json:",omitempty"` //每个分片的最大字节数
+	Media     *MediaInfo `json:",omitempty"` //上传完成时返回
+	Url       string     `json:",omitempty"` //下载链接
+	Expires   int64      `json:",omitempty"` //下载链接的过期时间，秒
+}
+
+type MediaSrv struct {
+	server *http.Server
+	pool   *redisclient.Client
+	store  MediaStore
+	config *MediaConfig
+	locks  []sync.Mutex //按id分段的锁，同一个上传的分片串行写入
+	quit   chan bool
+}
+
+func NewMediaSrv(config *MediaConfig) *MediaSrv {
+	store, err := NewMediaStore(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	s := &MediaSrv{
+		pool:   NewRedisClient(&config.Redis),
+		store:  store,
+		config: config,
+		locks:  make([]sync.Mutex, MEDIA_LOCK_STRIPES),
+		quit:   make(chan bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(MEDIA_PATH_UPLOADS, s.handleCreate)
+	mux.HandleFunc(MEDIA_PATH_UPLOADS+"/", s.handleUpload)
+	mux.HandleFunc(MEDIA_PATH_MEDIA, s.handleMedia)
+	s.server = &http.Server{
+		Addr:         config.HttpHost,
+		Handler:      mux,
+		ReadTimeout:  MEDIA_READ_TIMEOUT,
+		WriteTimeout: MEDIA_WRITE_TIMEOUT,
+	}
+	return s
+}
+
+func (s *MediaSrv) Serve() error {
+	return s.server.ListenAndServe()
+}
+
+//定时清理中断的上传和没有被引用的文件
+func (s *MediaSrv) Run() {
+	ticker := time.NewTicker(s.config.CleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.clean()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *MediaSrv) Close() {
+	close(s.quit)
+	s.server.Close()
+}
+
+//上传凭证: uid.过期时间(秒).签名，由业务服务登录后生成，和comet鉴权token一起下发给客户端
+func SignMediaToken(secret string, uid int64, expires int64) string {
+	payload := fmt.Sprintf("%d.%d", uid, expires)
+	return payload + "." + mediaSign(secret, payload)
+}
+
+//校验上传凭证，返回uid
+func VerifyMediaToken(secret string, token string, now time.Time) (int64, error) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 || !hmac.Equal([]byte(token[i+1:]), []byte(mediaSign(secret, token[:i]))) {
+		return 0, ErrMediaToken
+	}
+	var uid, expires int64
+	if _, err := fmt.Sscanf(token[:i], "%d.%d", &uid, &expires); err != nil || uid <= 0 {
+		return 0, ErrMediaToken
+	}
+	if expires < now.Unix() {
+		return 0, ErrMediaToken
+	}
+	return uid, nil
+}
+
+//下载链接的签名，和上传凭证使用不同的前缀，凭证不能当作下载签名使用
+func SignMediaUrl(secret string, id string, expires int64) string {
+	return mediaSign(secret, fmt.Sprintf("media.%s.%d", id, expires))
+}
+
+func mediaSign(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newMediaId() string {
+	return newResumeToken()
+}
+
+//id只能是newMediaId生成的hex字符串，避免拼接到存储路径中
+func validMediaId(id string) bool {
+	if len(id) != MEDIA_ID_BYTES*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func mediaUploadKey(id string) string {
+	return KEY_PREFIX_MEDIA_UPLOAD + id
+}
+
+func mediaInfoKey(id string) string {
+	return KEY_PREFIX_MEDIA_INFO + id
+}
+
+//消息引用媒体文件，文件存在时不再作为没有引用的文件清理，返回文件是否存在
+//先从待清理集合删除，清理时删除集合成员失败的文件不会被删除
+func ReferenceMedia(conn redis.Conn, id string) (bool, error) {
+	if !validMediaId(id) {
+		return false, nil
+	}
+	if _, err := conn.Do("ZREM", KEY_MEDIA_ORPHANS, id); err != nil {
+		return false, err
+	}
+	return redis.Bool(conn.Do("EXISTS", mediaInfoKey(id)))
+}
+
+func GetMediaInfo(conn redis.Conn, id string) (*MediaInfo, error) {
+	data, err := redis.Bytes(conn.Do("GET", mediaInfoKey(id)))
+	if err == redis.ErrNil {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := &MediaInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+//上传中的文件
+type mediaUpload struct {
+	Uid         int64  `redis:"uid"`
+	Size        int64  `redis:"size"`
+	Offset      int64  `redis:"offset"`
+	ContentType string `redis:"content_type"`
+	Name        string `redis:"name"`
+}
+
+func getMediaUpload(conn redis.Conn, id string) (*mediaUpload, error) {
+	values, err := redis.Values(conn.Do("HGETALL", mediaUploadKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrMediaNotFound
+	}
+	u := &mediaUpload{}
+	if err := redis.ScanStruct(values, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *MediaSrv) lock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+//返回凭证中的uid，无效时返回0
+func (s *MediaSrv) auth(r *http.Request) int64 {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return 0
+	}
+	uid, err := VerifyMediaToken(s.config.Secret, strings.TrimPrefix(header, "Bearer "), time.Now())
+	if err != nil {
+		return 0
+	}
+	return uid
+}
+
+//下载链接，没有配置public_url时使用请求的Host
+func (s *MediaSrv) downloadUrl(r *http.Request, id string) (string, int64) {
+	base := strings.TrimRight(s.config.PublicUrl, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	expires := time.Now().Add(s.config.UrlTtl).Unix()
+	return fmt.Sprintf("%s%s%s?expires=%d&sig=%s", base, MEDIA_PATH_MEDIA, id, expires, SignMediaUrl(s.config.Secret, id, expires)), expires
+}
+
+//POST /v1/uploads
+func (s *MediaSrv) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMediaResponse(w, http.StatusMethodNotAllowed, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "method not allowed"})
+		return
+	}
+	uid := s.auth(r)
+	if uid == 0 {
+		writeMediaResponse(w, http.StatusUnauthorized, &MediaResponse{Status: MEDIA_STATUS_AUTH, Msg: "auth failed"})
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MEDIA_REQUEST_MAX_SIZE))
+	if err != nil {
+		writeMediaResponse(w, http.StatusRequestEntityTooLarge, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "body too large"})
+		return
+	}
+	req := &MediaUploadRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeMediaResponse(w, http.StatusBadRequest, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "params decode err"})
+		return
+	}
+	if req.Size <= 0 || req.Size > s.config.MaxSize {
+		writeMediaResponse(w, http.StatusBadRequest, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: fmt.Sprintf("size must be in (0, %d]", s.config.MaxSize)})
+		return
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = MEDIA_CONTENT_TYPE
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		writeMediaResponse(w, http.StatusBadRequest, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "content_type invalid"})
+		return
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	id := newMediaId()
+	_, err = conn.Do("HMSET", mediaUploadKey(id), "uid", uid, "size", req.Size, "offset", 0, "content_type", contentType, "name", req.Name)
+	if err == nil {
+		_, err = conn.Do("ZADD", KEY_MEDIA_UPLOADS, nowMillis(), id)
+	}
+	if err != nil {
+		fmt.Printf("create media upload error: %s, uid=%d\n", err.Error(), uid)
+		writeMediaResponse(w, http.StatusServiceUnavailable, &MediaResponse{Status: MEDIA_STATUS_STORAGE, Msg: "create upload failed"})
+		return
+	}
+	writeMediaResponse(w, http.StatusOK, &MediaResponse{Status: 0, Msg: "ok", UploadId: id, Size: req.Size, ChunkSize: s.config.ChunkSize})
+}
+
+//GET /v1/uploads/id 查询上传进度，PUT /v1/uploads/id 上传分片
+func (s *MediaSrv) handleUpload(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, MEDIA_PATH_UPLOADS+"/")
+	if r.Method != "GET" && r.Method != "PUT" {
+		writeMediaResponse(w, http.StatusMethodNotAllowed, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "method not allowed"})
+		return
+	}
+	uid := s.auth(r)
+	if uid == 0 {
+		writeMediaResponse(w, http.StatusUnauthorized, &MediaResponse{Status: MEDIA_STATUS_AUTH, Msg: "auth failed"})
+		return
+	}
+	if !validMediaId(id) {
+		writeMediaResponse(w, http.StatusNotFound, &MediaResponse{Status: MEDIA_STATUS_NOT_FOUND, Msg: "upload not found"})
+		return
+	}
+
+	//分片先读到内存，持有锁时只写入存储，慢速网络不会阻塞同一分段的其他上传
+	var chunk []byte
+	if r.Method == "PUT" {
+		var err error
+		chunk, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.config.ChunkSize))
+		if err != nil {
+			writeMediaResponse(w, http.StatusRequestEntityTooLarge, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "read chunk failed or chunk too large"})
+			return
+		}
+	}
+
+	mutex := s.lock(id)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	u, err := getMediaUpload(conn, id)
+	if err == ErrMediaNotFound {
+		//已经完成的上传，完成时的响应丢失后客户端重试
+		if info, err := GetMediaInfo(conn, id); err == nil && info.Uid == uid {
+			s.writeCompleted(w, r, info)
+			return
+		}
+		writeMediaResponse(w, http.StatusNotFound, &MediaResponse{Status: MEDIA_STATUS_NOT_FOUND, Msg: "upload not found"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("get media upload error: %s, id=%s\n", err.Error(), id)
+		writeMediaResponse(w, http.StatusServiceUnavailable, &MediaResponse{Status: MEDIA_STATUS_STORAGE, Msg: "get upload failed"})
+		return
+	}
+	if u.Uid != uid {
+		writeMediaResponse(w, http.StatusForbidden, &MediaResponse{Status: MEDIA_STATUS_AUTH, Msg: "not your upload"})
+		return
+	}
+
+	progress := &MediaResponse{Status: 0, Msg: "ok", UploadId: id, Offset: u.Offset, Size: u.Size, ChunkSize: s.config.ChunkSize}
+	if r.Method == "GET" {
+		writeMediaResponse(w, http.StatusOK, progress)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(MEDIA_HEADER_OFFSET), 10, 64)
+	if err != nil || offset != u.Offset {
+		progress.Status, progress.Msg = MEDIA_STATUS_OFFSET, "offset mismatch"
+		writeMediaResponse(w, http.StatusConflict, progress)
+		return
+	}
+
+	if offset+int64(len(chunk)) > u.Size {
+		writeMediaResponse(w, http.StatusBadRequest, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "chunk exceeds size", UploadId: id, Offset: u.Offset})
+		return
+	}
+	size, err := s.store.Write(id, offset, bytes.NewReader(chunk))
+	if err != nil {
+		//写了一半的分片下次从offset重新写入
+		fmt.Printf("write media chunk error: %s, id=%s, offset=%d\n", err.Error(), id, offset)
+		writeMediaResponse(w, http.StatusServiceUnavailable, &MediaResponse{Status: MEDIA_STATUS_STORAGE, Msg: "write chunk failed", UploadId: id, Offset: u.Offset})
+		return
+	}
+
+	if size < u.Size {
+		_, err = conn.Do("HSET", mediaUploadKey(id), "offset", size)
+		if err == nil {
+			_, err = conn.Do("ZADD", KEY_MEDIA_UPLOADS, nowMillis(), id)
+		}
+		if err != nil {
+			fmt.Printf("update media upload error: %s, id=%s\n", err.Error(), id)
+			writeMediaResponse(w, http.StatusServiceUnavailable, &MediaResponse{Status: MEDIA_STATUS_STORAGE, Msg: "write chunk failed", UploadId: id, Offset: u.Offset})
+			return
+		}
+		progress.Offset = size
+		writeMediaResponse(w, http.StatusOK, progress)
+		return
+	}
+
+	info, err := s.complete(conn, id, u)
+	if err != nil {
+		fmt.Printf("complete media upload error: %s, id=%s\n", err.Error(), id)
+		writeMediaResponse(w, http.StatusServiceUnavailable, &MediaResponse{Status: MEDIA_STATUS_STORAGE, Msg: "complete upload failed", UploadId: id, Offset: u.Offset})
+		return
+	}
+	s.writeCompleted(w, r, info)
+}
+
+//上传完成，保存媒体信息后删除上传记录，失败时客户端按原来的offset重试最后一个分片
+func (s *MediaSrv) complete(conn redis.Conn, id string, u *mediaUpload) (*MediaInfo, error) {
+	if err := s.store.Commit(id); err != nil {
+		return nil, err
+	}
+	info := &MediaInfo{
+		Id:          id,
+		Uid:         u.Uid,
+		Size:        u.Size,
+		ContentType: u.ContentType,
+		Name:        u.Name,
+		Ct:          nowMillis(),
+	}
+	data, _ := json.Marshal(info)
+	if _, err := conn.Do("SET", mediaInfoKey(id), data); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Do("ZADD", KEY_MEDIA_ORPHANS, info.Ct, id); err != nil {
+		return nil, err
+	}
+	conn.Do("DEL", mediaUploadKey(id))
+	conn.Do("ZREM", KEY_MEDIA_UPLOADS, id)
+	return info, nil
+}
+
+func (s *MediaSrv) writeCompleted(w http.ResponseWriter, r *http.Request, info *MediaInfo) {
+	url, expires := s.downloadUrl(r, info.Id)
+	writeMediaResponse(w, http.StatusOK, &MediaResponse{Status: 0, Msg: "ok", UploadId: info.Id, Offset: info.Size, Size: info.Size, Media: info, Url: url, Expires: expires})
+}
+
+//GET /v1/media/id/url 生成下载链接，GET /v1/media/id?expires=&sig= 下载
+func (s *MediaSrv) handleMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeMediaResponse(w, http.StatusMethodNotAllowed, &MediaResponse{Status: MEDIA_STATUS_INVALID, Msg: "method not allowed"})
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, MEDIA_PATH_MEDIA)
+	if strings.HasSuffix(id, MEDIA_URL_SUFFIX) {
+		s.handleUrl(w, r, strings.TrimSuffix(id, MEDIA_URL_SUFFIX))
+		return
+	}
+	if !validMediaId(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	sig := r.URL.Query().Get("sig")
+	if err != nil || expires < time.Now().Unix() || !hmac.Equal([]byte(sig), []byte(SignMediaUrl(s.config.Secret, id, expires))) {
+		http.Error(w, "url expired or signature invalid", http.StatusForbidden)
+		return
+	}
+
+	conn := s.pool.Get()
+	info, err := GetMediaInfo(conn, id)
+	conn.Close()
+	if err == ErrMediaNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		fmt.Printf("get media info error: %s, id=%s\n", err.Error(), id)
+		http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, err := s.store.Open(id)
+	if err == ErrMediaNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		fmt.Printf("open media error: %s, id=%s\n", err.Error(), id)
+		http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", expires-time.Now().Unix()))
+	if info.Name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": info.Name}))
+	}
+	//支持Range，客户端可以断点下载
+	http.ServeContent(w, r, "", time.Unix(0, info.Ct*int64(time.Millisecond)), f)
+}
+
+//媒体id不可猜测，持有凭证的用户都可以获取下载链接，客户端从消息中取得id
+func (s *MediaSrv) handleUrl(w http.ResponseWriter, r *http.Request, id string) {
+	if s.auth(r) == 0 {
+		writeMediaResponse(w, http.StatusUnauthorized, &MediaResponse{Status: MEDIA_STATUS_AUTH, Msg: "auth failed"})
+		return
+	}
+	if !validMediaId(id) {
+		writeMediaResponse(w, http.StatusNotFound, &MediaResponse{Status: MEDIA_STATUS_NOT_FOUND, Msg: "media not found"})
+		return
+	}
+
+	conn := s.pool.Get()
+	info, err := GetMediaInfo(conn, id)
+	conn.Close()
+	if err == ErrMediaNotFound {
+		writeMediaResponse(w, http.StatusNotFound, &MediaResponse{Status: MEDIA_STATUS_NOT_FOUND, Msg: "media not found"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("get media info error: %s, id=%s\n", err.Error(), id)
+		writeMediaResponse(w, http.StatusServiceUnavailable, &MediaResponse{Status: MEDIA_STATUS_STORAGE, Msg: "get media failed"})
+		return
+	}
+	url, expires := s.downloadUrl(r, id)
+	writeMediaResponse(w, http.StatusOK, &MediaResponse{Status: 0, Msg: "ok", Media: info, Url: url, Expires: expires})
+}
+
+func writeMediaResponse(w http.ResponseWriter, code int, resp *MediaResponse) {
+	data, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+func (s *MediaSrv) clean() {
+	now := nowMillis()
+	uploads := s.cleanExpired(KEY_MEDIA_UPLOADS, now-int64(s.config.UploadTtl/time.Millisecond), now, mediaUploadKey)
+	orphans := s.cleanExpired(KEY_MEDIA_ORPHANS, now-int64(s.config.OrphanTtl/time.Millisecond), now, mediaInfoKey)
+	if uploads > 0 || orphans > 0 {
+		fmt.Printf("media cleaned: %d uploads, %d orphans\n", uploads, orphans)
+	}
+}
+
+var (
+	//KEYS: set key
+	//ARGV: id
+	//从集合删除成员的同时删除记录，ReferenceMedia在这之后不会再看到文件存在
+	cleanMediaScript = redis.NewScript(2, `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+return 1`)
+)
+
+//删除集合中score早于before的文件和记录，返回删除的数量
+//先原子地从集合删除成员和记录，删除成员失败(已经被消息引用)时保留文件
+//删除文件失败时以now放回集合，本轮不会再取到，过期时间之后再重试
+func (s *MediaSrv) cleanExpired(set string, before int64, now int64, key func(id string) string) int {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	total := 0
+	for {
+		ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", set, "-inf", before, "LIMIT", 0, MEDIA_CLEAN_BATCH))
+		if err != nil {
+			fmt.Printf("list expired media error: %s, set=%s\n", err.Error(), set)
+			return total
+		}
+		for _, id := range ids {
+			n, err := redis.Int(cleanMediaScript.Do(conn, set, key(id), id))
+			if err != nil {
+				//成员还在集合中，继续会反复取到同一批
+				fmt.Printf("remove expired media error: %s, set=%s\n", err.Error(), set)
+				return total
+			}
+			if n == 0 {
+				continue
+			}
+			if !validMediaId(id) {
+				continue
+			}
+			mutex := s.lock(id)
+			mutex.Lock()
+			err = s.store.Delete(id)
+			mutex.Unlock()
+			if err != nil {
+				fmt.Printf("delete media error: %s, id=%s\n", err.Error(), id)
+				conn.Do("ZADD", set, now, id)
+				continue
+			}
+			total++
+		}
+		if len(ids) < MEDIA_CLEAN_BATCH {
+			return total
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"go/tcpserver"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	config, _, err := tcpserver.LoadMediaConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("config: %s\n", tcpserver.ConfigString(config))
+
+	server := tcpserver.NewMediaSrv(config)
+	defer func() {
+		server.Close()
+	}()
+	errc := make(chan error)
+	go func() {
+		errc <- fmt.Errorf("%s", server.Serve())
+	}()
+	go func() {
+		server.Run()
+	}()
+	// Interrupt handler.
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errc <- fmt.Errorf("%s", <-c)
+	}()
+
+	fmt.Printf("exit: %v", <-errc)
+}
@@ -0,0 +1,121 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	MEDIA_STORAGE_LOCAL = "local" //保存在本地目录
+)
+
+var (
+	ErrMediaNotFound = errors.New("media not found")
+	ErrMediaOffset   = errors.New("media upload offset mismatch")
+)
+
+//读取媒体文件，下载时支持Range
+type MediaReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+//媒体文件的存储后端，上传中的文件和完成的文件按id区分
+type MediaStore interface {
+	//从offset开始写入分片，offset之后已有的数据(上次中断时写了一半的分片)被丢弃，返回写入后的文件大小
+	Write(id string, offset int64, r io.Reader) (int64, error)
+	//上传完成，文件不再修改，重复调用返回nil
+	Commit(id string) error
+	//打开已经完成的文件，不存在时返回ErrMediaNotFound
+	Open(id string) (MediaReader, error)
+	//删除上传中或者已经完成的文件，不存在时返回nil
+	Delete(id string) error
+}
+
+func NewMediaStore(config *MediaConfig) (MediaStore, error) {
+	switch config.Storage {
+	case MEDIA_STORAGE_LOCAL:
+		return NewLocalMediaStore(config.LocalDir)
+	}
+	return nil, fmt.Errorf("unknown media storage: %s", config.Storage)
+}
+
+//本地目录存储，上传中的文件在 dir/uploads/id，完成后移动到 dir/media/id前两位/id
+type LocalMediaStore struct {
+	dir string
+}
+
+func NewLocalMediaStore(dir string) (*LocalMediaStore, error) {
+	for _, sub := range []string{"uploads", "media"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalMediaStore{dir: dir}, nil
+}
+
+func (s *LocalMediaStore) uploadPath(id string) string {
+	return filepath.Join(s.dir, "uploads", id)
+}
+
+func (s *LocalMediaStore) mediaPath(id string) string {
+	return filepath.Join(s.dir, "media", id[:2], id)
+}
+
+func (s *LocalMediaStore) Write(id string, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.uploadPath(id), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < offset {
+		return info.Size(), ErrMediaOffset
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	return offset + n, err
+}
+
+func (s *LocalMediaStore) Commit(id string) error {
+	path := s.mediaPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(s.uploadPath(id), path)
+	if os.IsNotExist(err) {
+		if _, serr := os.Stat(path); serr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *LocalMediaStore) Open(id string) (MediaReader, error) {
+	f, err := os.Open(s.mediaPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrMediaNotFound
+	}
+	return f, err
+}
+
+func (s *LocalMediaStore) Delete(id string) error {
+	for _, path := range []string{s.uploadPath(id), s.mediaPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package tcpserver
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -9,6 +11,10 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+var (
+	ErrSaveMessage = errors.New("save message error")
+)
+
 type Message interface {
 	Save(p *Packet) bool                             //存储单条消息
 	Range(rid int64, mid int64, limit int) []*Packet //获取大于message id的limit条消息
@@ -28,7 +34,7 @@ func NewMysqlMessage(host string, user string, pwd string, database string, char
 		os.Exit(1)
 	}
 
-	stmt, err := db.Prepare("INSERT INTO `message` (`ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := db.Prepare("INSERT IGNORE INTO `message` (`ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct`, `expire_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -40,9 +46,28 @@ func NewMysqlMessage(host string, user string, pwd string, database string, char
 	}
 }
 
+//mid唯一，nsq重试时重复写入会被忽略
 func (mm *MysqlMessage) Save(p *Packet) bool {
 	//插入数据
-	_, err := mm.stmt.Exec(p.Ver, p.Mt, p.Mid, p.Sid, p.Rid, string(p.Ext), string(p.Pl), p.Ct)
+	_, err := mm.stmt.Exec(p.Ver, p.Mt, p.Mid, p.Sid, p.Rid, p.Ext, string(p.Pl), p.Ct, p.ExpireAt())
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	return true
+}
+
+//保存内容过滤命中记录，待审核的记录status为0
+func (mm *MysqlMessage) SaveFilterAudit(a *FilterAudit) bool {
+	hits, _ := json.Marshal(a.Hits)
+	status := 1
+	if a.Action == FILTER_ACTION_REVIEW {
+		status = 0
+	}
+
+	_, err := mm.db.Exec("INSERT INTO `filter_audit` (`mt`, `client_mid`, `sid`, `rid`, `action`, `hits`, `pl`, `status`, `ct`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.Mt, a.ClientMid, a.Sid, a.Rid, a.Action, string(hits), a.Pl, status, a.Ct)
 	if err != nil {
 		fmt.Println(err)
 		return false
@@ -53,19 +78,20 @@ func (mm *MysqlMessage) Save(p *Packet) bool {
 
 func (mm *MysqlMessage) SaveMulti(ps []*Packet) bool {
 	valueStrings := make([]string, 0, len(ps))
-	valueArgs := make([]interface{}, 0, len(ps)*8)
+	valueArgs := make([]interface{}, 0, len(ps)*9)
 	for _, p := range ps {
-		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?)")
+		valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?)")
 		valueArgs = append(valueArgs, p.Ver)
 		valueArgs = append(valueArgs, p.Mt)
 		valueArgs = append(valueArgs, p.Mid)
 		valueArgs = append(valueArgs, p.Sid)
 		valueArgs = append(valueArgs, p.Rid)
-		valueArgs = append(valueArgs, string(p.Ext))
+		valueArgs = append(valueArgs, p.Ext)
 		valueArgs = append(valueArgs, string(p.Pl))
 		valueArgs = append(valueArgs, p.Ct)
+		valueArgs = append(valueArgs, p.ExpireAt())
 	}
-	stmt := fmt.Sprintf("INSERT INTO `message` (`ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct`) VALUES %s", strings.Join(valueStrings, ","))
+	stmt := fmt.Sprintf("INSERT IGNORE INTO `message` (`ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct`, `expire_at`) VALUES %s", strings.Join(valueStrings, ","))
 	_, err := mm.db.Exec(stmt, valueArgs...)
 	if err != nil {
 		fmt.Println(err)
@@ -75,15 +101,46 @@ func (mm *MysqlMessage) SaveMulti(ps []*Packet) bool {
 	return true
 }
 
+//过期的消息即使还没有被清理也不返回
 func (mm *MysqlMessage) Range(rid int64, mid int64, limit int) []*Packet {
-	ps := []*Packet{}
-
-	rows, err := mm.db.Query("SELECT `ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct` FROM `message` WHERE `rid`=? AND `mid`>? ORDER BY mid DESC LIMIT ?", rid, mid, limit)
+	rows, err := mm.db.Query("SELECT `ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct` FROM `message` WHERE `rid`=? AND `mid`>? AND (`expire_at`=0 OR `expire_at`>?) ORDER BY mid DESC LIMIT ?", rid, mid, nowMillis(), limit)
 	if err != nil {
 		fmt.Println(err)
-		return ps
+		return []*Packet{}
 	}
+	return scanMessages(rows)
+}
 
+//接收者的一条消息，不存在时返回nil
+func (mm *MysqlMessage) Get(rid int64, mid int64) (*Packet, error) {
+	rows, err := mm.db.Query("SELECT `ver`, `mt`, `mid`, `sid`, `rid`, `ext`, `pl`, `ct` FROM `message` WHERE `rid`=? AND `mid`=?", rid, mid)
+	if err != nil {
+		return nil, err
+	}
+	ps := scanMessages(rows)
+	if len(ps) == 0 {
+		return nil, nil
+	}
+	return ps[0], nil
+}
+
+//删除接收者的一条消息，rid限制只能删除发给自己的消息
+func (mm *MysqlMessage) Delete(rid int64, mid int64) error {
+	_, err := mm.db.Exec("DELETE FROM `message` WHERE `rid`=? AND `mid`=?", rid, mid)
+	return err
+}
+
+//删除最多limit条已经过期的消息，返回删除的条数
+func (mm *MysqlMessage) PurgeExpired(now int64, limit int) (int64, error) {
+	res, err := mm.db.Exec("DELETE FROM `message` WHERE `expire_at`>0 AND `expire_at`<=? LIMIT ?", now, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scanMessages(rows *sql.Rows) []*Packet {
+	ps := []*Packet{}
 	for rows.Next() {
 		var ver int32
 		var mt int32
@@ -94,7 +151,7 @@ func (mm *MysqlMessage) Range(rid int64, mid int64, limit int) []*Packet {
 		var pl string
 		var ct int64
 
-		err = rows.Scan(&ver, &mt, &mid, &sid, &rid, &ext, &pl, &ct)
+		err := rows.Scan(&ver, &mt, &mid, &sid, &rid, &ext, &pl, &ct)
 		if err != nil {
 			fmt.Println(err)
 			continue
@@ -0,0 +1,234 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//离线消息按 用户+会话 存储在redis sorted set中，score为消息过期时间(ms)
+//用户所有有离线消息的会话记录在一个set中，超出保留策略被丢弃的消息数记录在一个hash中
+//key使用{uid}作为hash tag，集群模式下同一个用户的key在同一个slot
+var (
+	KEY_PREFIX_OFFLINE_MSGS  = "offline#msgs#"  //offline#msgs#{uid}#mt#cid
+	KEY_PREFIX_OFFLINE_CONVS = "offline#convs#" //offline#convs#{uid}
+	KEY_PREFIX_OFFLINE_GAPS  = "offline#gaps#"  //offline#gaps#{uid}
+
+	//升级前的离线消息list，上线时仍然读取一次
+	KEY_PREFIX_USER_OFFLINE_MSGS  = "user#offline#msgs#"
+	KEY_PREFIX_GROUP_OFFLINE_MSGS = "group#offline#msgs#"
+
+	OFFLINE_KEEP_NEWEST     = "newest"                  //超出条数时丢弃最早的消息
+	OFFLINE_KEEP_OLDEST     = "oldest"                  //超出条数时丢弃最新的消息
+	OFFLINE_MAX_AGE_FOREVER = 10 * 365 * 24 * time.Hour //max_age为0时使用的过期时间
+)
+
+//每种会话类型的离线消息保留策略
+type OfflineRetention struct {
+	MaxCount int           `yaml:"max_count"` //每个会话最多保留的条数，0表示不限制
+	MaxAge   time.Duration `yaml:"max_age"`   //最长保留时间，0表示不过期
+	Keep     string        `yaml:"keep"`      //超出条数时保留最新(newest)或者最早(oldest)的消息
+}
+
+func (r *OfflineRetention) Validate() error {
+	if r.MaxCount < 0 {
+		return fmt.Errorf("max_count must not be negative, got %d", r.MaxCount)
+	}
+	if r.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative, got %v", r.MaxAge)
+	}
+	if r.Keep != OFFLINE_KEEP_NEWEST && r.Keep != OFFLINE_KEEP_OLDEST {
+		return fmt.Errorf("keep must be %s or %s, got %s", OFFLINE_KEEP_NEWEST, OFFLINE_KEEP_OLDEST, r.Keep)
+	}
+	return nil
+}
+
+func (r *OfflineRetention) maxAge() time.Duration {
+	if r.MaxAge > 0 {
+		return r.MaxAge
+	}
+	return OFFLINE_MAX_AGE_FOREVER
+}
+
+//离线消息缺失通知，MESSAGE_TYPE_OFFLINE_GAP消息的payload
+//客户端收到后从消息存储补齐：Before > 0 时补齐FirstMid之前的消息，After > 0 时补齐LastMid之后的消息
+type OfflineGap struct {
+	Mt       int32 `json:"mt"`        //会话类型
+	Cid      int64 `json:"cid"`       //会话id，单聊为对方uid，群聊为群id
+	Before   int64 `json:"before"`    //早于FirstMid被丢弃的条数，-1表示条数未知
+	After    int64 `json:"after"`     //晚于LastMid被丢弃的条数
+	FirstMid int64 `json:"first_mid"` //本次下发的第一条离线消息，没有下发时为0
+	LastMid  int64 `json:"last_mid"`  //本次下发的最后一条离线消息，没有下发时为0
+}
+
+var (
+	//KEYS: msgs convs gaps
+	//ARGV: score member conv now max_count keep_oldest ttl
+	saveOfflineScript = redis.NewScript(3, `
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('SADD', KEYS[2], ARGV[3])
+local before = redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[4])
+local after = 0
+local max = tonumber(ARGV[5])
+if max > 0 then
+	local n = redis.call('ZCARD', KEYS[1])
+	if n > max then
+		if ARGV[6] == '1' then
+			after = redis.call('ZREMRANGEBYRANK', KEYS[1], max, -1)
+		else
+			before = before + redis.call('ZREMRANGEBYRANK', KEYS[1], 0, n - max - 1)
+		end
+	end
+end
+if before > 0 then
+	redis.call('HINCRBY', KEYS[3], ARGV[3], before)
+end
+if after > 0 then
+	redis.call('HINCRBY', KEYS[3], ARGV[3] .. '#after', after)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[7])
+return before + after`)
+
+	//KEYS: msgs convs gaps
+	//ARGV: conv now
+	popOfflineScript = redis.NewScript(3, `
+local before = redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[2])
+local msgs = redis.call('ZRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+before = before + tonumber(redis.call('HGET', KEYS[3], ARGV[1]) or 0)
+local after = tonumber(redis.call('HGET', KEYS[3], ARGV[1] .. '#after') or 0)
+redis.call('HDEL', KEYS[3], ARGV[1], ARGV[1] .. '#after')
+return {before, after, msgs}`)
+)
+
+func offlineMsgsKey(uid int64, conv string) string {
+	return fmt.Sprintf("%s{%d}#%s", KEY_PREFIX_OFFLINE_MSGS, uid, conv)
+}
+
+func offlineConvsKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_OFFLINE_CONVS, uid)
+}
+
+func offlineGapsKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_OFFLINE_GAPS, uid)
+}
+
+//会话标识 mt#cid
+func offlineConv(mt int32, cid int64) string {
+	return fmt.Sprintf("%d#%d", mt, cid)
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / 1000000
+}
+
+//按保留策略保存一条离线消息，p.Rid为接收者，p.Sid为会话id(单聊对方uid，群id)，返回本次被丢弃的条数
+func SaveOffline(conn redis.Conn, proto Protocol, p *Packet, r *OfflineRetention) (int64, error) {
+	conv := offlineConv(p.Mt, p.Sid)
+	maxAge := int64(r.maxAge() / time.Millisecond)
+	keepOldest := 0
+	if r.Keep == OFFLINE_KEEP_OLDEST {
+		keepOldest = 1
+	}
+
+	//同一个会话的max_age相同，按过期时间排序等同于按消息时间排序，同一毫秒内按序列化后的mid排序
+	return redis.Int64(saveOfflineScript.Do(conn, offlineMsgsKey(p.Rid, conv), offlineConvsKey(p.Rid), offlineGapsKey(p.Rid),
+		p.Ct+maxAge, proto.Serialize(p), conv, nowMillis(), r.MaxCount, keepOldest, maxAge))
+}
+
+//取出用户所有离线消息并删除，有消息被丢弃的会话在该会话的消息之前插入一条缺失通知
+func PopOffline(conn redis.Conn, proto Protocol, uid int64) ([]*Packet, error) {
+	convs, err := redis.Strings(conn.Do("SMEMBERS", offlineConvsKey(uid)))
+	if err != nil {
+		return nil, err
+	}
+
+	ps := []*Packet{}
+	for _, conv := range convs {
+		var mt int32
+		var cid int64
+		if _, err := fmt.Sscanf(conv, "%d#%d", &mt, &cid); err != nil {
+			conn.Do("SREM", offlineConvsKey(uid), conv)
+			continue
+		}
+
+		reply, err := redis.Values(popOfflineScript.Do(conn, offlineMsgsKey(uid, conv), offlineConvsKey(uid), offlineGapsKey(uid), conv, nowMillis()))
+		if err != nil {
+			return ps, err
+		}
+
+		if len(reply) != 3 {
+			return ps, fmt.Errorf("pop offline unexpected reply length %d", len(reply))
+		}
+		before, _ := redis.Int64(reply[0], nil)
+		after, _ := redis.Int64(reply[1], nil)
+		msgs, err := redis.ByteSlices(reply[2], nil)
+		if err != nil {
+			return ps, err
+		}
+
+		//有效期消息过期后直接丢弃，不计入缺失条数
+		now := nowMillis()
+		msgPs := make([]*Packet, 0, len(msgs))
+		for _, buf := range msgs {
+			if p, err := proto.Unserialize(buf); err == nil && !p.Expired(now) {
+				msgPs = append(msgPs, p)
+			}
+		}
+
+		//会话还在索引中但是消息已经整体过期，丢弃的条数未知
+		if len(msgs) == 0 && before == 0 && after == 0 {
+			before = -1
+		}
+
+		if before != 0 || after != 0 {
+			gap := OfflineGap{
+				Mt:     mt,
+				Cid:    cid,
+				Before: before,
+				After:  after,
+			}
+			if len(msgPs) > 0 {
+				gap.FirstMid = msgPs[0].Mid
+				gap.LastMid = msgPs[len(msgPs)-1].Mid
+			}
+			ps = append(ps, buildOfflineGap(uid, &gap))
+		}
+
+		ps = append(ps, msgPs...)
+	}
+
+	return ps, nil
+}
+
+func buildOfflineGap(uid int64, gap *OfflineGap) *Packet {
+	pl, _ := json.Marshal(gap)
+	return &Packet{
+		Ver: PROTO_VERSION,
+		Mt:  MESSAGE_TYPE_OFFLINE_GAP,
+		Sid: gap.Cid,
+		Rid: uid,
+		Ct:  nowMillis(),
+		Pl:  pl,
+	}
+}
+
+//读取升级前写入的离线消息list
+func popLegacyOffline(conn redis.Conn, proto Protocol, key string) []*Packet {
+	ps := []*Packet{}
+	for {
+		buf, err := redis.Bytes(conn.Do("LPOP", key))
+		if buf == nil || err != nil {
+			break
+		}
+
+		p, err := proto.Unserialize(buf)
+		if err == nil {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
@@ -1,12 +1,12 @@
 package tcpserver
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 var (
@@ -21,6 +21,22 @@ var (
 	MESSAGE_TYPE_ACK             int32 = 9  //消息ack回执
 	MESSAGE_TYPE_GROUP           int32 = 10 //群聊消息
 	MESSAGE_TYPE_ROOM            int32 = 11 //聊天室消息
+	MESSAGE_TYPE_OFFLINE_GAP     int32 = 12 //离线消息缺失通知，payload为OfflineGap
+	MESSAGE_TYPE_REJECT          int32 = 13 //消息被服务端拒绝，Mid为客户端消息序号，payload为ResponseInfo
+	MESSAGE_TYPE_CONV_SYNC       int32 = 14 //同步会话列表，payload为ConvSync
+	MESSAGE_TYPE_CONV_READ       int32 = 15 //会话已读回执，payload为ConvRead
+	MESSAGE_TYPE_CONV_LIST       int32 = 16 //会话列表，回复CONV_SYNC和CONV_READ，Mid为请求的Mid，payload为ConvList
+	MESSAGE_TYPE_BROADCAST       int32 = 17 //广播和系统通知，Mid为广播id
+	MESSAGE_TYPE_BURN_READ       int32 = 18 //阅后即焚消息已读，payload为ConvRead，Mid为已读的消息id
+
+	PROTO_VERSION int32 = 1 //服务端主动下发的消息使用的协议版本
+
+	//MESSAGE_TYPE_REJECT的ResponseInfo.Status，说明拒绝原因
+	REJECT_STATUS_FILTERED       int64 = -3 //内容过滤
+	REJECT_STATUS_BLOCKED        int64 = -4 //被接收者拉黑
+	REJECT_STATUS_FRIENDS_ONLY   int64 = -5 //接收者只接收好友消息
+	REJECT_STATUS_STRANGER_LIMIT int64 = -6 //给陌生人发送的消息超过限制
+	REJECT_STATUS_MEDIA_INVALID  int64 = -7 //引用的媒体文件不存在或者已经被清理
 )
 
 type Protocol interface {
@@ -30,6 +46,50 @@ type Protocol interface {
 	Unserialize(data []byte) (*Packet, error)
 }
 
+//可选接口，协议实现后合并写时直接编码到buf，避免Serialize的一次分配
+type packetAppender interface {
+	AppendPacket(buf []byte, p *Packet) []byte
+}
+
+//可选接口，事件循环模式从读缓冲区解析packet，返回消耗的字节数，数据不完整时返回0
+type packetDecoder interface {
+	DecodePacket(data []byte) (*Packet, int, error)
+}
+
+//从data开头解析一个带长度的packet，协议没有实现packetDecoder时按4字节长度加上Unserialize解析
+func decodeFramedPacket(proto Protocol, data []byte) (*Packet, int, error) {
+	if d, ok := proto.(packetDecoder); ok {
+		return d.DecodePacket(data)
+	}
+	if len(data) < PACKET_LENGTH_SIZE {
+		return nil, 0, nil
+	}
+	length := int(binary.BigEndian.Uint32(data))
+	if err := checkPacketLength(length); err != nil {
+		return nil, 0, err
+	}
+	if len(data)-PACKET_LENGTH_SIZE < length {
+		return nil, 0, nil
+	}
+	p, err := proto.Unserialize(data[PACKET_LENGTH_SIZE : PACKET_LENGTH_SIZE+length])
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, PACKET_LENGTH_SIZE + length, nil
+}
+
+//把带长度的packet追加到buf，用于合并写，协议没有实现packetAppender时使用Serialize加上4字节长度
+func appendPacket(proto Protocol, buf []byte, p *Packet) []byte {
+	if a, ok := proto.(packetAppender); ok {
+		return a.AppendPacket(buf, p)
+	}
+	data := proto.Serialize(p)
+	length := make([]byte, PACKET_LENGTH_SIZE)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	buf = append(buf, length...)
+	return append(buf, data...)
+}
+
 //消息结构体
 type Packet struct {
 	Ver int32  //协议版本号
@@ -42,40 +102,146 @@ type Packet struct {
 	Pl  []byte //内容payload
 }
 
+//单聊、群聊、聊天室消息
+func isChatPacket(p *Packet) bool {
+	return p.Mt == MESSAGE_TYPE_P2P || p.Mt == MESSAGE_TYPE_GROUP || p.Mt == MESSAGE_TYPE_ROOM
+}
+
 type CustomProto struct {
 }
 
+var (
+	PACKET_LENGTH_SIZE     = 4  //packet长度字段字节数
+	PACKET_HEADER_SIZE     = 48 //packet固定头部字节数 4 + 4 + 8 + 8 + 8 + 8 + 4 + 4
+	PACKET_POOL_BUFFER_MAX = 64 * 1024
+	PACKET_MAX_SIZE        = 4*1024*1024 + 64*1024 //packet最大字节数(不含长度字段)，超过时断开连接，避免客户端声明很大的长度让comet分配内存
+)
+
+var (
+	ErrPacketLength = errors.New("packet length invalid")
+)
+
+//长度字段不包含自己，小于固定头部或者超过最大长度都是非法的
+func checkPacketLength(length int) error {
+	if length < PACKET_HEADER_SIZE || length > PACKET_MAX_SIZE {
+		return ErrPacketLength
+	}
+	return nil
+}
+
+//编解码使用的缓冲池，避免每个packet重复分配内存
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+//从缓冲池获取长度为n的缓冲区
+func getBuffer(n int) *[]byte {
+	bp := bufferPool.Get().(*[]byte)
+	if cap(*bp) < n {
+		*bp = make([]byte, n)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
+
+//归还缓冲区，过大的缓冲区直接丢弃，避免缓冲池长期占用大块内存
+func putBuffer(bp *[]byte) {
+	if cap(*bp) > PACKET_POOL_BUFFER_MAX {
+		return
+	}
+	bufferPool.Put(bp)
+}
+
+//packet序列化后的字节数，不包含长度字段
+func PacketSize(p *Packet) int {
+	return PACKET_HEADER_SIZE + len(p.Ext) + len(p.Pl)
+}
+
+//把packet编码到buf，buf长度必须不小于PacketSize(p)，返回写入的字节数
+func encodePacket(buf []byte, p *Packet) int {
+	binary.BigEndian.PutUint32(buf[0:], uint32(p.Ver))
+	binary.BigEndian.PutUint32(buf[4:], uint32(p.Mt))
+	binary.BigEndian.PutUint64(buf[8:], uint64(p.Mid))
+	binary.BigEndian.PutUint64(buf[16:], uint64(p.Ct))
+	binary.BigEndian.PutUint64(buf[24:], uint64(p.Sid))
+	binary.BigEndian.PutUint64(buf[32:], uint64(p.Rid))
+	binary.BigEndian.PutUint32(buf[40:], uint32(len(p.Ext)))
+	binary.BigEndian.PutUint32(buf[44:], uint32(len(p.Pl)))
+	n := PACKET_HEADER_SIZE
+	n += copy(buf[n:], p.Ext)
+	n += copy(buf[n:], p.Pl)
+	return n
+}
+
+//从data解码packet，Ext和Pl直接引用data，不做拷贝
+func decodePacket(data []byte, p *Packet) error {
+	if len(data) < PACKET_HEADER_SIZE {
+		return errors.New("packet unserialize error")
+	}
+
+	p.Ver = int32(binary.BigEndian.Uint32(data[0:]))
+	p.Mt = int32(binary.BigEndian.Uint32(data[4:]))
+	p.Mid = int64(binary.BigEndian.Uint64(data[8:]))
+	p.Ct = int64(binary.BigEndian.Uint64(data[16:]))
+	p.Sid = int64(binary.BigEndian.Uint64(data[24:]))
+	p.Rid = int64(binary.BigEndian.Uint64(data[32:]))
+	extLength := int(int32(binary.BigEndian.Uint32(data[40:])))
+	plLength := int(int32(binary.BigEndian.Uint32(data[44:])))
+	if extLength < 0 || plLength < 0 || PACKET_HEADER_SIZE+extLength+plLength > len(data) {
+		return errors.New("packet unserialize error")
+	}
+
+	offset := PACKET_HEADER_SIZE
+	p.Ext = data[offset : offset+extLength : offset+extLength]
+	offset += extLength
+	p.Pl = data[offset : offset+plLength : offset+plLength]
+	return nil
+}
+
 func (proto *CustomProto) ReadPacket(conn net.Conn) (*Packet, error) {
 	//先读取单条数据长度 2^32
-	buf := make([]byte, 4)
-	_, err := io.ReadFull(conn, buf)
+	bp := getBuffer(PACKET_LENGTH_SIZE)
+	_, err := io.ReadFull(conn, *bp)
 	if err != nil {
+		putBuffer(bp)
 		fmt.Printf("read packet length error: %s\n", err.Error())
 		return nil, err
 	}
-	var length int32
-	buffer := bytes.NewBuffer(buf)
-	binary.Read(buffer, binary.BigEndian, &length)
+	length := int(binary.BigEndian.Uint32(*bp))
+	putBuffer(bp)
+	if err := checkPacketLength(length); err != nil {
+		fmt.Printf("read packet length invalid: %d\n", length)
+		return nil, err
+	}
 
-	//往后读取计算出长度字节
-	buf = make([]byte, length)
+	//往后读取计算出长度字节，packet的Ext和Pl直接引用这块内存
+	buf := make([]byte, length)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
 		fmt.Printf("read packet body error: %s\n", err.Error())
 		return nil, err
 	}
-	return proto.Unserialize(buf)
+
+	p := &Packet{}
+	if err := decodePacket(buf, p); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 func (proto *CustomProto) WritePacket(conn net.Conn, p *Packet) error {
-	buf := proto.Serialize(p)
-	length := len(buf)
-	buffer := new(bytes.Buffer)
+	size := PacketSize(p)
+	bp := getBuffer(PACKET_LENGTH_SIZE + size)
+	defer putBuffer(bp)
+
+	b := *bp
 	//写入长度
-	binary.Write(buffer, binary.BigEndian, int32(length))
-	buffer.Write(buf)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	encodePacket(b[PACKET_LENGTH_SIZE:], p)
 
-	b := buffer.Bytes()
 	n, err := conn.Write(b)
 	if err != nil {
 		fmt.Printf("socket write error: %s\n", err.Error())
@@ -90,69 +256,65 @@ func (proto *CustomProto) WritePacket(conn net.Conn, p *Packet) error {
 	return nil
 }
 
-func (proto *CustomProto) Serialize(p *Packet) []byte {
-	//写入消息总长度 4 + 4 + 8 + 8 + 8 + 4 + 4 + len(ext) + len(payload)
-	var extLength, plLength int32
-
-	extLength = int32(len(p.Ext))
-	plLength = int32(len(p.Pl))
-
-	buffer := new(bytes.Buffer)
-	//写入协议版本号
-	binary.Write(buffer, binary.BigEndian, p.Ver)
-	//写入消息类型
-	binary.Write(buffer, binary.BigEndian, p.Mt)
-	//写入消息id
-	binary.Write(buffer, binary.BigEndian, p.Mid)
-	//写入创建时间
-	binary.Write(buffer, binary.BigEndian, p.Ct)
-	//写入发送者id
-	binary.Write(buffer, binary.BigEndian, p.Sid)
-	//写入接收者id
-	binary.Write(buffer, binary.BigEndian, p.Rid)
-	//写入ext属性长度
-	binary.Write(buffer, binary.BigEndian, extLength)
-	//写入payload长度
-	binary.Write(buffer, binary.BigEndian, plLength)
-	buffer.Write(p.Ext)
-	buffer.Write(p.Pl)
-
-	buf := buffer.Bytes()
+//追加长度字段和packet到buf，返回追加后的切片
+func (proto *CustomProto) AppendPacket(buf []byte, p *Packet) []byte {
+	size := PacketSize(p)
+	n := len(buf)
+	if cap(buf)-n < PACKET_LENGTH_SIZE+size {
+		nbuf := make([]byte, n, 2*cap(buf)+PACKET_LENGTH_SIZE+size)
+		copy(nbuf, buf)
+		buf = nbuf
+	}
+	buf = buf[:n+PACKET_LENGTH_SIZE+size]
+	binary.BigEndian.PutUint32(buf[n:], uint32(size))
+	encodePacket(buf[n+PACKET_LENGTH_SIZE:], p)
+	return buf
+}
+
+//从data开头解析一个带长度的packet，数据不完整时返回0，packet不引用data
+func (proto *CustomProto) DecodePacket(data []byte) (*Packet, int, error) {
+	if len(data) < PACKET_LENGTH_SIZE {
+		return nil, 0, nil
+	}
+
+	length := int(binary.BigEndian.Uint32(data))
+	if err := checkPacketLength(length); err != nil {
+		return nil, 0, err
+	}
+
+	if len(data) < PACKET_LENGTH_SIZE+length {
+		return nil, 0, nil
+	}
+
+	p, err := proto.Unserialize(data[PACKET_LENGTH_SIZE : PACKET_LENGTH_SIZE+length])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return p, PACKET_LENGTH_SIZE + length, nil
+}
 
+//写入消息总长度 4 + 4 + 8 + 8 + 8 + 8 + 4 + 4 + len(ext) + len(payload)
+//返回的切片归调用方所有，只分配一次内存
+func (proto *CustomProto) Serialize(p *Packet) []byte {
+	buf := make([]byte, PacketSize(p))
+	encodePacket(buf, p)
 	return buf
 }
 
+//Ext和Pl会拷贝一份，调用方可以继续复用data
 func (proto *CustomProto) Unserialize(data []byte) (*Packet, error) {
-	//先读取单条数据长度 2^32
-	l := len(data)
-	if l < 48 {
-		return nil, errors.New("packet unserialize error")
-	}
-
-	p := Packet{}
-	buffer := bytes.NewBuffer(data)
-	//读取4字节协议版本号
-	binary.Read(buffer, binary.BigEndian, &p.Ver)
-	//读取4字节消息类型
-	binary.Read(buffer, binary.BigEndian, &p.Mt)
-	//读取8字节消息id
-	binary.Read(buffer, binary.BigEndian, &p.Mid)
-	//读取8字节创建时间
-	binary.Read(buffer, binary.BigEndian, &p.Ct)
-	//读取8字节发送者id
-	binary.Read(buffer, binary.BigEndian, &p.Sid)
-	//读取8字节接收者id
-	binary.Read(buffer, binary.BigEndian, &p.Rid)
-	var extLength, plLength int32
-	//读取4字节ext属性长度
-	binary.Read(buffer, binary.BigEndian, &extLength)
-	//读取4字节payload长度
-	binary.Read(buffer, binary.BigEndian, &plLength)
-
-	p.Ext = make([]byte, extLength)
-	p.Pl = make([]byte, plLength)
-	buffer.Read(p.Ext)
-	buffer.Read(p.Pl)
-
-	return &p, nil
+	p := &Packet{}
+	if err := decodePacket(data, p); err != nil {
+		return nil, err
+	}
+
+	//Ext和Pl放在同一块内存里，减少一次分配
+	body := make([]byte, len(p.Ext)+len(p.Pl))
+	n := copy(body, p.Ext)
+	copy(body[n:], p.Pl)
+	p.Ext = body[:n:n]
+	p.Pl = body[n:]
+
+	return p, nil
 }
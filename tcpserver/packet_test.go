@@ -0,0 +1,206 @@
+package tcpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+//改用预分配编码之前的实现，新的编码必须和它逐字节一致
+func legacySerialize(p *Packet) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, p.Ver)
+	binary.Write(buffer, binary.BigEndian, p.Mt)
+	binary.Write(buffer, binary.BigEndian, p.Mid)
+	binary.Write(buffer, binary.BigEndian, p.Ct)
+	binary.Write(buffer, binary.BigEndian, p.Sid)
+	binary.Write(buffer, binary.BigEndian, p.Rid)
+	binary.Write(buffer, binary.BigEndian, int32(len(p.Ext)))
+	binary.Write(buffer, binary.BigEndian, int32(len(p.Pl)))
+	buffer.Write(p.Ext)
+	buffer.Write(p.Pl)
+	return buffer.Bytes()
+}
+
+func legacyWritePacket(p *Packet) []byte {
+	buf := legacySerialize(p)
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int32(len(buf)))
+	buffer.Write(buf)
+	return buffer.Bytes()
+}
+
+var goldenPackets = []*Packet{
+	{},
+	{Ver: 1, Mt: MESSAGE_TYPE_P2P, Mid: 1234567890, Ct: 1700000000000, Sid: 10001, Rid: 10002, Ext: []byte("ext"), Pl: []byte("hello")},
+	{Ver: -1, Mt: math.MaxInt32, Mid: math.MinInt64, Ct: -1, Sid: math.MaxInt64, Rid: -10002, Pl: []byte("负数和边界值")},
+	{Ver: 2, Mt: MESSAGE_TYPE_GROUP, Mid: 1, Sid: 1, Rid: 2, Ext: bytes.Repeat([]byte{0xff}, 300)},
+	{Ver: 1, Mt: MESSAGE_TYPE_ROOM, Pl: bytes.Repeat([]byte("p"), 70*1024)},
+}
+
+//写入到内存buffer的连接
+type bufferConn struct {
+	net.Conn
+	buffer *bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buffer.Write(b)
+}
+
+func (c *bufferConn) Read(b []byte) (int, error) {
+	return c.buffer.Read(b)
+}
+
+func TestEncodePacketGolden(t *testing.T) {
+	proto := &CustomProto{}
+	for i, p := range goldenPackets {
+		want := legacySerialize(p)
+
+		buf := make([]byte, PacketSize(p))
+		if n := encodePacket(buf, p); n != len(want) || !bytes.Equal(buf, want) {
+			t.Fatalf("packet %d: encodePacket differs from legacy encoding", i)
+		}
+		if got := proto.Serialize(p); !bytes.Equal(got, want) {
+			t.Fatalf("packet %d: Serialize differs from legacy encoding", i)
+		}
+
+		framed := legacyWritePacket(p)
+		conn := &bufferConn{buffer: new(bytes.Buffer)}
+		if err := proto.WritePacket(conn, p); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(conn.buffer.Bytes(), framed) {
+			t.Fatalf("packet %d: WritePacket differs from legacy encoding", i)
+		}
+		if got := appendPacket(proto, []byte("x"), p); !bytes.Equal(got, append([]byte("x"), framed...)) {
+			t.Fatalf("packet %d: AppendPacket differs from legacy encoding", i)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	proto := &CustomProto{}
+	for i, p := range goldenPackets {
+		conn := &bufferConn{buffer: new(bytes.Buffer)}
+		proto.WritePacket(conn, p)
+		framed := append([]byte(nil), conn.buffer.Bytes()...)
+
+		got, err := proto.ReadPacket(conn)
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err.Error())
+		}
+		if !bytes.Equal(proto.Serialize(got), proto.Serialize(p)) {
+			t.Fatalf("packet %d: ReadPacket round trip mismatch", i)
+		}
+
+		got, n, err := proto.DecodePacket(framed)
+		if err != nil || n != len(framed) || !bytes.Equal(proto.Serialize(got), proto.Serialize(p)) {
+			t.Fatalf("packet %d: DecodePacket round trip mismatch, n=%d err=%v", i, n, err)
+		}
+		if _, n, _ := proto.DecodePacket(framed[:len(framed)-1]); n != 0 {
+			t.Fatalf("packet %d: DecodePacket consumed an incomplete frame", i)
+		}
+	}
+}
+
+//长度字段小于头部或者超过PACKET_MAX_SIZE时拒绝，不等待后面的数据
+func TestPacketLengthLimit(t *testing.T) {
+	proto := &CustomProto{}
+	for _, length := range []uint32{0, uint32(PACKET_HEADER_SIZE - 1), uint32(PACKET_MAX_SIZE + 1), math.MaxUint32} {
+		frame := make([]byte, PACKET_LENGTH_SIZE)
+		binary.BigEndian.PutUint32(frame, length)
+
+		if _, _, err := proto.DecodePacket(frame); err != ErrPacketLength {
+			t.Fatalf("DecodePacket length %d: got %v", length, err)
+		}
+		if _, _, err := decodeFramedPacket(struct{ Protocol }{proto}, frame); err != ErrPacketLength {
+			t.Fatalf("fallback decode length %d: got %v", length, err)
+		}
+		conn := &bufferConn{buffer: bytes.NewBuffer(frame)}
+		if _, err := proto.ReadPacket(conn); err != ErrPacketLength {
+			t.Fatalf("ReadPacket length %d: got %v", length, err)
+		}
+	}
+}
+
+//读取时循环返回同一段数据，写入直接丢弃
+type loopReadConn struct {
+	net.Conn
+	data   []byte
+	reader *bytes.Reader
+}
+
+func (c *loopReadConn) Read(b []byte) (int, error) {
+	if c.reader.Len() == 0 {
+		c.reader.Reset(c.data)
+	}
+	return c.reader.Read(b)
+}
+
+func (c *loopReadConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func benchPacket() *Packet {
+	return &Packet{
+		Ver: 1,
+		Mt:  MESSAGE_TYPE_P2P,
+		Mid: 1234567890,
+		Ct:  1700000000000,
+		Sid: 10001,
+		Rid: 10002,
+		Ext: bytes.Repeat([]byte("e"), 32),
+		Pl:  bytes.Repeat([]byte("p"), 256),
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	proto := &CustomProto{}
+	p := benchPacket()
+	b.ReportAllocs()
+	b.SetBytes(int64(PacketSize(p)))
+	for i := 0; i < b.N; i++ {
+		proto.Serialize(p)
+	}
+}
+
+func BenchmarkUnserialize(b *testing.B) {
+	proto := &CustomProto{}
+	data := proto.Serialize(benchPacket())
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := proto.Unserialize(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	proto := &CustomProto{}
+	data := appendPacket(proto, nil, benchPacket())
+	conn := &loopReadConn{data: data, reader: bytes.NewReader(data)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := proto.ReadPacket(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	proto := &CustomProto{}
+	p := benchPacket()
+	conn := &loopReadConn{}
+	b.ReportAllocs()
+	b.SetBytes(int64(PacketSize(p) + PACKET_LENGTH_SIZE))
+	for i := 0; i < b.N; i++ {
+		if err := proto.WritePacket(conn, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
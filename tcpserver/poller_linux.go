@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package tcpserver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+//基于epoll水平触发的poller
+type poller struct {
+	loop    *EventLoop
+	epfd    int
+	mutex   sync.RWMutex
+	conns   map[int]*loopConn
+	readBuf []byte
+}
+
+func newPoller(loop *EventLoop) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &poller{
+		loop:    loop,
+		epfd:    epfd,
+		conns:   make(map[int]*loopConn),
+		readBuf: make([]byte, EVENT_LOOP_READ_BUFFER),
+	}, nil
+}
+
+func (p *poller) add(lc *loopConn) error {
+	p.mutex.Lock()
+	p.conns[lc.fd] = lc
+	p.mutex.Unlock()
+
+	event := &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP,
+		Fd:     int32(lc.fd),
+	}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, lc.fd, event); err != nil {
+		p.mutex.Lock()
+		delete(p.conns, lc.fd)
+		p.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+//按连接状态更新监听的事件：暂停读取时不监听可读，有没写完的数据时监听可写，调用方需要持有lc.mutex
+func (p *poller) update(lc *loopConn) error {
+	event := &syscall.EpollEvent{
+		Fd: int32(lc.fd),
+	}
+	if atomic.LoadInt32(&lc.paused) == 0 {
+		event.Events |= syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	if lc.outOn {
+		event.Events |= syscall.EPOLLOUT
+	}
+
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, lc.fd, event)
+}
+
+//最后一次读到数据早于before的连接
+func (p *poller) idleConns(before int64) []*loopConn {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var idle []*loopConn
+	for _, lc := range p.conns {
+		if atomic.LoadInt64(&lc.lastRead) < before {
+			idle = append(idle, lc)
+		}
+	}
+	return idle
+}
+
+func (p *poller) remove(lc *loopConn) {
+	p.mutex.Lock()
+	if c, ok := p.conns[lc.fd]; ok && c == lc {
+		delete(p.conns, lc.fd)
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, lc.fd, nil)
+	}
+	p.mutex.Unlock()
+}
+
+func (p *poller) close() {
+	syscall.Close(p.epfd)
+}
+
+func (p *poller) run() {
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			fmt.Printf("epoll wait error: %s\n", err.Error())
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			p.mutex.RLock()
+			lc, ok := p.conns[fd]
+			p.mutex.RUnlock()
+			if !ok {
+				continue
+			}
+
+			ev := events[i].Events
+			if ev&syscall.EPOLLOUT != 0 {
+				if err := lc.onWrite(); err != nil {
+					p.closeConn(lc)
+					continue
+				}
+			}
+
+			if ev&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				p.handleRead(lc)
+			}
+		}
+	}
+}
+
+//读取所有可读数据，读到EOF或者出错时关闭连接
+func (p *poller) handleRead(lc *loopConn) {
+	for {
+		n, err := syscall.Read(lc.fd, p.readBuf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return
+		}
+		if err != nil || n == 0 {
+			p.closeConn(lc)
+			return
+		}
+
+		if err := lc.onRead(p.loop, p.readBuf[:n]); err != nil {
+			fmt.Printf("read packet error: %s\n", err.Error())
+			p.closeConn(lc)
+			return
+		}
+
+		if n < len(p.readBuf) {
+			return
+		}
+	}
+}
+
+//先停止监听，再交给worker关闭，保证已经解析的消息先处理完
+//poller和空闲检查可能同时关闭，只有从conns中删除的一方投递关闭任务
+func (p *poller) closeConn(lc *loopConn) {
+	p.mutex.Lock()
+	c, ok := p.conns[lc.fd]
+	removed := ok && c == lc
+	if removed {
+		delete(p.conns, lc.fd)
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, lc.fd, nil)
+	}
+	p.mutex.Unlock()
+
+	if removed {
+		p.loop.dispatchClose(lc)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+package tcpserver
+
+import "errors"
+
+//非linux平台不支持事件循环模式
+type poller struct {
+}
+
+func newPoller(loop *EventLoop) (*poller, error) {
+	return nil, errors.New("event loop only supported on linux")
+}
+
+func (p *poller) add(lc *loopConn) error {
+	return errors.New("event loop only supported on linux")
+}
+
+func (p *poller) update(lc *loopConn) error {
+	return nil
+}
+
+func (p *poller) idleConns(before int64) []*loopConn {
+	return nil
+}
+
+func (p *poller) closeConn(lc *loopConn) {
+}
+
+func (p *poller) remove(lc *loopConn) {
+}
+
+func (p *poller) close() {
+}
+
+func (p *poller) run() {
+}
@@ -2,43 +2,24 @@ package tcpserver
 
 import (
 	"fmt"
-	"time"
-
-	"github.com/garyburd/redigo/redis"
+	"go/redisclient"
 )
 
 //推送消息服务
 type PushSrv struct {
-	pool    *redis.Pool
+	pool    *redisclient.Client
 	sub     *Subscribe
 	outChan chan *Packet
 	quit    chan bool
+	badge   bool //推送时带上未读总数
 }
 
 func NewPushSrv(config *PushConfig) *PushSrv {
 	ps := &PushSrv{
 		outChan: make(chan *Packet, 1024),
 		quit:    make(chan bool),
-		pool: &redis.Pool{
-			MaxIdle:     5,
-			IdleTimeout: 300 * time.Second,
-			// Other pool configuration not shown in this example.
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", config.RedisHost)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := c.Do("AUTH", config.RedisPwd); err != nil {
-					c.Close()
-					return nil, err
-				}
-				if _, err := c.Do("SELECT", config.RedisDb); err != nil {
-					c.Close()
-					return nil, err
-				}
-				return c, nil
-			},
-		},
+		pool:    NewRedisClient(&config.Redis),
+		badge:   config.Badge,
 	}
 
 	ps.sub = NewSubscribe(&CustomProto{}, config.NsqdHost, MESSAGE_TOPIC_OFFLINE, MESSAGE_CHANNEL_OFFLINE_PUSH, ps.outChan)
@@ -68,17 +49,54 @@ func (ps *PushSrv) handle(p *Packet) {
 	case MESSAGE_TYPE_ROOM:
 		//聊天室消息
 		ps.handleRoom(p)
+	case MESSAGE_TYPE_REJECT:
+		//拒绝通知上线后从离线消息下发，不推送
 	default:
 		fmt.Printf("unknown message type: %d\n", p.Mt)
 	}
 }
 
 func (ps *PushSrv) handleP2p(p *Packet) {
-
+	fmt.Printf("push p2p message, rid=%d, badge=%d\n", p.Rid, ps.getBadge(p))
 }
 
+//接收者关闭了群消息通知时不推送，被@时仍然推送
 func (ps *PushSrv) handleGroup(p *Packet) {
+	mentioned := p.IsMentioned()
+	if !mentioned && ps.isMuted(p) {
+		return
+	}
+	fmt.Printf("push group message, rid=%d, badge=%d, mentioned=%v\n", p.Rid, ps.getBadge(p), mentioned)
+}
+
+//读取失败时按没有关闭通知处理，避免漏推
+func (ps *PushSrv) isMuted(p *Packet) bool {
+	conn := ps.pool.Get()
+	defer conn.Close()
+
+	muted, err := IsGroupMuted(conn, p.Sid, p.Rid)
+	if err != nil {
+		fmt.Printf("get group mute error: %s, gid=%d, rid=%d\n", err.Error(), p.Sid, p.Rid)
+		return false
+	}
+	return muted
+}
+
+//接收者的未读总数，没有开启或者读取失败时返回0，推送不带角标
+func (ps *PushSrv) getBadge(p *Packet) int64 {
+	if !ps.badge {
+		return 0
+	}
+
+	conn := ps.pool.Get()
+	defer conn.Close()
 
+	badge, err := ConversationBadge(conn, p)
+	if err != nil {
+		fmt.Printf("get badge error: %s, rid=%d\n", err.Error(), p.Rid)
+		return 0
+	}
+	return badge
 }
 
 func (ps *PushSrv) handleRoom(p *Packet) {
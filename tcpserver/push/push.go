@@ -9,7 +9,13 @@ import (
 )
 
 func main() {
-	config := tcpserver.NewPushConfig()
+	config, _, err := tcpserver.LoadPushConfig(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("config: %s\n", tcpserver.ConfigString(config))
+
 	d := tcpserver.NewPushSrv(config)
 	defer func() {
 		d.Close()
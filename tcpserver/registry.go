@@ -0,0 +1,183 @@
+package tcpserver
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+var (
+	CLIENT_REGISTRY_SHARDS = 64 //客户端映射表分片数量
+)
+
+type uidShard struct {
+	mutex   sync.RWMutex
+	clients map[int64]*Client
+}
+
+type dtShard struct {
+	mutex   sync.RWMutex
+	clients map[string]*Client
+}
+
+//分片的客户端映射表，按用户id和设备token查找客户端
+//每个分片独立加锁，查找只需要读锁
+type clientRegistry struct {
+	uidShards []*uidShard
+	dtShards  []*dtShard
+}
+
+func newClientRegistry(shards int) *clientRegistry {
+	if shards <= 0 {
+		shards = 1
+	}
+
+	r := &clientRegistry{
+		uidShards: make([]*uidShard, shards),
+		dtShards:  make([]*dtShard, shards),
+	}
+	for i := 0; i < shards; i++ {
+		r.uidShards[i] = &uidShard{clients: make(map[int64]*Client)}
+		r.dtShards[i] = &dtShard{clients: make(map[string]*Client)}
+	}
+
+	return r
+}
+
+func (r *clientRegistry) uidShard(uid int64) *uidShard {
+	return r.uidShards[uint64(uid)%uint64(len(r.uidShards))]
+}
+
+func (r *clientRegistry) dtShard(dt string) *dtShard {
+	h := fnv.New32a()
+	h.Write([]byte(dt))
+	return r.dtShards[h.Sum32()%uint32(len(r.dtShards))]
+}
+
+func (r *clientRegistry) GetByUid(uid int64) *Client {
+	shard := r.uidShard(uid)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	return shard.clients[uid]
+}
+
+func (r *clientRegistry) GetByDt(dt string) *Client {
+	shard := r.dtShard(dt)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	return shard.clients[dt]
+}
+
+//不存在时注册，返回是否注册成功
+func (r *clientRegistry) AddUid(uid int64, client *Client) bool {
+	shard := r.uidShard(uid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, ok := shard.clients[uid]; ok {
+		return false
+	}
+	shard.clients[uid] = client
+	return true
+}
+
+func (r *clientRegistry) AddDt(dt string, client *Client) bool {
+	shard := r.dtShard(dt)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, ok := shard.clients[dt]; ok {
+		return false
+	}
+	shard.clients[dt] = client
+	return true
+}
+
+//原子替换，返回被替换的老客户端，没有时返回nil
+func (r *clientRegistry) ReplaceUid(uid int64, client *Client) *Client {
+	shard := r.uidShard(uid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	old := shard.clients[uid]
+	shard.clients[uid] = client
+	return old
+}
+
+func (r *clientRegistry) ReplaceDt(dt string, client *Client) *Client {
+	shard := r.dtShard(dt)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	old := shard.clients[dt]
+	shard.clients[dt] = client
+	return old
+}
+
+//只有当前映射的还是client时才删除，避免老连接关闭时把重新登录的新连接删掉
+func (r *clientRegistry) RemoveUid(uid int64, client *Client) bool {
+	shard := r.uidShard(uid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if c, ok := shard.clients[uid]; ok && c == client {
+		delete(shard.clients, uid)
+		return true
+	}
+	return false
+}
+
+func (r *clientRegistry) RemoveDt(dt string, client *Client) bool {
+	shard := r.dtShard(dt)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if c, ok := shard.clients[dt]; ok && c == client {
+		delete(shard.clients, dt)
+		return true
+	}
+	return false
+}
+
+//在线用户数
+func (r *clientRegistry) CountUid() int {
+	n := 0
+	for _, shard := range r.uidShards {
+		shard.mutex.RLock()
+		n += len(shard.clients)
+		shard.mutex.RUnlock()
+	}
+	return n
+}
+
+//遍历所有登录的客户端，每个分片先复制再调用fn，fn中可以阻塞
+func (r *clientRegistry) EachUid(fn func(client *Client)) {
+	var clients []*Client
+	for _, shard := range r.uidShards {
+		clients = clients[:0]
+		shard.mutex.RLock()
+		for _, c := range shard.clients {
+			clients = append(clients, c)
+		}
+		shard.mutex.RUnlock()
+
+		for _, c := range clients {
+			fn(c)
+		}
+	}
+}
+
+func (r *clientRegistry) Clear() {
+	for _, shard := range r.uidShards {
+		shard.mutex.Lock()
+		shard.clients = make(map[int64]*Client)
+		shard.mutex.Unlock()
+	}
+
+	for _, shard := range r.dtShards {
+		shard.mutex.Lock()
+		shard.clients = make(map[string]*Client)
+		shard.mutex.Unlock()
+	}
+}
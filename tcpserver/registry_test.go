@@ -0,0 +1,143 @@
+package tcpserver
+
+import (
+	"sync"
+	"testing"
+)
+
+//go test -race ./tcpserver/ 检查并发访问
+func newTestClient(uid int64) *Client {
+	c := &Client{}
+	c.setUid(uid)
+	return c
+}
+
+//并发替换同一个uid，每个客户端只被替换出来一次，最后剩下的和所有被替换的合起来正好是全部客户端
+func TestRegistryConcurrentReplace(t *testing.T) {
+	r := newClientRegistry(8)
+	const n = 200
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = newTestClient(1)
+	}
+
+	olds := make([]*Client, n)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			olds[i] = r.ReplaceUid(1, clients[i])
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[*Client]int)
+	empty := 0
+	for _, old := range olds {
+		if old == nil {
+			empty++
+			continue
+		}
+		seen[old]++
+	}
+	seen[r.GetByUid(1)]++
+
+	if empty != 1 {
+		t.Fatalf("expected exactly one replace on empty slot, got %d", empty)
+	}
+	for _, c := range clients {
+		if seen[c] != 1 {
+			t.Fatalf("client seen %d times, want 1", seen[c])
+		}
+	}
+}
+
+//老连接关闭时不能删除已经替换进来的新连接
+func TestRegistryRemoveIfSame(t *testing.T) {
+	r := newClientRegistry(8)
+	old, cur := newTestClient(1), newTestClient(1)
+
+	r.ReplaceUid(1, old)
+	r.ReplaceUid(1, cur)
+	if r.RemoveUid(1, old) {
+		t.Fatal("removed a client that was already replaced")
+	}
+	if r.GetByUid(1) != cur {
+		t.Fatal("current client lost after removing the old one")
+	}
+	if !r.RemoveUid(1, cur) || r.GetByUid(1) != nil {
+		t.Fatal("current client not removed")
+	}
+
+	r.ReplaceDt("dt", old)
+	r.ReplaceDt("dt", cur)
+	if r.RemoveDt("dt", old) || r.GetByDt("dt") != cur {
+		t.Fatal("device token mapping removed by the old client")
+	}
+}
+
+//每个客户端替换后删除自己，不管怎么交错最后都不应该留下任何客户端
+func TestRegistryConcurrentReplaceRemove(t *testing.T) {
+	r := newClientRegistry(8)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(uid int64) {
+			defer wg.Done()
+			c := newTestClient(uid)
+			r.ReplaceUid(uid, c)
+			r.RemoveUid(uid, c)
+		}(int64(i % 10))
+	}
+	wg.Wait()
+
+	if n := r.CountUid(); n != 0 {
+		t.Fatalf("expected empty registry, got %d clients", n)
+	}
+}
+
+//遍历时其他uid并发变化，一直在线的客户端每个都正好访问一次，fn中可以访问映射表
+func TestRegistryEachUid(t *testing.T) {
+	r := newClientRegistry(8)
+	const stable = 100
+	for uid := int64(1); uid <= stable; uid++ {
+		r.AddUid(uid, newTestClient(uid))
+	}
+
+	quit := make(chan bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				uid := int64(1000 + g*100 + i%100)
+				c := newTestClient(uid)
+				r.ReplaceUid(uid, c)
+				r.RemoveUid(uid, c)
+			}
+		}(g)
+	}
+
+	for round := 0; round < 20; round++ {
+		visited := make(map[int64]int)
+		r.EachUid(func(c *Client) {
+			uid := c.Uid()
+			visited[uid]++
+			r.GetByUid(uid)
+		})
+		for uid := int64(1); uid <= stable; uid++ {
+			if visited[uid] != 1 {
+				t.Fatalf("uid %d visited %d times, want 1", uid, visited[uid])
+			}
+		}
+	}
+	close(quit)
+	wg.Wait()
+}
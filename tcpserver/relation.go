@@ -0,0 +1,320 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"go/redisclient"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//单聊关系检查，dispatch路由单聊消息之前检查接收者和发送者的关系
+//接收者拉黑了发送者、接收者只接收好友消息、陌生人在窗口内发送的消息超过限制时拒绝，通知发送者拒绝原因
+//key使用{uid}作为hash tag，同一个用户的关系在同一个slot，一次脚本调用取出
+var (
+	KEY_PREFIX_RELATION_BLOCK    = "relation#block#"    //relation#block#{uid}，uid拉黑的用户set
+	KEY_PREFIX_RELATION_FRIEND   = "relation#friend#"   //relation#friend#{uid}，uid的好友set
+	KEY_PREFIX_RELATION_PRIVACY  = "relation#privacy#"  //relation#privacy#{uid}，单聊隐私设置
+	KEY_PREFIX_RELATION_STRANGER = "relation#stranger#" //relation#stranger#{uid}#sid，sid在窗口内给uid发送的陌生人消息数量
+
+	RELATION_PRIVACY_ALL     = "all"     //接收所有人的消息，没有设置时的默认值
+	RELATION_PRIVACY_FRIENDS = "friends" //只接收好友的消息
+)
+
+var (
+	ErrRelationBlocked       = errors.New("message rejected, blocked by receiver")
+	ErrRelationFriendsOnly   = errors.New("message rejected, receiver only accepts friends")
+	ErrRelationStrangerLimit = errors.New("message rejected, too many messages to a stranger")
+)
+
+type RelationConfig struct {
+	Enable         bool          `yaml:"enable"`
+	CacheTtl       time.Duration `yaml:"cache_ttl"`       //本地缓存关系的时间，拉黑和隐私设置最多延迟这么久生效，0表示不缓存
+	CacheSize      int           `yaml:"cache_size"`      //本地缓存的用户对数量
+	StrangerLimit  int64         `yaml:"stranger_limit"`  //非好友在窗口内最多给同一个用户发送的消息数量，0表示不限制
+	StrangerWindow time.Duration `yaml:"stranger_window"` //陌生人消息计数的窗口，从第一条消息开始计算
+}
+
+func NewRelationConfig() RelationConfig {
+	return RelationConfig{
+		Enable:         false,
+		CacheTtl:       10 * time.Second,
+		CacheSize:      100000,
+		StrangerLimit:  0,
+		StrangerWindow: 24 * time.Hour,
+	}
+}
+
+func (c *RelationConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.CacheTtl < 0 {
+		return fmt.Errorf("relation cache_ttl must not be negative, got %v", c.CacheTtl)
+	}
+	if c.CacheTtl > 0 && c.CacheSize <= 0 {
+		return fmt.Errorf("relation cache_size must be positive, got %d", c.CacheSize)
+	}
+	if c.StrangerLimit < 0 {
+		return fmt.Errorf("relation stranger_limit must not be negative, got %d", c.StrangerLimit)
+	}
+	if c.StrangerLimit > 0 && c.StrangerWindow < time.Second {
+		return fmt.Errorf("relation stranger_window must be at least 1s, got %v", c.StrangerWindow)
+	}
+	return nil
+}
+
+//uid对peer的关系
+type RelationState struct {
+	Blocked bool   //uid拉黑了peer
+	Friend  bool   //peer是uid的好友
+	Privacy string //uid的单聊隐私设置
+}
+
+type Relation interface {
+	GetRelation(uid, peer int64) (*RelationState, error)
+	IncrStranger(uid, peer int64, window time.Duration) (int64, error) //peer给uid的陌生人消息计数加1，返回窗口内的数量
+}
+
+var (
+	//KEYS: block friend privacy
+	//ARGV: peer
+	getRelationScript = redis.NewScript(3, `
+return {redis.call('SISMEMBER', KEYS[1], ARGV[1]), redis.call('SISMEMBER', KEYS[2], ARGV[1]), redis.call('GET', KEYS[3]) or ''}`)
+
+	//KEYS: stranger
+	//ARGV: window
+	incrStrangerScript = redis.NewScript(1, `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n`)
+)
+
+type RedisRelation struct {
+	pool *redisclient.Client
+}
+
+func NewRedisRelation(pool *redisclient.Client) *RedisRelation {
+	return &RedisRelation{pool: pool}
+}
+
+func relationBlockKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_RELATION_BLOCK, uid)
+}
+
+func relationFriendKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_RELATION_FRIEND, uid)
+}
+
+func relationPrivacyKey(uid int64) string {
+	return fmt.Sprintf("%s{%d}", KEY_PREFIX_RELATION_PRIVACY, uid)
+}
+
+func relationStrangerKey(uid, peer int64) string {
+	return fmt.Sprintf("%s{%d}#%d", KEY_PREFIX_RELATION_STRANGER, uid, peer)
+}
+
+func (r *RedisRelation) GetRelation(uid, peer int64) (*RelationState, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(getRelationScript.Do(conn, relationBlockKey(uid), relationFriendKey(uid), relationPrivacyKey(uid), peer))
+	if err != nil {
+		return nil, err
+	}
+	var blocked, friend int64
+	var privacy string
+	if _, err := redis.Scan(values, &blocked, &friend, &privacy); err != nil {
+		return nil, err
+	}
+	if privacy == "" {
+		privacy = RELATION_PRIVACY_ALL
+	}
+	return &RelationState{Blocked: blocked == 1, Friend: friend == 1, Privacy: privacy}, nil
+}
+
+func (r *RedisRelation) IncrStranger(uid, peer int64, window time.Duration) (int64, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	return redis.Int64(incrStrangerScript.Do(conn, relationStrangerKey(uid, peer), int64(window/time.Millisecond)))
+}
+
+//以下由业务服务调用，维护拉黑、好友和隐私设置
+
+func (r *RedisRelation) Block(uid, peer int64) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", relationBlockKey(uid), peer)
+	return err
+}
+
+func (r *RedisRelation) Unblock(uid, peer int64) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SREM", relationBlockKey(uid), peer)
+	return err
+}
+
+//好友关系是双向的，两个用户的key不在同一个slot，分两次写入
+func (r *RedisRelation) AddFriend(uid, peer int64) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SADD", relationFriendKey(uid), peer); err != nil {
+		return err
+	}
+	_, err := conn.Do("SADD", relationFriendKey(peer), uid)
+	return err
+}
+
+func (r *RedisRelation) RemoveFriend(uid, peer int64) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SREM", relationFriendKey(uid), peer); err != nil {
+		return err
+	}
+	_, err := conn.Do("SREM", relationFriendKey(peer), uid)
+	return err
+}
+
+func (r *RedisRelation) SetPrivacy(uid int64, privacy string) error {
+	if privacy != RELATION_PRIVACY_ALL && privacy != RELATION_PRIVACY_FRIENDS {
+		return fmt.Errorf("relation privacy must be %s or %s, got %q", RELATION_PRIVACY_ALL, RELATION_PRIVACY_FRIENDS, privacy)
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", relationPrivacyKey(uid), privacy)
+	return err
+}
+
+type relationEntry struct {
+	state  *RelationState
+	expire time.Time
+}
+
+//本地缓存接收者对发送者的关系，按 接收者+发送者 缓存
+type relationCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[[2]int64]relationEntry
+}
+
+func newRelationCache(ttl time.Duration, size int) *relationCache {
+	return &relationCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[[2]int64]relationEntry),
+	}
+}
+
+func (c *relationCache) get(uid, peer int64) (*RelationState, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[[2]int64{uid, peer}]
+	if !ok || time.Now().After(e.expire) {
+		return nil, false
+	}
+	return e.state, true
+}
+
+func (c *relationCache) set(uid, peer int64, state *RelationState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		//先清理过期的，仍然超过上限时随机淘汰到上限的90%
+		for k, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size*9/10 {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[[2]int64{uid, peer}] = relationEntry{state: state, expire: now.Add(c.ttl)}
+}
+
+//dispatch使用的关系检查
+type relationChecker struct {
+	provider       Relation
+	cache          *relationCache //cache_ttl为0时为nil
+	strangerLimit  int64
+	strangerWindow time.Duration
+}
+
+func newRelationChecker(provider Relation, config *RelationConfig) *relationChecker {
+	c := &relationChecker{
+		provider:       provider,
+		strangerLimit:  config.StrangerLimit,
+		strangerWindow: config.StrangerWindow,
+	}
+	if config.CacheTtl > 0 {
+		c.cache = newRelationCache(config.CacheTtl, config.CacheSize)
+	}
+	return c
+}
+
+func (c *relationChecker) relation(uid, peer int64) (*RelationState, error) {
+	if c.cache != nil {
+		if state, ok := c.cache.get(uid, peer); ok {
+			return state, nil
+		}
+	}
+	state, err := c.provider.GetRelation(uid, peer)
+	if err != nil {
+		return nil, err
+	}
+	if c.cache != nil {
+		c.cache.set(uid, peer, state)
+	}
+	return state, nil
+}
+
+//sid给rid发送单聊消息，被拒绝时返回ErrRelation开头的错误，读取关系失败时返回redis错误
+func (c *relationChecker) check(sid, rid int64) error {
+	if sid == rid {
+		return nil
+	}
+
+	state, err := c.relation(rid, sid)
+	if err != nil {
+		return err
+	}
+	if state.Blocked {
+		return ErrRelationBlocked
+	}
+	if state.Friend {
+		return nil
+	}
+	if state.Privacy == RELATION_PRIVACY_FRIENDS {
+		return ErrRelationFriendsOnly
+	}
+
+	if c.strangerLimit > 0 {
+		n, err := c.provider.IncrStranger(rid, sid, c.strangerWindow)
+		if err != nil {
+			return err
+		}
+		if n > c.strangerLimit {
+			return ErrRelationStrangerLimit
+		}
+	}
+	return nil
+}
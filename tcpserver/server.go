@@ -1,61 +1,103 @@
 package tcpserver
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"go/redisclient"
 	"net"
+	"os"
 	"runtime"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/garyburd/redigo/redis"
 )
 
 type TCPServer struct {
-	address    string
-	quit       chan bool
-	sub        *Subscribe //订阅消息
-	protocol   Protocol   //消息解析协议
-	mutex      sync.Mutex
-	uidClients map[int64]*Client  //用户id对应客户端映射表
-	dtClients  map[string]*Client //设备token对应客户端映射表
-	inChan     chan *Packet       //客户端写入到服务器
-	outChan    chan *Packet       //服务器下发到客户端
-	pool       *redis.Pool
+	address  string       //明文监听地址，为空时只监听TLS
+	tlsHost  string       //TLS监听地址，为空时不开启
+	tls      *tlsReloader //TLS证书，没有开启TLS时为nil
+	quit     chan bool
+	sub      *Subscribe      //订阅消息
+	bcastSub *Subscribe      //订阅广播，每个节点一个临时channel
+	protocol Protocol        //消息解析协议
+	clients  *clientRegistry //用户id和设备token对应客户端映射表
+	inChan   chan *Packet    //客户端写入到服务器
+	outChan  chan *Packet    //服务器下发到客户端
+	pool     *redisclient.Client
+
+	writeFlushSize    int64 //单个连接合并写的最大字节数，可以热加载
+	writeFlushLatency int64 //合并写最多等待的时间，纳秒，可以热加载
+
+	loop      *EventLoop //事件循环模式，为nil时每个连接使用独立的读写goroutine
+	connCount int64      //当前连接数
+	tracer    *Tracer    //消息链路追踪，没有开启时为nil
+
+	caps              uint32 //可以和客户端协商的能力
+	compressThreshold int
+	signKey           ed25519.PrivateKey //对密钥交换签名，为nil时不签名
+
+	resumeTtl   time.Duration //断线后保留会话状态的时间，为0时不下发恢复token
+	idleTimeout time.Duration //没有收到数据的最长时间，为0时不检查
 }
 
 func NewTCPServer(config *CometConfig) *TCPServer {
 	server := &TCPServer{
-		address:    config.TcpHost,
-		quit:       make(chan bool),
-		protocol:   &CustomProto{},
-		uidClients: make(map[int64]*Client),
-		dtClients:  make(map[string]*Client),
-		inChan:     make(chan *Packet, 1024),
-		outChan:    make(chan *Packet, 1024),
-		pool: &redis.Pool{
-			MaxIdle:     5,
-			IdleTimeout: 300 * time.Second,
-			// Other pool configuration not shown in this example.
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", config.RedisHost)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := c.Do("AUTH", config.RedisPwd); err != nil {
-					c.Close()
-					return nil, err
-				}
-				if _, err := c.Do("SELECT", config.RedisDb); err != nil {
-					c.Close()
-					return nil, err
-				}
-				return c, nil
-			},
-		},
+		address:           config.TcpHost,
+		tlsHost:           config.Tls.Host,
+		quit:              make(chan bool),
+		protocol:          &CustomProto{},
+		clients:           newClientRegistry(CLIENT_REGISTRY_SHARDS),
+		inChan:            make(chan *Packet, 1024),
+		outChan:           make(chan *Packet, 1024),
+		pool:              NewRedisClient(&config.Redis),
+		writeFlushSize:    int64(config.WriteFlushSize),
+		writeFlushLatency: int64(config.WriteFlushLatency),
+		compressThreshold: config.CompressThreshold,
+		resumeTtl:         config.ResumeTtl,
+		idleTimeout:       config.IdleTimeout,
+	}
+	if config.CompressThreshold > 0 {
+		server.caps |= CAP_DEFLATE
+	}
+	if config.Encrypt {
+		server.caps |= CAP_AES_GCM
+	}
+	if config.EncryptSignKey != "" {
+		key, err := ParseSignKey(config.EncryptSignKey)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		server.signKey = key
 	}
 
-	server.sub = NewSubscribe(server.protocol, config.NsqdHost, MESSAGE_TOPIC_DISPATCH, MESSAGE_CHANNEL_DISPATCH_IM, server.outChan)
+	server.tracer = NewTracer("comet", server.pool, &config.Trace)
+
+	if server.tlsHost != "" {
+		r, err := newTlsReloader(&config.Tls)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		server.tls = r
+	}
+
+	if config.EventLoop {
+		loop, err := NewEventLoop(server, config.EventLoopPollers, config.EventLoopWorkers, config.IdleTimeout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		server.loop = loop
+	}
+
+	//没有配置nsqd时只作为单机tcp服务运行，用于压测
+	if config.NsqdHost != "" {
+		server.sub = NewSubscribe(server.protocol, config.NsqdHost, MESSAGE_TOPIC_DISPATCH, MESSAGE_CHANNEL_DISPATCH_IM, server.outChan)
+		server.bcastSub = NewSubscribeBody(config.NsqdHost, MESSAGE_TOPIC_BROADCAST, broadcastChannel(), server.handleBroadcast)
+	}
 
 	go server.inLoop()
 	go server.outLoop()
@@ -64,85 +106,123 @@ func NewTCPServer(config *CometConfig) *TCPServer {
 }
 
 func (server *TCPServer) GetClientByUid(uid int64) *Client {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	if client, ok := server.uidClients[uid]; ok {
-		return client
-	}
-
-	return nil
+	return server.clients.GetByUid(uid)
 }
 
 func (server *TCPServer) GetClientByDt(dt string) *Client {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	if client, ok := server.dtClients[dt]; ok {
-		return client
-	}
-
-	return nil
+	return server.clients.GetByDt(dt)
 }
 
+//不存在时注册
 func (server *TCPServer) RegisterClientByUid(client *Client, uid int64) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-
-	if _, ok := server.uidClients[uid]; !ok {
-		server.uidClients[uid] = client
-	}
+	server.clients.AddUid(uid, client)
 }
 
 func (server *TCPServer) RegisterClientByDt(client *Client, dt string) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
+	server.clients.AddDt(dt, client)
+}
 
-	if _, ok := server.dtClients[dt]; !ok {
-		server.dtClients[dt] = client
-	}
+//注册并替换老的客户端，返回被替换的客户端，调用方负责关闭
+func (server *TCPServer) ReplaceClientByUid(client *Client, uid int64) *Client {
+	return server.clients.ReplaceUid(uid, client)
 }
 
-func (server *TCPServer) UnRegisterClient(uid int64, dt string) {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
+func (server *TCPServer) ReplaceClientByDt(client *Client, dt string) *Client {
+	return server.clients.ReplaceDt(dt, client)
+}
 
-	if _, ok := server.uidClients[uid]; ok {
-		delete(server.uidClients, uid)
+//注销客户端，映射表里已经是新客户端时不删除
+func (server *TCPServer) UnRegisterClient(client *Client) {
+	if uid := client.Uid(); uid != 0 {
+		server.clients.RemoveUid(uid, client)
 	}
 
-	if _, ok := server.dtClients[dt]; ok {
-		delete(server.dtClients, dt)
+	if dt := client.DeviceToken(); dt != "" {
+		server.clients.RemoveDt(dt, client)
 	}
 }
 
 func (server *TCPServer) Close() {
-	server.mutex.Lock()
-	defer server.mutex.Unlock()
-	for k, _ := range server.uidClients {
-		delete(server.uidClients, k)
-	}
-
-	for k, _ := range server.dtClients {
-		delete(server.dtClients, k)
-	}
+	server.clients.Clear()
 
 	server.quit <- true
 	close(server.quit)
 	close(server.inChan)
 	close(server.outChan)
-	server.sub.Close()
+	if server.sub != nil {
+		server.sub.Close()
+		server.bcastSub.Close()
+	}
+	if server.loop != nil {
+		server.loop.Close()
+	}
+	if server.tls != nil {
+		server.tls.close()
+	}
 }
 
+//热加载配置，只更新可以安全修改的配置，新的连接生效
+func (server *TCPServer) Reload(config *CometConfig) {
+	atomic.StoreInt64(&server.writeFlushSize, int64(config.WriteFlushSize))
+	atomic.StoreInt64(&server.writeFlushLatency, int64(config.WriteFlushLatency))
+	if server.tls != nil {
+		server.tls.reload(&config.Tls)
+	}
+}
+
+//当前登录的用户数
+func (server *TCPServer) OnlineCount() int {
+	return server.clients.CountUid()
+}
+
+//当前连接数
+func (server *TCPServer) ConnCount() int64 {
+	return atomic.LoadInt64(&server.connCount)
+}
+
+func (server *TCPServer) connDone() {
+	atomic.AddInt64(&server.connCount, -1)
+}
+
+//开启明文和TLS监听，任意一个监听退出时返回
 func (server *TCPServer) Serve() error {
-	listener, err := net.Listen("tcp", server.address)
-	if err != nil {
-		fmt.Printf("error listen tcp: %s, error: %s\n", server.address, err.Error())
-		return err
+	listeners := []net.Listener{}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	if server.address != "" {
+		listener, err := net.Listen("tcp", server.address)
+		if err != nil {
+			fmt.Printf("error listen tcp: %s, error: %s\n", server.address, err.Error())
+			return err
+		}
+		fmt.Printf("listen tcp: %s\n", server.address)
+		listeners = append(listeners, listener)
+	}
+
+	if server.tls != nil {
+		listener, err := net.Listen("tcp", server.tlsHost)
+		if err != nil {
+			fmt.Printf("error listen tls: %s, error: %s\n", server.tlsHost, err.Error())
+			return err
+		}
+		fmt.Printf("listen tls: %s\n", server.tlsHost)
+		listeners = append(listeners, tls.NewListener(listener, server.tls.tlsConfig()))
 	}
 
-	fmt.Printf("listen tcp: %s\n", server.address)
+	errc := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errc <- server.serve(listener)
+		}(listener)
+	}
+	return <-errc
+}
 
+func (server *TCPServer) serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -157,6 +237,12 @@ func (server *TCPServer) Serve() error {
 			}
 			return err
 		}
+		if server.loop != nil && !isTlsConn(conn) {
+			//事件循环模式, 连接交给poller统一处理, 不再为每个连接启动goroutine
+			//TLS连接需要在读写时加解密，仍然使用独立的读写goroutine
+			server.handle(conn)
+			continue
+		}
 		//启动一个线程, 交给 handler 处理, 这里使用的是 one connect per thread 模式
 		//因为golang的特性, one connect per thread 模式 实际上是  one connect per goroutine
 		go server.handle(conn)
@@ -164,8 +250,21 @@ func (server *TCPServer) Serve() error {
 }
 
 func (server *TCPServer) handle(conn net.Conn) {
+	certName := ""
+	if tc, ok := conn.(*tls.Conn); ok {
+		name, err := tlsHandshake(tc)
+		if err != nil {
+			fmt.Printf("tls handshake error: %s, remote: %s\n", err.Error(), conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		certName = name
+	}
+
+	atomic.AddInt64(&server.connCount, 1)
 	//创建客户端
 	client := NewClient(server, conn)
+	client.certName = certName
 	//运行客户端
 	client.Do()
 }
@@ -178,11 +277,47 @@ func (server *TCPServer) inLoop() {
 			return
 		case p := <-server.inChan:
 			//写到nsq分发
-			server.sub.Publish(MESSAGE_TOPIC_LOGIC, p)
+			if server.sub != nil {
+				start := time.Now()
+				err := server.sub.Publish(MESSAGE_TOPIC_LOGIC, p)
+				if err != nil {
+					fmt.Printf("publish message error: %s, sid=%d\n", err.Error(), p.Sid)
+				}
+				server.tracer.Record(p.TraceId(), SPAN_NSQ_PUBLISH, p, start, err, "topic", MESSAGE_TOPIC_LOGIC)
+			}
 		}
 	}
 }
 
+//广播下发给本节点满足分群条件的客户端
+func (server *TCPServer) handleBroadcast(body []byte) error {
+	b := &Broadcast{}
+	if err := json.Unmarshal(body, b); err != nil {
+		return Permanent(err)
+	}
+	if b.Expire > 0 && b.Expire < time.Now().UnixNano()/1000000 {
+		return nil
+	}
+
+	n, slow := 0, 0
+	server.clients.EachUid(func(c *Client) {
+		meta := c.Meta()
+		if !c.IsAuth() || !b.Match(&meta) {
+			return
+		}
+		if !c.TrySendLane(b.Packet(meta.Uid), LANE_BULK) {
+			//下发队列满说明客户端读得太慢，关闭连接，重连后通过离线广播补齐
+			fmt.Printf("broadcast %d lane full, close slow client uid=%d\n", b.Id, meta.Uid)
+			slow++
+			go c.Close()
+			return
+		}
+		n++
+	})
+	fmt.Printf("broadcast %d delivered to %d clients, %d slow clients closed\n", b.Id, n, slow)
+	return nil
+}
+
 //服务端将信息写到客户端
 func (server *TCPServer) outLoop() {
 	for {
@@ -190,8 +325,12 @@ func (server *TCPServer) outLoop() {
 		case <-server.quit:
 			return
 		case p := <-server.outChan:
-			if c, ok := server.uidClients[p.Rid]; ok {
-				c.sendChan <- p
+			//nsq积压或者重试时有效期消息可能已经过期
+			if p.Expired(nowMillis()) {
+				continue
+			}
+			if c := server.clients.GetByUid(p.Rid); c != nil {
+				c.Send(p)
 			}
 		}
 	}
@@ -0,0 +1,173 @@
+package tcpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//断线重连恢复会话
+//鉴权回执带上恢复token，连接断开时comet把会话状态(设备token、客户端信息、最后回执的mid、已下发还没有回执的消息)写入redis，保存resume_ttl
+//客户端重连时在AuthInfo.Resume中带上token，不需要注册设备和鉴权，comet重新下发没有回执的消息和断线期间的离线消息
+//token只能使用一次，每次鉴权成功下发新的token
+var (
+	KEY_PREFIX_SESSION_RESUME = "session#resume#" //session#resume#{uid}#token，ResumeSession(json)
+
+	RESUME_TOKEN_BYTES = 16
+	RESUME_MAX_PENDING = 256 //每个连接最多保留的没有回执的消息，超出时丢弃最早的
+
+	AUTH_STATUS_RESUME_FAILED int64 = -3 //鉴权回执: 恢复token无效或者已经过期，客户端重新注册和鉴权
+)
+
+//断线时保存的会话状态
+type ResumeSession struct {
+	Uid         int64    `json:"uid"`
+	DeviceToken string   `json:"device_token"`
+	Platform    string   `json:"platform"`
+	AppVersion  string   `json:"app_version"`
+	AckMid      int64    `json:"ack_mid"` //最后回执的消息id
+	Pending     [][]byte `json:"pending"` //已经下发还没有回执的消息，按下发顺序，序列化后的packet
+}
+
+var (
+	//KEYS: session
+	takeSessionScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if v then
+	redis.call('DEL', KEYS[1])
+end
+return v`)
+)
+
+func sessionResumeKey(uid int64, token string) string {
+	return fmt.Sprintf("%s{%d}#%s", KEY_PREFIX_SESSION_RESUME, uid, token)
+}
+
+func newResumeToken() string {
+	b := make([]byte, RESUME_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func SaveResumeSession(conn redis.Conn, token string, s *ResumeSession, ttl time.Duration) error {
+	data, _ := json.Marshal(s)
+	_, err := conn.Do("SET", sessionResumeKey(s.Uid, token), data, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+//取出并删除会话，不存在时返回nil
+func TakeResumeSession(conn redis.Conn, uid int64, token string) (*ResumeSession, error) {
+	data, err := redis.Bytes(takeSessionScript.Do(conn, sessionResumeKey(uid, token)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ResumeSession{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Uid != uid {
+		return nil, nil
+	}
+	return s, nil
+}
+
+//需要等待回执、断线后重新下发的消息
+func isResumablePacket(p *Packet) bool {
+	return (p.Mt == MESSAGE_TYPE_P2P || p.Mt == MESSAGE_TYPE_GROUP) && p.Mid != 0
+}
+
+//恢复会话，网络切换时老连接可能还没有断开，在本节点上时先关闭，关闭时写入会话状态
+func (server *TCPServer) takeResumeSession(uid int64, token string) (*ResumeSession, error) {
+	if c := server.GetClientByUid(uid); c != nil && c.ResumeToken() == token {
+		c.Close()
+	}
+
+	conn := server.pool.Get()
+	defer conn.Close()
+
+	return TakeResumeSession(conn, uid, token)
+}
+
+func (client *Client) ResumeToken() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return client.resumeToken
+}
+
+func (client *Client) setResumeToken(token string) {
+	client.mutex.Lock()
+	client.resumeToken = token
+	client.mutex.Unlock()
+}
+
+//记录下发的消息，收到回执后删除
+func (client *Client) trackPending(p *Packet) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.pending = append(client.pending, p)
+	if len(client.pending) > RESUME_MAX_PENDING {
+		client.pending = client.pending[len(client.pending)-RESUME_MAX_PENDING:]
+	}
+}
+
+func (client *Client) ackPending(mid int64) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	for i, p := range client.pending {
+		if p.Mid == mid {
+			client.pending = append(client.pending[:i], client.pending[i+1:]...)
+			break
+		}
+	}
+	if mid > client.ackMid {
+		client.ackMid = mid
+	}
+}
+
+//断线时的会话状态，没有鉴权或者没有下发过token时返回nil
+func (client *Client) resumeSession() (string, *ResumeSession) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.uid == 0 || client.resumeToken == "" {
+		return "", nil
+	}
+
+	s := &ResumeSession{
+		Uid:         client.uid,
+		DeviceToken: client.deviceToken,
+		Platform:    client.meta.Platform,
+		AppVersion:  client.meta.AppVersion,
+		AckMid:      client.ackMid,
+		Pending:     make([][]byte, 0, len(client.pending)),
+	}
+	for _, p := range client.pending {
+		s.Pending = append(s.Pending, client.server.protocol.Serialize(p))
+	}
+	return client.resumeToken, s
+}
+
+//恢复会话后需要重新下发的消息，已经过期的消息不下发
+func (s *ResumeSession) packets(proto Protocol) []*Packet {
+	now := nowMillis()
+	ps := make([]*Packet, 0, len(s.Pending))
+	for _, buf := range s.Pending {
+		if p, err := proto.Unserialize(buf); err == nil && !p.Expired(now) {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
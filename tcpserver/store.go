@@ -1,100 +1,276 @@
 package tcpserver
 
 import (
+	"encoding/json"
 	"fmt"
+	"go/redisclient"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
-var (
-	KEY_PREFIX_USER_OFFLINE_MSGS  = "user#offline#msgs#"
-	KEY_PREFIX_GROUP_OFFLINE_MSGS = "group#offline#msgs#"
-)
-
 //存储消息服务
 type StoreSrv struct {
 	dispatchSub  *Subscribe
 	offlineSub   *Subscribe
-	dispatchChan chan *Packet
-	offlineChan  chan *Packet
+	auditSub     *Subscribe
+	bcastSub     *Subscribe
+	burnSub      *Subscribe
 	quit         chan bool
+	purgeQuit    chan bool
 	message      *MysqlMessage
-	pool         *redis.Pool
+	pool         *redisclient.Client
+	proto        Protocol
+	tracer       *Tracer
+	offlineP2p   *OfflineRetention //单聊离线消息保留策略
+	offlineGroup *OfflineRetention //群聊离线消息保留策略
+	conversation *ConversationConfig
+	ephemeral    *EphemeralConfig
 }
 
 func NewStoreSrv(config *StoreConfig) *StoreSrv {
 	ps := &StoreSrv{
-		dispatchChan: make(chan *Packet, 1024),
-		offlineChan:  make(chan *Packet, 1024),
 		quit:         make(chan bool),
-		pool: &redis.Pool{
-			MaxIdle:     5,
-			IdleTimeout: 300 * time.Second,
-			// Other pool configuration not shown in this example.
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", config.RedisHost)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := c.Do("AUTH", config.RedisPwd); err != nil {
-					c.Close()
-					return nil, err
-				}
-				if _, err := c.Do("SELECT", config.RedisDb); err != nil {
-					c.Close()
-					return nil, err
-				}
-				return c, nil
-			},
-		},
-	}
-
-	ps.dispatchSub = NewSubscribe(&CustomProto{}, config.NsqdHost, MESSAGE_TOPIC_DISPATCH, MESSAGE_CHANNEL_DISPATCH_STORE, ps.dispatchChan)
-	ps.offlineSub = NewSubscribe(&CustomProto{}, config.NsqdHost, MESSAGE_TOPIC_OFFLINE, MESSAGE_CHANNEL_OFFLINE_STORE, ps.offlineChan)
+		purgeQuit:    make(chan bool),
+		pool:         NewRedisClient(&config.Redis),
+		proto:        &CustomProto{},
+		offlineP2p:   &config.OfflineP2p,
+		offlineGroup: &config.OfflineGroup,
+		conversation: &config.Conversation,
+		ephemeral:    &config.Ephemeral,
+	}
+	ps.tracer = NewTracer("store", ps.pool, &config.Trace)
+
 	ps.message = NewMysqlMessage(config.DbHost, config.DbUser, config.DbPwd, config.DbName, config.DbCharset)
+	//写入失败的消息由nsq重试，消息按mid去重，重复写入是安全的
+	ps.dispatchSub = NewSubscribeHandler(ps.proto, config.NsqdHost, MESSAGE_TOPIC_DISPATCH, MESSAGE_CHANNEL_DISPATCH_STORE, ps.handleDispatch)
+	ps.offlineSub = NewSubscribeHandler(ps.proto, config.NsqdHost, MESSAGE_TOPIC_OFFLINE, MESSAGE_CHANNEL_OFFLINE_STORE, ps.handleOffline)
+	ps.auditSub = NewSubscribeBody(config.NsqdHost, MESSAGE_TOPIC_FILTER_AUDIT, MESSAGE_CHANNEL_FILTER_AUDIT, ps.handleFilterAudit)
+	ps.bcastSub = NewSubscribeBody(config.NsqdHost, MESSAGE_TOPIC_BROADCAST, MESSAGE_CHANNEL_BROADCAST_STORE, ps.handleBroadcast)
+	ps.burnSub = NewSubscribeBody(config.NsqdHost, MESSAGE_TOPIC_BURN, MESSAGE_CHANNEL_BURN_STORE, ps.handleBurn)
+
+	go ps.purgeLoop()
 
 	return ps
 }
 
+//消息在nsq的handler中处理，Run等待退出
 func (ss *StoreSrv) Run() {
+	<-ss.quit
+}
+
+func (ss *StoreSrv) handleDispatch(p *Packet) error {
+	//拒绝通知等不是聊天消息，不需要存储
+	if !isChatPacket(p) {
+		return nil
+	}
+
+	start := time.Now()
+	var err error
+	if !ss.message.Save(p) {
+		err = ErrSaveMessage
+	} else {
+		err = ss.updateConversation(p)
+	}
+	ss.tracer.Record(p.TraceId(), SPAN_STORE_WRITE, p, start, err, "channel", MESSAGE_CHANNEL_DISPATCH_STORE)
+	return err
+}
+
+func (ss *StoreSrv) handleOffline(p *Packet) error {
+	start := time.Now()
+	dropped, err := ss.storeOffline(p)
+	ss.tracer.Record(p.TraceId(), SPAN_STORE_WRITE, p, start, err, "channel", MESSAGE_CHANNEL_OFFLINE_STORE, "dropped", strconv.FormatInt(dropped, 10))
+	return err
+}
+
+//返回因为保留策略丢弃的离线消息数量
+func (ss *StoreSrv) storeOffline(p *Packet) (int64, error) {
+	//拒绝通知不是聊天消息，不写入存储和会话列表，只保存到离线消息等发送者上线后下发
+	if p.Mt == MESSAGE_TYPE_REJECT {
+		return ss.saveOffline(p, ss.offlineP2p)
+	}
+
+	if !ss.message.Save(p) {
+		return 0, ErrSaveMessage
+	}
+	if err := ss.updateConversation(p); err != nil {
+		return 0, err
+	}
+
+	//消息已经写入存储，redis中只保留用于上线下发的部分，超出保留策略的消息客户端通过缺失通知从存储补齐
+	switch p.Mt {
+	case MESSAGE_TYPE_P2P:
+		//单聊，按发送者区分会话
+		return ss.saveOffline(p, ss.offlineP2p)
+	case MESSAGE_TYPE_GROUP:
+		//群消息，dispatch扩散后Sid为群id
+		return ss.saveOffline(p, ss.offlineGroup)
+	case MESSAGE_TYPE_ROOM:
+		//聊天室消息
+		//聊天室不提供离线功能
+		return 0, nil
+	default:
+		return 0, Permanent(fmt.Errorf("unknown message type: %d", p.Mt))
+	}
+}
+
+func (ss *StoreSrv) saveOffline(p *Packet, r *OfflineRetention) (int64, error) {
+	conn := ss.pool.Get()
+	defer conn.Close()
+
+	dropped, err := SaveOffline(conn, ss.proto, p, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := IndexEphemeralOffline(conn, p); err != nil {
+		return 0, err
+	}
+	if dropped > 0 {
+		fmt.Printf("offline messages dropped: %d, uid=%d, mt=%d, cid=%d\n", dropped, p.Rid, p.Mt, p.Sid)
+	}
+	return dropped, nil
+}
+
+//更新会话列表和未读数，聊天室没有会话列表
+func (ss *StoreSrv) updateConversation(p *Packet) error {
+	if !ss.conversation.Enable || p.Mt == MESSAGE_TYPE_ROOM {
+		return nil
+	}
+
+	conn := ss.pool.Get()
+	defer conn.Close()
+
+	return UpdateConversation(conn, p, ss.conversation.MaxCount)
+}
+
+func (ss *StoreSrv) handleFilterAudit(body []byte) error {
+	audit := &FilterAudit{}
+	if err := json.Unmarshal(body, audit); err != nil {
+		return Permanent(err)
+	}
+	if !ss.message.SaveFilterAudit(audit) {
+		return ErrSaveMessage
+	}
+	return nil
+}
+
+//保存需要下发给离线用户的广播
+func (ss *StoreSrv) handleBroadcast(body []byte) error {
+	b := &Broadcast{}
+	if err := json.Unmarshal(body, b); err != nil {
+		return Permanent(err)
+	}
+	if !b.Offline {
+		return nil
+	}
+
+	conn := ss.pool.Get()
+	defer conn.Close()
+
+	return SaveOfflineBroadcast(conn, b)
+}
+
+//接收者已读阅后即焚消息，从数据库和离线消息中删除
+//消息按接收者查询，只能删除发给自己并且带有阅后即焚标记的消息
+func (ss *StoreSrv) handleBurn(body []byte) error {
+	e, err := decodeBurnEvent(body)
+	if err != nil {
+		return Permanent(err)
+	}
+
 	conn := ss.pool.Get()
 	defer conn.Close()
 
-	proto := &CustomProto{}
+	p, err := ss.message.Get(e.Uid, e.Mid)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		//已经删除的重试直接完成，否则消息还在存储队列中，退避后重试
+		done, err := redis.Bool(conn.Do("EXISTS", burnDoneKey(e.Uid, e.Mid)))
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		return ErrBurnNotSaved
+	}
+	if !p.IsBurnAfterRead() {
+		return Permanent(fmt.Errorf("message is not burn after read, uid=%d, mid=%d", e.Uid, e.Mid))
+	}
+
+	//先删除离线消息，数据库删除失败重试时仍然能查到消息
+	if err := BurnOffline(conn, ss.proto, p); err != nil {
+		return err
+	}
+	if _, err := conn.Do("SET", burnDoneKey(e.Uid, e.Mid), 1, "EX", int64(BURN_DONE_TTL/time.Second)); err != nil {
+		return err
+	}
+	return ss.message.Delete(e.Uid, e.Mid)
+}
+
+//定时清理过期的消息
+func (ss *StoreSrv) purgeLoop() {
+	ticker := time.NewTicker(ss.ephemeral.PurgeInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case p := <-ss.dispatchChan:
-			ss.message.Save(p)
-		case p := <-ss.offlineChan:
-			ss.message.Save(p)
-			switch p.Mt {
-			case MESSAGE_TYPE_P2P:
-				//单聊
-				//点对点缓存到redis list， 保留最近200条聊天记录
-				key := fmt.Sprintf("%s%d", KEY_PREFIX_USER_OFFLINE_MSGS, p.Rid)
-				conn.Do("RPUSH", key, proto.Serialize(p))
-				conn.Do("LTRIM", key, 0, 200)
-			case MESSAGE_TYPE_GROUP:
-				//群消息
-				//群消息缓存到redis list， 保留最近500条聊天记录
-				key := fmt.Sprintf("%s%d", KEY_PREFIX_GROUP_OFFLINE_MSGS, p.Rid)
-				conn.Do("RPUSH", key, proto.Serialize(p))
-				conn.Do("LTRIM", key, 0, 500)
-			case MESSAGE_TYPE_ROOM:
-				//聊天室消息
-				//聊天室不提供离线功能
-			default:
-				fmt.Printf("unknown message type: %d\n", p.Mt)
-			}
-		case <-ss.quit:
+		case <-ss.purgeQuit:
 			return
+		case <-ticker.C:
+			ss.purgeExpired()
+		}
+	}
+}
+
+func (ss *StoreSrv) purgeExpired() {
+	now := nowMillis()
+	batch := ss.ephemeral.PurgeBatch
+
+	var rows int64
+	for {
+		n, err := ss.message.PurgeExpired(now, batch)
+		if err != nil {
+			fmt.Printf("purge expired messages error: %s\n", err.Error())
+			break
 		}
+		rows += n
+		if n < int64(batch) {
+			break
+		}
+	}
+
+	conn := ss.pool.Get()
+	defer conn.Close()
+
+	var offline int64
+	for {
+		n, count, err := PurgeOfflineExpired(conn, ss.proto, now, batch)
+		offline += n
+		if err != nil {
+			fmt.Printf("purge expired offline messages error: %s\n", err.Error())
+			break
+		}
+		if count < batch {
+			break
+		}
+	}
+
+	if rows > 0 || offline > 0 {
+		fmt.Printf("expired messages purged: %d from db, %d from offline\n", rows, offline)
 	}
 }
 
 func (ss *StoreSrv) Close() {
+	ss.dispatchSub.Close()
+	ss.offlineSub.Close()
+	ss.auditSub.Close()
+	ss.bcastSub.Close()
+	ss.burnSub.Close()
+	close(ss.purgeQuit)
 	ss.quit <- true
 	ss.message.Close()
 }
@@ -1,8 +1,11 @@
 package tcpserver
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	nsq "github.com/nsqio/go-nsq"
 )
@@ -16,17 +19,97 @@ var (
 	MESSAGE_TOPIC_OFFLINE          = "message_topic_offline"          //离线消息推送
 	MESSAGE_CHANNEL_OFFLINE_PUSH   = "message_channel_offline_push"   //离线消息推送
 	MESSAGE_CHANNEL_OFFLINE_STORE  = "message_channel_offline_store"  //离线消息存储
+	MESSAGE_TOPIC_DEAD_LETTER      = "message_topic_dead_letter"      //无法处理的消息
+	MESSAGE_CHANNEL_DEAD_LETTER    = "message_channel_dead_letter"    //死信查看和重放
+	MESSAGE_TOPIC_FILTER_AUDIT     = "message_topic_filter_audit"     //内容过滤命中记录，内容为FilterAudit(json)
+	MESSAGE_CHANNEL_FILTER_AUDIT   = "message_channel_filter_audit"   //保存内容过滤命中记录
+
+	SUBSCRIBE_MAX_ATTEMPTS      = uint16(5)        //最多处理次数，超过后进入死信
+	SUBSCRIBE_REQUEUE_DELAY     = time.Second      //第一次重试的延迟，之后每次翻倍
+	SUBSCRIBE_MAX_REQUEUE_DELAY = 60 * time.Second //重试延迟上限
+	SUBSCRIBE_DELIVER_TIMEOUT   = 5 * time.Second  //写入outChan的超时时间，超时后重新入队
+)
+
+var (
+	ErrDeliverTimeout = errors.New("deliver packet timeout")
 )
 
+//处理消息失败，并且重试也不会成功，直接进入死信
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func IsPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+//死信，MESSAGE_TOPIC_DEAD_LETTER中的消息内容(json)
+type DeadLetter struct {
+	Id       string `json:"id"`       //原始nsq消息id
+	Topic    string `json:"topic"`    //原始topic
+	Channel  string `json:"channel"`  //处理失败的channel
+	Attempts uint16 `json:"attempts"` //已经处理的次数
+	Error    string `json:"error"`    //最后一次处理的错误
+	Ct       int64  `json:"ct"`       //进入死信的时间，ms
+	Body     []byte `json:"body"`     //原始消息
+}
+
+//处理消息，返回错误时重试，返回Permanent错误时直接进入死信
+type PacketHandler func(p *Packet) error
+
+//和PacketHandler相同，处理不是Packet格式的原始消息
+type BodyHandler func(body []byte) error
+
 type Subscribe struct {
 	protocol Protocol      //消息解析协议
 	producer *nsq.Producer //发送消息到逻辑处理层
 	consumer *nsq.Consumer //分发消息到客户端
 	outChan  chan *Packet
+	topic    string
+	channel  string
+	handler  BodyHandler
 }
 
+//订阅消息并写入out，写入超时的消息重新入队
 func NewSubscribe(protocol Protocol, nsqaddr string, topic string, c string, out chan *Packet) *Subscribe {
+	sub := &Subscribe{outChan: out}
+	return newSubscribe(sub, protocol, nsqaddr, topic, c, packetHandler(protocol, sub.deliver))
+}
+
+//订阅消息并同步调用handler，handler的结果决定消息完成、重试还是进入死信
+func NewSubscribeHandler(protocol Protocol, nsqaddr string, topic string, c string, handler PacketHandler) *Subscribe {
+	return newSubscribe(&Subscribe{}, protocol, nsqaddr, topic, c, packetHandler(protocol, handler))
+}
+
+//和NewSubscribeHandler相同，消息内容不解析为Packet
+func NewSubscribeBody(nsqaddr string, topic string, c string, handler BodyHandler) *Subscribe {
+	return newSubscribe(&Subscribe{}, &CustomProto{}, nsqaddr, topic, c, handler)
+}
+
+//只发布消息，不订阅
+func NewPublisher(protocol Protocol, nsqaddr string) *Subscribe {
+	producer, err := nsq.NewProducer(nsqaddr, nsq.NewConfig())
+	if err != nil {
+		fmt.Printf("nsq producer error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	return &Subscribe{protocol: protocol, producer: producer}
+}
+
+func newSubscribe(sub *Subscribe, protocol Protocol, nsqaddr string, topic string, c string, handler BodyHandler) *Subscribe {
 	cfg := nsq.NewConfig()
+	//重试次数和死信由handleMessage处理
+	cfg.MaxAttempts = 0
+	cfg.MaxRequeueDelay = SUBSCRIBE_MAX_REQUEUE_DELAY
 	producer, err := nsq.NewProducer(nsqaddr, cfg)
 	if err != nil {
 		fmt.Printf("nsq producer error: %s\n", err.Error())
@@ -39,22 +122,16 @@ func NewSubscribe(protocol Protocol, nsqaddr string, topic string, c string, out
 		os.Exit(1)
 	}
 
-	sub := &Subscribe{
-		protocol: protocol,
-		producer: producer,
-		consumer: consumer,
-		outChan:  out,
-	}
+	sub.protocol = protocol
+	sub.producer = producer
+	sub.consumer = consumer
+	sub.topic = topic
+	sub.channel = c
+	sub.handler = handler
 
 	go func() {
 		// 设置消息处理函数
-		consumer.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
-			p, err := sub.protocol.Unserialize(message.Body)
-			if err == nil {
-				sub.outChan <- p
-			}
-			return nil
-		}))
+		consumer.AddHandler(nsq.HandlerFunc(sub.handleMessage))
 
 		// 连接到单例nsqd
 		if err := consumer.ConnectToNSQD(nsqaddr); err != nil {
@@ -67,10 +144,89 @@ func NewSubscribe(protocol Protocol, nsqaddr string, topic string, c string, out
 	return sub
 }
 
-func (sub *Subscribe) Publish(topic string, p *Packet) {
-	sub.producer.Publish(topic, sub.protocol.Serialize(p))
+func (sub *Subscribe) handleMessage(message *nsq.Message) error {
+	message.DisableAutoResponse()
+
+	err := sub.handler(message.Body)
+	if err == nil {
+		message.Finish()
+		return nil
+	}
+
+	if IsPermanent(err) || message.Attempts >= SUBSCRIBE_MAX_ATTEMPTS {
+		sub.deadLetter(message, err)
+		return nil
+	}
+
+	//按处理次数指数退避
+	delay := SUBSCRIBE_REQUEUE_DELAY << uint(message.Attempts-1)
+	if delay > SUBSCRIBE_MAX_REQUEUE_DELAY || delay <= 0 {
+		delay = SUBSCRIBE_MAX_REQUEUE_DELAY
+	}
+	fmt.Printf("nsq message requeue: topic=%s channel=%s attempts=%d delay=%v error=%s\n", sub.topic, sub.channel, message.Attempts, delay, err.Error())
+	message.Requeue(delay)
+	return nil
+}
+
+//写入死信topic后完成消息，写入失败时重新入队，避免丢消息
+func (sub *Subscribe) deadLetter(message *nsq.Message, err error) {
+	dl := DeadLetter{
+		Id:       string(message.ID[:]),
+		Topic:    sub.topic,
+		Channel:  sub.channel,
+		Attempts: message.Attempts,
+		Error:    err.Error(),
+		Ct:       time.Now().UnixNano() / 1000000,
+		Body:     message.Body,
+	}
+
+	data, _ := json.Marshal(dl)
+	if perr := sub.producer.Publish(MESSAGE_TOPIC_DEAD_LETTER, data); perr != nil {
+		fmt.Printf("nsq dead letter publish error: %s\n", perr.Error())
+		message.Requeue(SUBSCRIBE_MAX_REQUEUE_DELAY)
+		return
+	}
+
+	fmt.Printf("nsq message dead letter: topic=%s channel=%s attempts=%d error=%s\n", sub.topic, sub.channel, message.Attempts, err.Error())
+	message.Finish()
 }
 
+//解析Packet后调用handler，无法解析的消息直接进入死信
+func packetHandler(protocol Protocol, handler PacketHandler) BodyHandler {
+	return func(body []byte) error {
+		p, err := protocol.Unserialize(body)
+		if err != nil {
+			return Permanent(err)
+		}
+		return handler(p)
+	}
+}
+
+func (sub *Subscribe) deliver(p *Packet) error {
+	timer := time.NewTimer(SUBSCRIBE_DELIVER_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case sub.outChan <- p:
+		return nil
+	case <-timer.C:
+		return ErrDeliverTimeout
+	}
+}
+
+func (sub *Subscribe) Publish(topic string, p *Packet) error {
+	return sub.producer.Publish(topic, sub.protocol.Serialize(p))
+}
+
+func (sub *Subscribe) PublishBody(topic string, body []byte) error {
+	return sub.producer.Publish(topic, body)
+}
+
+//停止消费，等待正在处理的消息完成后再停止生产者，处理消息时可能还会发布
 func (sub *Subscribe) Close() {
-	sub.consumer.Stop()
+	if sub.consumer != nil {
+		sub.consumer.Stop()
+		<-sub.consumer.StopChan
+	}
+	sub.producer.Stop()
 }
@@ -0,0 +1,201 @@
+package tcpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	TLS_HANDSHAKE_TIMEOUT = 10 * time.Second //握手超时，避免慢连接占用goroutine
+)
+
+//comet的TLS监听，和明文监听可以同时开启，迁移期间新老客户端分别连接
+//配置了client_ca_file时校验客户端证书，证书CN为uid的连接鉴权时不需要token，用于服务端机器人
+type TlsConfig struct {
+	Host              string        `yaml:"host"`                              //TLS监听地址，为空时不开启
+	CertFile          string        `yaml:"cert_file" reload:"true"`           //服务端证书，可以包含中间证书
+	KeyFile           string        `yaml:"key_file" reload:"true"`            //服务端私钥
+	ClientCaFile      string        `yaml:"client_ca_file" reload:"true"`      //签发客户端证书的CA，为空时不校验客户端证书
+	RequireClientCert bool          `yaml:"require_client_cert" reload:"true"` //只允许带有效证书的客户端连接
+	CheckInterval     time.Duration `yaml:"check_interval"`                    //检查证书文件变化的间隔，0表示只在SIGHUP时重新加载
+}
+
+func NewTlsConfig() TlsConfig {
+	return TlsConfig{
+		CheckInterval: time.Minute,
+	}
+}
+
+func (c *TlsConfig) Validate() error {
+	if c.Host == "" {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("tls cert_file and key_file are required")
+	}
+	if c.RequireClientCert && c.ClientCaFile == "" {
+		return errors.New("tls require_client_cert needs client_ca_file")
+	}
+	if c.CheckInterval < 0 {
+		return fmt.Errorf("tls check_interval must not be negative, got %v", c.CheckInterval)
+	}
+	return nil
+}
+
+//证书热加载，每次握手使用最新加载的证书和CA，加载失败时继续使用原来的
+type tlsReloader struct {
+	mutex     sync.RWMutex
+	config    TlsConfig
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time //证书文件最后的修改时间
+	quit      chan bool
+}
+
+func newTlsReloader(config *TlsConfig) (*tlsReloader, error) {
+	r := &tlsReloader{quit: make(chan bool)}
+	if err := r.load(config); err != nil {
+		return nil, err
+	}
+
+	if config.CheckInterval > 0 {
+		go r.watch(config.CheckInterval)
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) load(config *TlsConfig) error {
+	//先记录修改时间，加载期间文件再次被替换时下次检查会重新加载
+	modTime := tlsModTime(config)
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load tls cert error: %s", err.Error())
+	}
+
+	var pool *x509.CertPool
+	if config.ClientCaFile != "" {
+		data, err := ioutil.ReadFile(config.ClientCaFile)
+		if err != nil {
+			return fmt.Errorf("load tls client ca error: %s", err.Error())
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("load tls client ca error: no certificates in %s", config.ClientCaFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.config = *config
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return nil
+}
+
+//SIGHUP重新加载配置时调用
+func (r *tlsReloader) reload(config *TlsConfig) {
+	if err := r.load(config); err != nil {
+		fmt.Printf("reload tls error: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("reload tls cert: %s\n", config.CertFile)
+}
+
+//证书文件被替换后自动重新加载，例如证书自动续期
+func (r *tlsReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+			r.mutex.RLock()
+			config := r.config
+			modTime := r.modTime
+			r.mutex.RUnlock()
+
+			if t := tlsModTime(&config); t.After(modTime) {
+				r.reload(&config)
+				//加载失败时等文件再次修改后重试，不重复输出错误
+				r.mutex.Lock()
+				if r.modTime.Before(t) {
+					r.modTime = t
+				}
+				r.mutex.Unlock()
+			}
+		}
+	}
+}
+
+func (r *tlsReloader) close() {
+	close(r.quit)
+}
+
+//监听使用的配置，具体的证书在每次握手时获取
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.configForClient,
+	}
+}
+
+func (r *tlsReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.clientCAs != nil {
+		config.ClientCAs = r.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.config.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+func tlsModTime(config *TlsConfig) time.Time {
+	var t time.Time
+	for _, name := range []string{config.CertFile, config.KeyFile, config.ClientCaFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+//握手，返回校验通过的客户端证书CN，没有证书时为空
+func tlsHandshake(conn *tls.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+func isTlsConn(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
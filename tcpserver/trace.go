@@ -0,0 +1,228 @@
+package tcpserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/redisclient"
+	"math"
+	mrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//消息链路追踪
+//comet收到客户端消息时分配trace id，写入Ext的EXT_KEY_TRACE_ID，消息经过的每一跳记录一个span到redis
+//spans按trace id保存，dispatch分配mid后记录mid到trace id的索引，可以按mid查询完整链路
+var (
+	SPAN_COMET_INGRESS  = "comet_ingress"  //comet收到客户端消息
+	SPAN_NSQ_PUBLISH    = "nsq_publish"    //comet发布到nsq
+	SPAN_DISPATCH_ROUTE = "dispatch_route" //dispatch分配mid并路由到在线/离线
+	SPAN_STORE_WRITE    = "store_write"    //store写入存储
+	SPAN_DOWNLINK_WRITE = "downlink_write" //comet下发给接收者
+	SPAN_CLIENT_ACK     = "client_ack"     //接收者回执
+
+	KEY_PREFIX_TRACE_SPANS = "trace#spans#" //trace#spans#traceId，span列表
+	KEY_PREFIX_TRACE_MID   = "trace#mid#"   //trace#mid#mid，mid对应的trace id
+
+	TRACE_QUEUE_SIZE   = 10000 //待写入的span队列长度，队列满时丢弃
+	TRACE_PENDING_ACKS = 256   //每个连接等待回执的追踪消息数量上限
+)
+
+type TraceConfig struct {
+	Enable     bool          `yaml:"enable"`      //是否记录span
+	SampleRate float64       `yaml:"sample_rate"` //comet分配trace id的采样率，0-1
+	Ttl        time.Duration `yaml:"ttl"`         //span保留时间
+}
+
+func NewTraceConfig() TraceConfig {
+	return TraceConfig{
+		Enable:     false,
+		SampleRate: 1,
+		Ttl:        24 * time.Hour,
+	}
+}
+
+func (c *TraceConfig) Validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("trace sample_rate must be in [0, 1], got %v", c.SampleRate)
+	}
+	if c.Enable && c.Ttl <= 0 {
+		return fmt.Errorf("trace ttl must be positive, got %v", c.Ttl)
+	}
+	return nil
+}
+
+type Span struct {
+	TraceId  string            `json:"trace_id"`
+	Name     string            `json:"name"`
+	Node     string            `json:"node"`          //角色@主机名:pid
+	Mid      int64             `json:"mid,omitempty"` //dispatch之前是客户端的序列号
+	Sid      int64             `json:"sid,omitempty"`
+	Rid      int64             `json:"rid,omitempty"`
+	Start    int64             `json:"start"`    //开始时间，us
+	Duration int64             `json:"duration"` //耗时，us
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+//异步写入span，为nil时所有方法不做任何事
+type Tracer struct {
+	pool       *redisclient.Client
+	node       string
+	sampleRate float64
+	ttl        time.Duration
+	spans      chan *Span
+	dropped    int64
+}
+
+//没有开启追踪时返回nil
+func NewTracer(role string, pool *redisclient.Client, config *TraceConfig) *Tracer {
+	if !config.Enable {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	t := &Tracer{
+		pool:       pool,
+		node:       fmt.Sprintf("%s@%s:%d", role, hostname, os.Getpid()),
+		sampleRate: config.SampleRate,
+		ttl:        config.Ttl,
+		spans:      make(chan *Span, TRACE_QUEUE_SIZE),
+	}
+
+	go t.writeLoop()
+	return t
+}
+
+//按采样率为消息分配trace id并写入Ext，返回0表示不追踪
+func (t *Tracer) Start(p *Packet) uint64 {
+	if t == nil || (t.sampleRate < 1 && mrand.Float64() >= t.sampleRate) {
+		return 0
+	}
+
+	id := newTraceId()
+	p.SetTraceId(id)
+	//Ext无法写入时不追踪
+	return p.TraceId()
+}
+
+//记录一个span，traceId为0时忽略，attrs为 key, value 交替
+func (t *Tracer) Record(traceId uint64, name string, p *Packet, start time.Time, err error, attrs ...string) {
+	if t == nil || traceId == 0 {
+		return
+	}
+
+	span := &Span{
+		TraceId:  FormatTraceId(traceId),
+		Name:     name,
+		Node:     t.node,
+		Mid:      p.Mid,
+		Sid:      p.Sid,
+		Rid:      p.Rid,
+		Start:    start.UnixNano() / 1000,
+		Duration: int64(time.Since(start) / time.Microsecond),
+	}
+	if err != nil {
+		span.Error = err.Error()
+	}
+	if len(attrs) > 1 {
+		span.Attrs = make(map[string]string, len(attrs)/2)
+		for i := 0; i+1 < len(attrs); i += 2 {
+			span.Attrs[attrs[i]] = attrs[i+1]
+		}
+	}
+
+	select {
+	case t.spans <- span:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) writeLoop() {
+	ttl := int64(t.ttl / time.Second)
+	for span := range t.spans {
+		data, _ := json.Marshal(span)
+
+		//集群模式下span列表和mid索引不在同一个slot，不使用pipeline
+		conn := t.pool.Get()
+		key := KEY_PREFIX_TRACE_SPANS + span.TraceId
+		_, err := conn.Do("RPUSH", key, data)
+		if err == nil {
+			_, err = conn.Do("EXPIRE", key, ttl)
+		}
+		//dispatch分配mid之后才能按mid查询
+		if err == nil && span.Name == SPAN_DISPATCH_ROUTE && span.Mid != 0 {
+			_, err = conn.Do("SET", fmt.Sprintf("%s%d", KEY_PREFIX_TRACE_MID, span.Mid), span.TraceId, "EX", ttl)
+		}
+		if err != nil {
+			fmt.Printf("trace write span error: %s\n", err.Error())
+		}
+		conn.Close()
+
+		if n := atomic.SwapInt64(&t.dropped, 0); n > 0 {
+			fmt.Printf("trace spans dropped: %d\n", n)
+		}
+	}
+}
+
+//查询mid所在链路的所有span，按开始时间排序
+func QueryTraceByMid(conn redis.Conn, mid int64) ([]*Span, error) {
+	traceId, err := redis.String(conn.Do("GET", fmt.Sprintf("%s%d", KEY_PREFIX_TRACE_MID, mid)))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("no trace found for mid %d", mid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return QueryTrace(conn, traceId)
+}
+
+func QueryTrace(conn redis.Conn, traceId string) ([]*Span, error) {
+	values, err := redis.ByteSlices(conn.Do("LRANGE", KEY_PREFIX_TRACE_SPANS+traceId, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	spans := make([]*Span, 0, len(values))
+	for _, v := range values {
+		span := &Span{}
+		if err := json.Unmarshal(v, span); err == nil {
+			spans = append(spans, span)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+	return spans, nil
+}
+
+func newTraceId() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 && id != math.MaxUint64 {
+			return id
+		}
+	}
+}
+
+func FormatTraceId(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+func ParseTraceId(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 16, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New("invalid trace id")
+	}
+	return id, nil
+}
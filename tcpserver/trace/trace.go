@@ -0,0 +1,96 @@
+package main
+
+//消息链路查询工具，按mid或者trace id输出消息经过的每一跳
+//例如: trace -redis_host 127.0.0.1:6379 -redis_db 1 -mid 123456
+
+import (
+	"flag"
+	"fmt"
+	"go/redisclient"
+	"go/tcpserver"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func main() {
+	mid := flag.Int64("mid", 0, "message id assigned by dispatch")
+	traceId := flag.String("trace", "", "trace id, hex")
+	mode := flag.String("redis_mode", redisclient.MODE_STANDALONE, "standalone, sentinel or cluster")
+	host := flag.String("redis_host", "127.0.0.1:6379", "redis address, comma separated for sentinel and cluster")
+	masterName := flag.String("redis_master_name", "", "sentinel master name")
+	pwd := flag.String("redis_pwd", "", "redis password")
+	db := flag.Int("redis_db", 1, "redis db")
+	flag.Parse()
+
+	if *mid == 0 && *traceId == "" {
+		fmt.Println("-mid or -trace is required")
+		os.Exit(1)
+	}
+	if *traceId != "" {
+		if _, err := tcpserver.ParseTraceId(*traceId); err != nil {
+			fmt.Printf("%s: %s\n", err.Error(), *traceId)
+			os.Exit(1)
+		}
+	}
+
+	config := redisclient.NewConfig(*host, *pwd, *db)
+	config.Mode = *mode
+	config.MasterName = *masterName
+	client, err := redisclient.New(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	conn := client.Get()
+	defer conn.Close()
+
+	var spans []*tcpserver.Span
+	if *traceId != "" {
+		spans, err = tcpserver.QueryTrace(conn, *traceId)
+	} else {
+		spans, err = tcpserver.QueryTraceByMid(conn, *mid)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(spans) == 0 {
+		fmt.Println("no spans found, the trace may have expired")
+		os.Exit(1)
+	}
+
+	printSpans(spans)
+}
+
+//按开始时间输出，offset为距离第一个span开始的时间
+func printSpans(spans []*tcpserver.Span) {
+	first := spans[0].Start
+	fmt.Printf("trace %s, start %s\n", spans[0].TraceId, time.Unix(0, first*int64(time.Microsecond)).Format("2006-01-02 15:04:05.000000"))
+
+	for _, span := range spans {
+		offset := time.Duration(span.Start-first) * time.Microsecond
+		duration := time.Duration(span.Duration) * time.Microsecond
+		fmt.Printf("+%-12v %-16s %-12v mid=%d sid=%d rid=%d node=%s", offset, span.Name, duration, span.Mid, span.Sid, span.Rid, span.Node)
+
+		keys := make([]string, 0, len(span.Attrs))
+		for k := range span.Attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		attrs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			attrs = append(attrs, k+"="+span.Attrs[k])
+		}
+		if len(attrs) > 0 {
+			fmt.Printf(" %s", strings.Join(attrs, " "))
+		}
+		if span.Error != "" {
+			fmt.Printf(" error=%q", span.Error)
+		}
+		fmt.Println()
+	}
+}
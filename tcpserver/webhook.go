@@ -0,0 +1,221 @@
+package tcpserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//webhook投递，发给机器人uid的消息POST到配置的url
+//订阅在线和离线两个topic，投递失败由nsq按SUBSCRIBE_MAX_ATTEMPTS重试，之后进入死信，可以用deadletter工具重放
+//请求带签名: X-Im-Signature 为 sha256= + hex(hmac-sha256(secret, X-Im-Timestamp + "." + body))
+//重试可能重复投递，接收方按 X-Im-Delivery(消息mid) 去重
+var (
+	MESSAGE_CHANNEL_DISPATCH_WEBHOOK = "message_channel_dispatch_webhook" //在线消息webhook投递
+	MESSAGE_CHANNEL_OFFLINE_WEBHOOK  = "message_channel_offline_webhook"  //离线消息webhook投递
+
+	WEBHOOK_HEADER_SIGNATURE = "X-Im-Signature"
+	WEBHOOK_HEADER_TIMESTAMP = "X-Im-Timestamp"
+	WEBHOOK_HEADER_DELIVERY  = "X-Im-Delivery"
+	WEBHOOK_SIGNATURE_PREFIX = "sha256="
+)
+
+var (
+	ErrWebhookSignature = errors.New("webhook signature invalid")
+	ErrWebhookExpired   = errors.New("webhook timestamp expired")
+)
+
+type WebhookConfig struct {
+	Enable  bool          `yaml:"enable"`
+	Url     string        `yaml:"url" reload:"true"`
+	Secret  string        `yaml:"secret" secret:"true" reload:"true"` //签名密钥
+	BotUids string        `yaml:"bot_uids" reload:"true"`             //机器人uid，逗号分隔
+	Timeout time.Duration `yaml:"timeout"`                            //单次请求的超时时间
+}
+
+func NewWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Enable:  false,
+		Timeout: 5 * time.Second,
+	}
+}
+
+func (c *WebhookConfig) Validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if !strings.HasPrefix(c.Url, "http://") && !strings.HasPrefix(c.Url, "https://") {
+		return fmt.Errorf("webhook url must be http or https, got %q", c.Url)
+	}
+	if c.Secret == "" {
+		return errors.New("webhook secret is required")
+	}
+	if _, err := parseUids(c.BotUids); err != nil {
+		return fmt.Errorf("webhook bot_uids %s", err.Error())
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("webhook timeout must be positive, got %v", c.Timeout)
+	}
+	return nil
+}
+
+//逗号分隔的uid列表
+func parseUids(s string) (map[int64]bool, error) {
+	uids := make(map[int64]bool)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		uid, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || uid <= 0 {
+			return nil, fmt.Errorf("invalid uid %q", f)
+		}
+		uids[uid] = true
+	}
+	return uids, nil
+}
+
+//webhook请求的body
+type WebhookEvent struct {
+	Mid         int64  `json:"mid"`
+	Mt          int32  `json:"mt"`
+	Sid         int64  `json:"sid"` //发送者，群消息为群id
+	Rid         int64  `json:"rid"` //机器人uid
+	Ct          int64  `json:"ct"`
+	ClientMid   int64  `json:"client_mid"`
+	ContentType string `json:"content_type"`
+	Ext         []byte `json:"ext"`
+	Pl          []byte `json:"pl"`
+}
+
+//计算签名，返回X-Im-Signature的值
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return WEBHOOK_SIGNATURE_PREFIX + hex.EncodeToString(mac.Sum(nil))
+}
+
+//接收方校验签名，tolerance为允许的时间偏差，防止重放
+func VerifyWebhook(secret string, r *http.Request, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(r.Header.Get(WEBHOOK_HEADER_TIMESTAMP), 10, 64)
+	if err != nil {
+		return ErrWebhookSignature
+	}
+	if d := time.Since(time.Unix(timestamp, 0)); d > tolerance || d < -tolerance {
+		return ErrWebhookExpired
+	}
+	if !hmac.Equal([]byte(r.Header.Get(WEBHOOK_HEADER_SIGNATURE)), []byte(SignWebhook(secret, timestamp, body))) {
+		return ErrWebhookSignature
+	}
+	return nil
+}
+
+type Webhook struct {
+	mutex  sync.RWMutex
+	url    string
+	secret string
+	bots   map[int64]bool
+	client *http.Client
+	subs   []*Subscribe
+}
+
+func NewWebhook(nsqaddr string, config *WebhookConfig) *Webhook {
+	w := &Webhook{
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	w.Reload(config)
+
+	proto := &CustomProto{}
+	w.subs = []*Subscribe{
+		NewSubscribeHandler(proto, nsqaddr, MESSAGE_TOPIC_DISPATCH, MESSAGE_CHANNEL_DISPATCH_WEBHOOK, w.handle),
+		NewSubscribeHandler(proto, nsqaddr, MESSAGE_TOPIC_OFFLINE, MESSAGE_CHANNEL_OFFLINE_WEBHOOK, w.handle),
+	}
+	return w
+}
+
+//SIGHUP重新加载url、密钥和机器人列表，配置已经校验过
+func (w *Webhook) Reload(config *WebhookConfig) {
+	bots, _ := parseUids(config.BotUids)
+
+	w.mutex.Lock()
+	w.url = config.Url
+	w.secret = config.Secret
+	w.bots = bots
+	w.mutex.Unlock()
+}
+
+func (w *Webhook) handle(p *Packet) error {
+	if !isChatPacket(p) {
+		return nil
+	}
+
+	w.mutex.RLock()
+	url, secret, ok := w.url, w.secret, w.bots[p.Rid]
+	w.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	event := WebhookEvent{
+		Mid:         p.Mid,
+		Mt:          p.Mt,
+		Sid:         p.Sid,
+		Rid:         p.Rid,
+		Ct:          p.Ct,
+		ClientMid:   p.ClientMid(),
+		ContentType: p.ContentType(),
+		Ext:         p.Ext,
+		Pl:          p.Pl,
+	}
+	body, _ := json.Marshal(event)
+	return w.post(url, secret, p.Mid, body)
+}
+
+//4xx(408、429除外)说明请求本身有问题，重试也不会成功，直接进入死信
+func (w *Webhook) post(url string, secret string, mid int64, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_HEADER_TIMESTAMP, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WEBHOOK_HEADER_SIGNATURE, SignWebhook(secret, timestamp, body))
+	req.Header.Set(WEBHOOK_HEADER_DELIVERY, strconv.FormatInt(mid, 10))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook response status %d, mid=%d", resp.StatusCode, mid)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+func (w *Webhook) Close() {
+	for _, sub := range w.subs {
+		sub.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package tcpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go/redisclient"
+	"os"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	KEY_PREFIX_WORKER_ID = "dispatch#workerid#"
+	MAX_WORKER_ID        = int64(1024) //snowflake workerId取值 0 <= workerId < 1024
+
+	ErrNoFreeWorkerId = errors.New("no free worker id")
+	ErrWorkerIdLost   = errors.New("worker id lease lost")
+)
+
+//workerId租约，保证同一时间每个workerId只被一个节点使用
+type WorkerIdLease interface {
+	Acquire() (int64, error)  //申请一个空闲的workerId
+	KeepAlive(id int64) error //续约，租约已经被别人持有时返回ErrWorkerIdLost
+	Release(id int64)         //释放
+}
+
+//只有持有者才能续约和释放
+var (
+	renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+//基于redis SET NX PX的workerId租约
+type RedisWorkerIdLease struct {
+	pool  *redisclient.Client
+	ttl   time.Duration
+	owner string //当前节点标识，主机名 + pid + 随机数
+}
+
+func NewRedisWorkerIdLease(pool *redisclient.Client, ttl time.Duration) *RedisWorkerIdLease {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return &RedisWorkerIdLease{
+		pool:  pool,
+		ttl:   ttl,
+		owner: fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b)),
+	}
+}
+
+func (l *RedisWorkerIdLease) key(id int64) string {
+	return fmt.Sprintf("%s%d", KEY_PREFIX_WORKER_ID, id)
+}
+
+func (l *RedisWorkerIdLease) Acquire() (int64, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	for id := int64(0); id < MAX_WORKER_ID; id++ {
+		reply, err := redis.String(conn.Do("SET", l.key(id), l.owner, "NX", "PX", int64(l.ttl/time.Millisecond)))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if reply == "OK" {
+			return id, nil
+		}
+	}
+
+	return 0, ErrNoFreeWorkerId
+}
+
+func (l *RedisWorkerIdLease) KeepAlive(id int64) error {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(renewScript.Do(conn, l.key(id), l.owner, int64(l.ttl/time.Millisecond)))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWorkerIdLost
+	}
+	return nil
+}
+
+func (l *RedisWorkerIdLease) Release(id int64) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	releaseScript.Do(conn, l.key(id), l.owner)
+}